@@ -42,6 +42,10 @@ func addPlugins(db *gorm.DB) {
 		CollectCallerDepth:     5,                     // if we want to collect details about where the SQL query was performed, enter how far we want to look up the call chain
 		AutoPurgeAge:           time.Hour * 24 * 7,    // automatically purge data older than 7 days
 		CollectSystemResources: true,                  // periodically collect the CPU and memory usage
+		CollectTransactions:    true,                  // track transaction duration, statement count, idle time, and commit/rollback outcome
+		SampleRate:             1,                     // fraction of statements to record, lower this on high traffic applications. Totals are scaled so they remain unbiased
+		SampleKeepErrors:       true,                  // always record statements that return an error regardless of the sample rate
+		SampleKeepSlowerThan:   time.Second,           // always record statements taking at least this long regardless of the sample rate
 		StopTimeLimit:          time.Second * 5,       // default length of time to wait when stopping the plugin when the plugin is being unregistered
 		SkipAutomigration:      false,                 // if you want to skip the automigration of the SQLInsights tables, set this to true, but make sure you do this at least once after each update to the plugin
 
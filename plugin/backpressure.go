@@ -0,0 +1,151 @@
+package insights
+
+import (
+	"time"
+)
+
+// BackpressurePolicy defines what happens to a statistic when the statistics buffer is full
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock waits for room in the buffer, slowing down statements until the collector catches up or the plugin is stopped. This is the default, statistics are only dropped once the plugin is stopped
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureDropNewest drops the statistic being added, statements are never slowed down
+	BackpressureDropNewest
+	// BackpressureDropOldest drops the oldest buffered statistic to make room for the one being added
+	BackpressureDropOldest
+	// BackpressureBlockTimeout waits up to Config.BackpressureTimeout for room in the buffer before dropping the statistic being added
+	BackpressureBlockTimeout
+)
+
+const (
+	// _backpressureRetryInterval is how often a blocked statement retries adding its statistic to the stats queue
+	_backpressureRetryInterval = time.Millisecond
+)
+
+// String returns the name of the backpressure policy
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case BackpressureBlock:
+		return "block"
+	case BackpressureDropNewest:
+		return "drop_newest"
+	case BackpressureDropOldest:
+		return "drop_oldest"
+	case BackpressureBlockTimeout:
+		return "block_timeout"
+	}
+	return "unknown"
+}
+
+// insightsAddStatFull applies the configured backpressure policy to a statistic that did not fit in the full stats queue
+func (s *SQLInsights) insightsAddStatFull(statValue *stat) {
+	// wake the collector so it makes room
+	s.wakeCollector()
+
+	switch s.config.Backpressure {
+	case BackpressureDropOldest:
+		// make room by dropping the oldest statistics until ours fits
+		for !s.statsQueue.push(statValue) {
+			if oldest, ok := s.statsQueue.pop(); ok {
+				releaseStat(oldest)
+				s.droppedStats.Add(1)
+			}
+		}
+		return
+	case BackpressureBlock, BackpressureBlockTimeout:
+		var deadline <-chan time.Time
+		if s.config.Backpressure == BackpressureBlockTimeout {
+			timer := time.NewTimer(s.config.BackpressureTimeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		retry := time.NewTicker(_backpressureRetryInterval)
+		defer retry.Stop()
+	wait:
+		for {
+			select {
+			case <-retry.C:
+				if s.statsQueue.push(statValue) {
+					return
+				}
+				s.wakeCollector()
+			case <-deadline:
+				// waited long enough, drop it
+				break wait
+			case <-s.stopping:
+				// stopped, nothing will collect it anymore, drop it
+				break wait
+			}
+		}
+	}
+
+	// drop the newest statistic, ours
+	releaseStat(statValue)
+	s.droppedStats.Add(1)
+}
+
+// sendWithBackpressure sends the value to the channel, applying the configured backpressure policy when the channel is full. Returns the number of values dropped
+func sendWithBackpressure[T any](s *SQLInsights, ch chan T, value T) int64 {
+	select {
+	case ch <- value:
+		return 0
+	default:
+	}
+
+	switch s.config.Backpressure {
+	case BackpressureDropOldest:
+		// make room by dropping the oldest values until ours fits
+		var dropped int64
+		for {
+			select {
+			case ch <- value:
+				return dropped
+			case <-ch:
+				dropped++
+			}
+		}
+	case BackpressureBlock, BackpressureBlockTimeout:
+		var deadline <-chan time.Time
+		if s.config.Backpressure == BackpressureBlockTimeout {
+			timer := time.NewTimer(s.config.BackpressureTimeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case ch <- value:
+			return 0
+		case <-deadline:
+			// waited long enough, drop it
+		case <-s.stopping:
+			// stopped, nothing will collect it anymore, drop it
+		}
+	}
+	return 1
+}
+
+// unsafeCollectDrops returns the number of statistics dropped since the previous report per buffer: stats, transaction stats, and repetitions, adding them to the cumulative metrics.
+// It is not thread safe and assumes statsLock is already locked
+func (s *SQLInsights) unsafeCollectDrops() [3]int64 {
+	dropped := [3]int64{s.droppedStats.Swap(0), s.droppedTxStats.Swap(0), s.droppedRepetitions.Swap(0)}
+	s.metrics.droppedStats += dropped[0]
+	s.metrics.droppedTxStats += dropped[1]
+	s.metrics.droppedRepetitions += dropped[2]
+	return dropped
+}
+
+// buildDropHistory returns the history record of the statistics dropped since the previous report, see unsafeCollectDrops, or nil if none were dropped
+func (s *SQLInsights) buildDropHistory(bucket reportBucket, dropped [3]int64) *SQLInsightsDropHistory {
+	if dropped == [3]int64{} {
+		return nil
+	}
+	return &SQLInsightsDropHistory{
+		InstanceID:  s.instanceAppID,
+		CreatedAt:   bucket.Start,
+		EndedAt:     bucket.End,
+		Policy:      s.config.Backpressure.String(),
+		Stats:       dropped[0],
+		TxStats:     dropped[1],
+		Repetitions: dropped[2],
+	}
+}
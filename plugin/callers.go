@@ -1,19 +1,69 @@
 package insights
 
 import (
+	"database/sql"
+	"encoding/binary"
+	"net/url"
+	"path"
 	"reflect"
 	"runtime"
+	"runtime/debug"
 	"strings"
+	"sync"
 
 	"gorm.io/gorm"
 )
 
 var (
 	// import paths for caller filtering
-	_packageImportPath = reflect.TypeOf(SQLInsights{}).PkgPath() + "."
-	_gormImportPath    = reflect.TypeOf(gorm.DB{}).PkgPath() + "."
+	_packageImportPath     = reflect.TypeOf(SQLInsights{}).PkgPath() + "."
+	_gormImportPath        = reflect.TypeOf(gorm.DB{}).PkgPath() + "."
+	_databaseSQLImportPath = reflect.TypeOf(sql.DB{}).PkgPath() + "."
+
+	// _buildModules returns the versioned modules the binary was built with, read once from its build info
+	_buildModules = sync.OnceValue(func() []*debug.Module {
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return nil
+		}
+		modules := make([]*debug.Module, 0, len(info.Deps))
+		for _, dep := range info.Deps {
+			if dep.Replace != nil {
+				// use the module we were actually built with, keeping the path code imports it by
+				dep = &debug.Module{Path: dep.Path, Version: dep.Replace.Version}
+			}
+			if dep.Version != "" && dep.Version != "(devel)" {
+				modules = append(modules, dep)
+			}
+		}
+		return modules
+	})
+)
+
+const (
+	// _maxCachedCallers is the maximum number of resolved caller stacks cached before the cache is reset
+	_maxCachedCallers = 10000
+
+	// _maxCachedFrames is the maximum number of resolved program counters cached before the cache is reset
+	_maxCachedFrames = 50000
+
+	// _callerSkip is the number of stack frames skipped when capturing callers (runtime.Callers, our capture function, our caller, and the gorm related functions)
+	_callerSkip = 5
+
+	// _minCallerFrames is the initial number of program counters captured beyond the caller depth, to get past the frames of our package, GORM, and database/sql
+	_minCallerFrames = 15
+
+	// _maxCallerPCs is the maximum number of program counters captured for a stack
+	_maxCallerPCs = 128
 )
 
+// cachedCallers holds the resolved callers of a captured stack along with their serialized JSON and hash
+type cachedCallers struct {
+	callers []*callerInfo
+	json    []byte
+	hash    string
+}
+
 // callerInfo is a struct that holds information about the function that performed the DB operation
 type callerInfo struct {
 	Filename string
@@ -21,46 +71,268 @@ type callerInfo struct {
 	Function string
 }
 
+// callerFrame is a single frame resolved from a program counter
+type callerFrame struct {
+	info *callerInfo
+	skip bool // belongs to our package, GORM, database/sql, or Config.CallerSkipPackagePrefixes
+}
+
+// callerCache caches the callers resolved from captured stacks, along with their JSON and precomputed hash, and the frames resolved from each program counter.
+// Stacks seen before are resolved without symbolizing or allocating, and new stacks only symbolize program counters not seen before
+type callerCache struct {
+	lock   sync.RWMutex
+	stacks map[string]*cachedCallers // depth and program counters -> callers
+	frames map[uintptr][]callerFrame // program counter -> frames, inlined functions first
+}
+
+// newCallerCache creates a new empty caller cache
+func newCallerCache() *callerCache {
+	return &callerCache{
+		stacks: make(map[string]*cachedCallers, 100),
+		frames: make(map[uintptr][]callerFrame, 100),
+	}
+}
+
 // getCallers returns the calling functions for the current DB operation. The depth parameter specifies how many callers to collect in the stack
-func getCallers(depth int) []*callerInfo {
+func (s *SQLInsights) getCallers(depth int) []*callerInfo {
 	if depth < 1 {
 		// not collecting callers
 		return nil
 	}
-	// storage for caller function pointers, allocate min capacity of 15
-	fptrs := make([]uintptr, 5+depth)
-	// get callers, skip 5 levels (this function, our caller, and the gorm related functions)
-	if runtime.Callers(5, fptrs) == 0 {
+	// capture into a buffer on our stack, only as many program counters as stacks have needed so far
+	var buf [_maxCallerPCs]uintptr
+	size := min(depth+s.captureFrames(), _maxCallerPCs)
+	n := runtime.Callers(_callerSkip, buf[:size])
+	if n == 0 {
 		// nothing there, return blank
 		return nil
 	}
+	return s.lookupCallers(buf[:n], depth, n == size).callers
+}
 
-	// loop through callers and collect function call stack details
+// callerPCs captures the program counters of the calling functions for the current DB operation into pcs, reusing its capacity, so they can be resolved later by lookupCallers
+func (s *SQLInsights) callerPCs(pcs []uintptr, depth int) []uintptr {
+	if depth < 1 {
+		// not collecting callers
+		return pcs[:0]
+	}
+	if size := min(depth+s.captureFrames(), _maxCallerPCs); cap(pcs) < size {
+		pcs = make([]uintptr, size)
+	}
+	return pcs[:runtime.Callers(_callerSkip, pcs[:cap(pcs)])]
+}
+
+// captureFrames returns the number of program counters to capture beyond the caller depth
+func (s *SQLInsights) captureFrames() int {
+	return max(int(s.callerFrames.Load()), _minCallerFrames)
+}
+
+// lookupCallers returns up to depth callers resolved from the captured program counters, along with their JSON and hash, resolving and caching them if the stack was not seen before.
+// Truncated tells if the capture buffer was filled, in which case more program counters are captured from now on when the callers fall short of the depth
+func (s *SQLInsights) lookupCallers(pcs []uintptr, depth int, truncated bool) *cachedCallers {
+	// build our cache key from the depth and program counters in a buffer on our stack, so the lookup does not allocate
+	var keyBuf [8 * (_maxCallerPCs + 1)]byte
+	key := binary.LittleEndian.AppendUint64(keyBuf[:0], uint64(depth))
+	for _, pc := range pcs {
+		key = binary.LittleEndian.AppendUint64(key, uint64(pc))
+	}
+
+	cache := s.callerCache
+	cache.lock.RLock()
+	cached, ok := cache.stacks[string(key)]
+	cache.lock.RUnlock()
+	if ok {
+		return cached
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cached, ok := cache.stacks[string(key)]; ok {
+		// resolved while we were waiting
+		return cached
+	}
+	cached = &cachedCallers{callers: s.unsafeResolveCallers(pcs, depth)}
+	cached.json, cached.hash = s.hashCallers(cached.callers)
+	if len(cache.stacks) >= _maxCachedCallers {
+		// too many distinct stacks, start over rather than growing without bounds
+		clear(cache.stacks)
+	}
+	cache.stacks[string(key)] = cached
+
+	if truncated && len(cached.callers) < depth {
+		// the stack goes deeper than we captured, capture more from now on
+		if frames := s.captureFrames(); depth+frames < _maxCallerPCs {
+			s.callerFrames.Store(int64(frames * 2))
+		}
+	}
+	return cached
+}
+
+// unsafeResolveCallers returns up to depth calling functions outside of our package, GORM, database/sql, and Config.CallerSkipPackagePrefixes for the specified program counters, including inlined functions.
+// It is not thread safe and assumes the caller cache lock is already locked
+func (s *SQLInsights) unsafeResolveCallers(pcs []uintptr, depth int) []*callerInfo {
 	ret := make([]*callerInfo, 0, depth)
-	for _, p := range fptrs {
-		if p == 0 {
+	for _, pc := range pcs {
+		if pc == 0 {
 			continue
 		}
-		if f := runtime.FuncForPC(p); f != nil {
-			// get line function name
-			funcNameWithPath := f.Name()
-			if !strings.HasPrefix(funcNameWithPath, _packageImportPath) &&
-				!strings.HasPrefix(funcNameWithPath, _gormImportPath) {
-				// outside of our package and GORM, so we can stop here
-				fileName, fileLine := f.FileLine(p)
-				ret = append(ret, &callerInfo{
-					Filename: fileName,
-					Line:     fileLine,
-					Function: funcNameWithPath,
-				})
-				depth--
-				if depth <= 0 {
-					// we have collected our max callers
-					return ret
-				}
+		frames, ok := s.callerCache.frames[pc]
+		if !ok {
+			if len(s.callerCache.frames) >= _maxCachedFrames {
+				// too many distinct program counters, start over rather than growing without bounds
+				clear(s.callerCache.frames)
+			}
+			frames = s.resolveFrames(pc)
+			s.callerCache.frames[pc] = frames
+		}
+		for _, frame := range frames {
+			if frame.skip {
+				continue
+			}
+			// outside of our package, GORM, database/sql, and the skipped packages
+			ret = append(ret, frame.info)
+			if len(ret) >= depth {
+				// we have collected our max callers
+				return ret
 			}
 		}
 	}
-
 	return ret
 }
+
+// resolveFrames resolves the frames of a single program counter, which are several frames when functions were inlined at the call
+func (s *SQLInsights) resolveFrames(pc uintptr) []callerFrame {
+	frames := make([]callerFrame, 0, 1)
+	callersFrames := runtime.CallersFrames([]uintptr{pc})
+	for {
+		frame, more := callersFrames.Next()
+		if frame.Function != "" {
+			frames = append(frames, callerFrame{
+				info: &callerInfo{
+					Filename: callerFilename(frame.Function, frame.File),
+					Line:     frame.Line,
+					Function: frame.Function,
+				},
+				skip: strings.HasPrefix(frame.Function, _packageImportPath) ||
+					strings.HasPrefix(frame.Function, _gormImportPath) ||
+					strings.HasPrefix(frame.Function, _databaseSQLImportPath) ||
+					s.skipCallerPackage(frame.Function),
+			})
+		}
+		if !more {
+			return frames
+		}
+	}
+}
+
+// skipCallerPackage returns true if the function belongs to a package of Config.CallerSkipPackagePrefixes
+func (s *SQLInsights) skipCallerPackage(function string) bool {
+	if len(s.config.CallerSkipPackagePrefixes) == 0 {
+		return false
+	}
+	function = unescapeFunction(function)
+	for _, prefix := range s.config.CallerSkipPackagePrefixes {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// callerFilename returns the file name of a caller relative to the import path of the package of its function, versioned for dependencies, so it does not depend on where or how the binary was built.
+// Ex. github.com/myorg/myapp/users/repository.go or github.com/myorg/lib@v1.2.3/db/query.go. Returns the file name unchanged if the package cannot be determined
+func callerFilename(function, fileName string) string {
+	pkg := functionPackage(function)
+	if pkg == "" {
+		return fileName
+	}
+	return versionedPackagePath(pkg) + "/" + path.Base(fileName)
+}
+
+// functionPackage returns the import path of the package of a fully qualified function name, ex. github.com/myorg/myapp/users for github.com/myorg/myapp/users.(*Repository).Find
+func functionPackage(function string) string {
+	end := functionPackageEnd(function)
+	if end < 0 {
+		return ""
+	}
+	return unescapePackagePath(function[:end])
+}
+
+// unescapeFunction returns the fully qualified function name with the import path of its package unescaped, see unescapePackagePath
+func unescapeFunction(function string) string {
+	if strings.IndexByte(function, '%') < 0 {
+		return function
+	}
+	end := functionPackageEnd(function)
+	if end < 0 {
+		return function
+	}
+	return unescapePackagePath(function[:end]) + function[end:]
+}
+
+// functionPackageEnd returns the index of the dot ending the import path of the package of a fully qualified function name, or -1 if it has none
+func functionPackageEnd(function string) int {
+	slash := strings.LastIndexByte(function, '/')
+	dot := strings.IndexByte(function[slash+1:], '.')
+	if dot < 0 {
+		return -1
+	}
+	return slash + 1 + dot
+}
+
+// unescapePackagePath returns the import path of a package as found in a function name, where the linker escapes the dots of the last path element, ex. gopkg.in/yaml%2ev3 for gopkg.in/yaml.v3
+func unescapePackagePath(pkg string) string {
+	if strings.IndexByte(pkg, '%') < 0 {
+		return pkg
+	}
+	if unescaped, err := url.PathUnescape(pkg); err == nil {
+		return unescaped
+	}
+	return pkg
+}
+
+// versionedPackagePath returns the import path of the package with the version of its module inserted after the module path if it belongs to a versioned dependency, ex. gorm.io/gorm@v1.25.12/clause
+func versionedPackagePath(pkg string) string {
+	var module *debug.Module
+	for _, dep := range _buildModules() {
+		if (pkg == dep.Path || strings.HasPrefix(pkg, dep.Path+"/")) && (module == nil || len(dep.Path) > len(module.Path)) {
+			module = dep
+		}
+	}
+	if module == nil {
+		// our main module or the standard library
+		return pkg
+	}
+	return module.Path + "@" + module.Version + pkg[len(module.Path):]
+}
+
+// unsafeResolveStatCallers resolves the captured program counters of the stat into its callers, reusing the callers previously resolved for the same stack.
+// It is not thread safe and assumes statsLock is already locked
+func (s *SQLInsights) unsafeResolveStatCallers(statValue *stat) {
+	if len(statValue.pcs) == 0 {
+		return
+	}
+	cached := s.lookupCallers(statValue.pcs, s.config.CollectCallerDepth, len(statValue.pcs) == cap(statValue.pcs))
+	statValue.Callers, statValue.CallerJSON, statValue.CallerHash = cached.callers, cached.json, cached.hash
+}
+
+// unsafeBoundCallers limits the number of distinct callers recorded per statement per report interval, recording executions from additional callers without their callers once the limit has been reached.
+// It is not thread safe and assumes statsLock is already locked
+func (s *SQLInsights) unsafeBoundCallers(statValue *stat) {
+	if statValue.CallerHash == "" {
+		return
+	}
+	callerHashes, ok := s.callerSets[statValue.KeyHash]
+	if !ok {
+		callerHashes = make(map[string]struct{}, 1)
+		s.callerSets[statValue.KeyHash] = callerHashes
+	}
+	if _, ok := callerHashes[statValue.CallerHash]; ok {
+		return
+	}
+	if len(callerHashes) >= s.config.MaxCallersPerHash {
+		statValue.Callers, statValue.CallerJSON, statValue.CallerHash = nil, nil, ""
+		return
+	}
+	callerHashes[statValue.CallerHash] = struct{}{}
+}
@@ -1,18 +1,25 @@
 package insights
 
 import (
+	"context"
 	"encoding/json"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+var (
+	// _statDBContext marks the statements storing/querying statistics so a wrapped database/sql driver does not record them
+	_statDBContext = context.WithValue(context.Background(), gormStatementContextKey{}, struct{}{})
+)
+
 // SQLInsightsHash defines a hash of a SQL statement and the first time it was seen
 type SQLInsightsHash struct {
 	ID        string    `gorm:"size:32;primaryKey"` // key hash
 	CreatedAt time.Time `gorm:"type:datetime(6)"`   // created/first seen
 	Statement string    `gorm:"size:4096"`          // SQL statement our hash is based on
 	NumVars   int       ``                          // number of variables in the SQL statement
+	Name      string    `gorm:"size:191"`           // human readable name set at the call site with the SettingName directive
 }
 
 // SQLInsightsApp defines an application/instance so we can segregate statistics by different applications or instances. Ex. API instances running in different regions or Lambda functions
@@ -21,30 +28,58 @@ type SQLInsightsApp struct {
 	InstanceAppName string `gorm:"size:191;index"`           // application/Instance ID/name
 }
 
+// _schemaVersion is the version of the stored statistics, bumped whenever stored values must be converted by GormStore.Migrate
+const _schemaVersion = 1
+
+// SQLInsightsSchema records the version of the stored statistics, a single row converted statistics are tracked with
+type SQLInsightsSchema struct {
+	ID      uint `gorm:"primaryKey;autoIncrement:false"` // always 1
+	Version int  ``                                      // version of the stored statistics, see _schemaVersion
+}
+
 // SQLInsightsHistory defines a historical record of a specific SQL statement at the specified time for the specified instance
 type SQLInsightsHistory struct {
 	ID         uint      `gorm:"primaryKey;autoIncrement"` // auto incrementing ID
 	InstanceID uint      `gorm:"index"`                    // SQLInsightsApp ID
-	CreatedAt  time.Time `gorm:"type:datetime(6)"`         // History aggregation
+	CreatedAt  time.Time `gorm:"type:datetime(6)"`         // start of the report interval, aligned to the wall clock
+	EndedAt    time.Time `gorm:"type:datetime(6)"`         // end of the report interval
 	HashID     string    `gorm:"size:32;index"`            // hash ID
 	Type       statType  `gorm:"size:12;index"`            // stat type
+	Database   string    `gorm:"size:64;index"`            // database name, see SQLInsights.Database
+	Connection string    `gorm:"size:64"`                  // connection the statements were executed on (source, replica, or a name set with DatabasePlugin.NameConnection)
+	CallerHash string    `gorm:"size:32;index"`            // caller hash of the executions, empty when callers are not collected or the statement exceeded Config.MaxCallersPerHash
+	Labels     string    `gorm:"size:255;index"`           // encoded context labels (route, tenant, job, etc.)
 	Errors     int       ``                                // number of errors
+	Slow       int       ``                                // number of executions at or above their slow threshold
+	TraceID    string    `gorm:"size:32"`                  // trace ID of the slowest execution at or above its slow threshold, an exemplar to look up in your tracing backend
 	CPU        float64   `gorm:"type:decimal(3,2)"`        // CPU percentage (0.00-1.00)
 	Mem        float64   `gorm:"type:decimal(3,2)"`        // memory percentage (0.00-1.00)
-	Count      int       ``                                // number of executions
+	Count      int       ``                                // number of executions, estimated from the sampled executions when sampling
+	SampleRate float64   `gorm:"type:decimal(7,6)"`        // effective sample rate (0.000001-1.000000) of the recorded executions
 	RowsMin    int64     `gorm:"type:bigint"`              // minimum number of rows affected/returned
 	RowsMax    int64     `gorm:"type:bigint"`              // maximum number of rows affected/returned
 	RowsAvg    int64     `gorm:"type:bigint"`              // average/mean number of rows affected/returned
 	RowsSum    int64     `gorm:"type:bigint"`              // total number of rows affected/returned
 	RowsMed    int64     `gorm:"type:bigint"`              // median number of rows affected/returned
+	RowsP90    int64     `gorm:"type:bigint"`              // 90th percentile number of rows affected/returned
+	RowsP95    int64     `gorm:"type:bigint"`              // 95th percentile number of rows affected/returned
+	RowsP99    int64     `gorm:"type:bigint"`              // 99th percentile number of rows affected/returned
+	RowsP999   int64     `gorm:"type:bigint"`              // 99.9th percentile number of rows affected/returned
+	RowsStdDev float64   `gorm:"type:decimal(20,6)"`       // standard deviation of the number of rows affected/returned
 	TookMin    float64   `gorm:"type:decimal(14,6)"`       // minimum execution duration in fractional milliseconds
 	TookMax    float64   `gorm:"type:decimal(14,6)"`       // maximum execution duration in fractional milliseconds
 	TookAvg    float64   `gorm:"type:decimal(14,6)"`       // average/mean execution duration in fractional milliseconds
 	TookMed    float64   `gorm:"type:decimal(14,6)"`       // median execution duration in fractional milliseconds
+	TookP90    float64   `gorm:"type:decimal(14,6)"`       // 90th percentile execution duration in fractional milliseconds
+	TookP95    float64   `gorm:"type:decimal(14,6)"`       // 95th percentile execution duration in fractional milliseconds
+	TookP99    float64   `gorm:"type:decimal(14,6)"`       // 99th percentile execution duration in fractional milliseconds
+	TookP999   float64   `gorm:"type:decimal(14,6)"`       // 99.9th percentile execution duration in fractional milliseconds
+	TookStdDev float64   `gorm:"type:decimal(14,6)"`       // standard deviation of the execution duration in fractional milliseconds
+	Latency    string    `gorm:"size:255"`                 // comma separated execution counts per latency bucket, see LatencyBucketBounds
 	TookSum    float64   `gorm:"type:decimal(14,6)"`       // total execution duration in fractional milliseconds
 }
 
-// SQLInsightsCallerHistory defines a historcal record of a specified SQL statement and the caller information when first seen
+// SQLInsightsCallerHistory defines a historcal record of a specified SQL statement and the caller information when first seen. The statistics per caller are stored in SQLInsightsHistory by caller hash
 type SQLInsightsCallerHistory struct {
 	ID        string    `gorm:"primaryKey;size:32"`       // caller hash
 	CreatedAt time.Time `gorm:"type:datetime(6)"`         // created/first seen
@@ -52,6 +87,92 @@ type SQLInsightsCallerHistory struct {
 	Value     []byte    `gorm:"type:LONGBLOB"`            // caller value
 }
 
+// SQLInsightsTxHistory defines a historical record of transactions sharing the same first SQL statement and caller at the specified time for the specified instance
+type SQLInsightsTxHistory struct {
+	ID            uint      `gorm:"primaryKey;autoIncrement"` // auto incrementing ID
+	InstanceID    uint      `gorm:"index"`                    // SQLInsightsApp ID
+	CreatedAt     time.Time `gorm:"type:datetime(6)"`         // start of the report interval, aligned to the wall clock
+	EndedAt       time.Time `gorm:"type:datetime(6)"`         // end of the report interval
+	HashID        string    `gorm:"size:32;index"`            // hash ID of the first statement executed in the transaction
+	CallerHash    string    `gorm:"size:32"`                  // caller hash of the first statement executed in the transaction
+	Count         int       ``                                // number of transactions
+	Commits       int       ``                                // number of committed transactions
+	Rollbacks     int       ``                                // number of rolled back transactions, including failed commits
+	StatementsMax int       ``                                // maximum number of statements executed in a transaction
+	StatementsSum int       ``                                // total number of statements executed in all transactions
+	TookMin       float64   `gorm:"type:decimal(14,6)"`       // minimum transaction duration in fractional milliseconds
+	TookMax       float64   `gorm:"type:decimal(14,6)"`       // maximum transaction duration in fractional milliseconds
+	TookAvg       float64   `gorm:"type:decimal(14,6)"`       // average/mean transaction duration in fractional milliseconds
+	TookSum       float64   `gorm:"type:decimal(14,6)"`       // total transaction duration in fractional milliseconds
+	IdleMax       float64   `gorm:"type:decimal(14,6)"`       // maximum idle time between statements of a transaction in fractional milliseconds
+	IdleSum       float64   `gorm:"type:decimal(14,6)"`       // total idle time between statements of all transactions in fractional milliseconds
+	HashIDs       []byte    `gorm:"type:LONGBLOB"`            // JSON list of the hash IDs of the statements executed in the transactions
+}
+
+// SQLInsightsRepetitionHistory defines a historical record of a SQL statement repeated within single units of work (N+1 queries) from the same caller at the specified time for the specified instance
+type SQLInsightsRepetitionHistory struct {
+	ID             uint      `gorm:"primaryKey;autoIncrement"` // auto incrementing ID
+	InstanceID     uint      `gorm:"index"`                    // SQLInsightsApp ID
+	CreatedAt      time.Time `gorm:"type:datetime(6)"`         // start of the report interval, aligned to the wall clock
+	EndedAt        time.Time `gorm:"type:datetime(6)"`         // end of the report interval
+	HashID         string    `gorm:"size:32;index"`            // hash ID of the repeated statement
+	CallerHash     string    `gorm:"size:32"`                  // caller hash of the execution reaching the repetition threshold
+	Type           statType  `gorm:"size:12"`                  // stat type
+	Labels         string    `gorm:"size:255"`                 // encoded context labels of the units of work
+	Occurrences    int       ``                                // number of units of work the statement was repeated in
+	RepetitionsMax int       ``                                // maximum number of executions within a single unit of work
+	RepetitionsSum int       ``                                // total number of executions within all units of work
+}
+
+// SQLInsightsErrorHistory defines a historical record of the errors of a specific SQL statement by error class and code at the specified time for the specified instance
+type SQLInsightsErrorHistory struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement"` // auto incrementing ID
+	InstanceID uint      `gorm:"index"`                    // SQLInsightsApp ID
+	CreatedAt  time.Time `gorm:"type:datetime(6)"`         // start of the report interval, aligned to the wall clock
+	EndedAt    time.Time `gorm:"type:datetime(6)"`         // end of the report interval
+	HashID     string    `gorm:"size:32;index"`            // hash ID
+	Type       statType  `gorm:"size:12"`                  // stat type
+	Database   string    `gorm:"size:64;index"`            // database name, see SQLInsights.Database
+	Connection string    `gorm:"size:64"`                  // connection the statements were executed on
+	Class      string    `gorm:"size:32;index"`            // error class (deadlock, duplicate_key, timeout, etc.)
+	Code       string    `gorm:"size:32"`                  // driver specific error code, such as mysql:1213 or pg:40P01
+	Count      int       ``                                // number of errors
+	TookMax    float64   `gorm:"type:decimal(14,6)"`       // maximum execution duration of the errors in fractional milliseconds
+	TookSum    float64   `gorm:"type:decimal(14,6)"`       // total execution duration of the errors in fractional milliseconds
+	Message    string    `gorm:"size:1024"`                // sample error message
+}
+
+// SQLInsightsPoolHistory defines a historical record of the statistics of a connection pool of a monitored DB at the specified time for the specified instance
+type SQLInsightsPoolHistory struct {
+	ID                 uint      `gorm:"primaryKey;autoIncrement"` // auto incrementing ID
+	InstanceID         uint      `gorm:"index"`                    // SQLInsightsApp ID
+	CreatedAt          time.Time `gorm:"type:datetime(6);index"`   // start of the report interval, aligned to the wall clock
+	EndedAt            time.Time `gorm:"type:datetime(6)"`         // end of the report interval
+	Database           string    `gorm:"size:64;index"`            // database name, see SQLInsights.Database
+	Connection         string    `gorm:"size:64"`                  // connection name (source or a name set with DatabasePlugin.NameConnection)
+	MaxOpenConnections int       ``                                // maximum number of open connections to the database
+	OpenConnections    int       ``                                // number of established connections, both in use and idle
+	InUse              int       ``                                // number of connections currently in use
+	Idle               int       ``                                // number of idle connections
+	WaitCount          int64     `gorm:"type:bigint"`              // number of connections waited for since the previous record
+	WaitDuration       float64   `gorm:"type:decimal(14,6)"`       // time blocked waiting for a new connection since the previous record in fractional milliseconds
+	MaxIdleClosed      int64     `gorm:"type:bigint"`              // number of connections closed due to SetMaxIdleConns since the previous record
+	MaxIdleTimeClosed  int64     `gorm:"type:bigint"`              // number of connections closed due to SetConnMaxIdleTime since the previous record
+	MaxLifetimeClosed  int64     `gorm:"type:bigint"`              // number of connections closed due to SetConnMaxLifetime since the previous record
+}
+
+// SQLInsightsDropHistory defines a historical record of the statistics dropped because the statistics buffer was full at the specified time for the specified instance
+type SQLInsightsDropHistory struct {
+	ID          uint      `gorm:"primaryKey;autoIncrement"` // auto incrementing ID
+	InstanceID  uint      `gorm:"index"`                    // SQLInsightsApp ID
+	CreatedAt   time.Time `gorm:"type:datetime(6);index"`   // start of the report interval, aligned to the wall clock
+	EndedAt     time.Time `gorm:"type:datetime(6)"`         // end of the report interval
+	Policy      string    `gorm:"size:16"`                  // backpressure policy in effect
+	Stats       int64     `gorm:"type:bigint"`              // number of statement statistics dropped since the previous record
+	TxStats     int64     `gorm:"type:bigint"`              // number of transaction statistics dropped since the previous record
+	Repetitions int64     `gorm:"type:bigint"`              // number of repetition findings dropped since the previous record
+}
+
 // SetValue serializes the callers as a JSON string and stores result in Value
 func (s *SQLInsightsCallerHistory) SetValue(callers []*callerInfo) {
 	// serialize callers as JSON string and store result in Value
@@ -86,10 +207,31 @@ func autoMigration() []interface{} {
 		&SQLInsightsHash{},
 		&SQLInsightsHistory{},
 		&SQLInsightsCallerHistory{},
+		&SQLInsightsTxHistory{},
+		&SQLInsightsRepetitionHistory{},
+		&SQLInsightsErrorHistory{},
+		&SQLInsightsPoolHistory{},
+		&SQLInsightsDropHistory{},
+		&SQLInsightsSchema{},
+	}
+}
+
+// historyModels returns the history tables purged by instance and creation time, see Config.AutoPurgeAge
+func historyModels() []interface{} {
+	return []interface{}{
+		&SQLInsightsHistory{},
+		&SQLInsightsTxHistory{},
+		&SQLInsightsRepetitionHistory{},
+		&SQLInsightsErrorHistory{},
+		&SQLInsightsPoolHistory{},
+		&SQLInsightsDropHistory{},
 	}
 }
 
 // StatDB returns the DB instance used by the SQLInsights to store/query statistics, skipping hooks, just in case the same DB instance being monitored is used to store the statistics
 func (s *SQLInsights) StatDB() *gorm.DB {
-	return s.config.DB.Session(&gorm.Session{NewDB: true, SkipHooks: true})
+	if gormStore, ok := s.store.(*GormStore); ok {
+		return gormStore.DB()
+	}
+	return s.config.DB.Session(&gorm.Session{NewDB: true, SkipHooks: true, Context: _statDBContext})
 }
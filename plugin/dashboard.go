@@ -2,6 +2,7 @@ package insights
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"sort"
@@ -15,10 +16,11 @@ type DashboardConfig struct {
 	TimeLocation *time.Location
 }
 
-// DashboardMux returns a new ServeMux with the dashboard and API handlers registered
+// DashboardMux returns a new ServeMux with the dashboard, API, and Prometheus metrics handlers registered
 func (s *SQLInsights) DashboardMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api", s.apiHandler())
+	mux.HandleFunc("/metrics", s.metricsHandler())
 	mux.HandleFunc("/", s.dashboardHandler())
 	return mux
 }
@@ -76,6 +78,150 @@ func (s *SQLInsights) apiHandler() func(w http.ResponseWriter, r *http.Request)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+		case "sql_label_summary":
+			// handle the SQLLabelSummary request
+			var input SQLLabelSummaryRequest
+			if err := json.Unmarshal(body, &input); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// get the DB time per label
+			results, err := s.SQLLabelSummary(&input)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// write the response
+			if err := json.NewEncoder(w).Encode(results); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "sql_repetition_summary":
+			// handle the SQLRepetitionSummary request
+			var input SQLRepetitionSummaryRequest
+			if err := json.Unmarshal(body, &input); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// get the N+1 findings
+			results, err := s.SQLRepetitionSummary(&input)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// write the response
+			if err := json.NewEncoder(w).Encode(results); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "sql_transaction_summary":
+			// handle the SQLTransactionSummary request
+			var input SQLTransactionSummaryRequest
+			if err := json.Unmarshal(body, &input); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// get the slowest/longest transactions
+			results, err := s.SQLTransactionSummary(&input)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// write the response
+			if err := json.NewEncoder(w).Encode(results); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "sql_pool_history":
+			// handle the SQLPoolHistory request
+			var input SQLPoolHistoryRequest
+			if err := json.Unmarshal(body, &input); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// get the connection pool history
+			results, err := s.SQLPoolHistory(&input)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// write the response
+			if err := json.NewEncoder(w).Encode(results); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "sql_latency_heatmap":
+			// handle the SQLLatencyHeatmap request
+			var input SQLLatencyHeatmapRequest
+			if err := json.Unmarshal(body, &input); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// get the latency heatmap
+			results, err := s.SQLLatencyHeatmap(&input)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// write the response
+			if err := json.NewEncoder(w).Encode(results); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "sql_caller_summary":
+			// handle the SQLCallerSummary request
+			var input SQLCallerSummaryRequest
+			if err := json.Unmarshal(body, &input); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// get the call sites
+			results, err := s.SQLCallerSummary(&input)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// write the response
+			if err := json.NewEncoder(w).Encode(results); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "sql_function_summary":
+			// handle the SQLFunctionSummary request
+			var input SQLFunctionSummaryRequest
+			if err := json.Unmarshal(body, &input); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// get the statements
+			results, err := s.SQLFunctionSummary(&input)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// write the response
+			if err := json.NewEncoder(w).Encode(results); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "sql_error_summary":
+			// handle the SQLErrorSummary request
+			var input SQLErrorSummaryRequest
+			if err := json.Unmarshal(body, &input); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// get the errors by class
+			results, err := s.SQLErrorSummary(&input)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// write the response
+			if err := json.NewEncoder(w).Encode(results); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 		}
 	}
 }
@@ -90,18 +236,22 @@ type SQLQueryCountsResult struct {
 // SQLQueryCountsResultDaySummary defines the result of the SQLQueryCounts method for a single day
 type SQLQueryCountsResultDaySummary struct {
 	Day   time.Time
-	Count int
+	Count int // number of statements executed during the day, estimated when sampling
 }
 
 // SQLQueryCountsRequest defines the input for the SQLQueryCounts method
 type SQLQueryCountsRequest struct {
 	InstanceAppIDs []string
+	Databases      []string // database names to include, see SQLInsights.Database. Empty includes all databases
+	Types          []string // statement types to include (query, raw, create, update, delete, row, sql_query, sql_exec). Empty includes all types
 	From           *time.Time
 	To             *time.Time
 }
 
 type SQLQueryHistoryRequest struct {
 	InstanceAppIDs []string
+	Databases      []string // database names to include, see SQLInsights.Database. Empty includes all databases
+	Types          []string // statement types to include (query, raw, create, update, delete, row, sql_query, sql_exec). Empty includes all types
 	From           *time.Time
 	To             *time.Time
 }
@@ -110,6 +260,7 @@ type SQLQueryHistoryRequest struct {
 type SQLInsightsQueryQueryHistoryDBResult struct {
 	SQLInsightsHistory
 	InstanceAppName string
+	Name            string // human readable name of the statement, set at the call site with the SettingName directive
 }
 
 // SQLQueryHistory returns the history of SQL queries executed over a period of time to be graphed
@@ -118,40 +269,15 @@ func (s *SQLInsights) SQLQueryHistory(input *SQLQueryHistoryRequest) ([]*SQLInsi
 		return nil, nil
 	}
 
-	// setup our time range
-	var fromTime, toTime time.Time
-	if input.From != nil && !input.From.IsZero() {
-		fromTime = *input.From
-		fromTime = fromTime.UTC()
-	} else {
-		// default to 7 days ago
-		fromTime = time.Now().UTC().AddDate(0, 0, -7)
-	}
-	if input.To != nil && !input.To.IsZero() {
-		toTime = *input.To
-		toTime = toTime.UTC()
-	} else {
-		// default to now
-		toTime = time.Now().UTC()
-	}
-
-	// create query
-	query := s.StatDB().Select("sql_insights_app.instance_app_name, sql_insights_history.*")
-
-	// join on the SQLInsightsApp table to get the InstanceID
-	query = query.Joins("INNER JOIN sql_insights_app ON sql_insights_history.instance_id = sql_insights_app.id")
-	query = query.Model(&SQLInsightsHistory{}).Where("created_at >= ? AND created_at <= ?", fromTime, toTime)
-	if len(input.InstanceAppIDs) > 0 {
-		query = query.Where("instance_id IN (?)", input.InstanceAppIDs)
-	}
-
-	// get the counts
-	var results []*SQLInsightsQueryQueryHistoryDBResult
-	if err := query.Find(&results).Error; err != nil {
+	store, err := s.dashboardStore()
+	if err != nil {
 		return nil, err
 	}
 
-	return results, nil
+	filter := newHistoryFilter(input.InstanceAppIDs, input.From, input.To)
+	filter.Databases = input.Databases
+	filter.Types = input.Types
+	return store.StatementHistory(filter)
 }
 
 // SQLQueryCounts returns the number of SQL queries executed per day per ApplicationID over a period of time to be graphed
@@ -163,6 +289,8 @@ func (s *SQLInsights) SQLQueryCounts(input *SQLQueryCountsRequest) ([]*SQLQueryC
 	// query history
 	results, err := s.SQLQueryHistory(&SQLQueryHistoryRequest{
 		InstanceAppIDs: input.InstanceAppIDs,
+		Databases:      input.Databases,
+		Types:          input.Types,
 		From:           input.From,
 		To:             input.To,
 	})
@@ -173,7 +301,7 @@ func (s *SQLInsights) SQLQueryCounts(input *SQLQueryCountsRequest) ([]*SQLQueryC
 	// group the results by InstanceAppID
 	groupedResults := make(map[string][]*SQLInsightsHistory)
 	for _, result := range results {
-		if results == nil {
+		if result == nil {
 			continue
 		}
 		if _, ok := groupedResults[result.InstanceAppName]; !ok {
@@ -188,17 +316,13 @@ func (s *SQLInsights) SQLQueryCounts(input *SQLQueryCountsRequest) ([]*SQLQueryC
 		if len(instanceHistories) <= 0 {
 			continue
 		}
-		// group the histories by day
+		// sum the executions by day, history records are split by caller, labels, database, and connection so they can not simply be counted
 		groupedHistories := make(map[time.Time]int)
 		for _, history := range instanceHistories {
 			// get the day
 			createdAt := history.CreatedAt.In(s.config.DashboardConfig.TimeLocation)
 			day := time.Date(createdAt.Year(), createdAt.Month(), createdAt.Day(), 0, 0, 0, 0, s.config.DashboardConfig.TimeLocation)
-			if _, ok := groupedHistories[day]; !ok {
-				groupedHistories[day] = 1
-			} else {
-				groupedHistories[day]++
-			}
+			groupedHistories[day] += history.Count
 		}
 		// build the result
 		result := &SQLQueryCountsResult{
@@ -221,3 +345,757 @@ func (s *SQLInsights) SQLQueryCounts(input *SQLQueryCountsRequest) ([]*SQLQueryC
 
 	return finalResults, nil
 }
+
+// SQLLabelSummaryRequest defines the input for the SQLLabelSummary method
+type SQLLabelSummaryRequest struct {
+	InstanceAppIDs []string
+	Databases      []string // database names to include, see SQLInsights.Database. Empty includes all databases
+	Types          []string // statement types to include (query, raw, create, update, delete, row, sql_query, sql_exec). Empty includes all types
+	From           *time.Time
+	To             *time.Time
+	LabelKey       string // group by the value of this label key, such as "route". Empty groups by the full label set
+	Limit          int    // maximum number of results to return, defaults to 50
+}
+
+// SQLLabelSummaryResult defines the DB time and volume for a single label value or label set over a period of time
+type SQLLabelSummaryResult struct {
+	Label   string            // label value, or the encoded label set when grouping by the full label set
+	Labels  map[string]string // decoded label set when grouping by the full label set
+	Count   int
+	Errors  int
+	RowsSum int64
+	TookSum float64
+	TookMax float64
+}
+
+// SQLLabelSummary returns the DB time per label over a period of time, sorted by the total execution duration descending
+func (s *SQLInsights) SQLLabelSummary(input *SQLLabelSummaryRequest) ([]*SQLLabelSummaryResult, error) {
+	if input == nil {
+		return nil, nil
+	}
+
+	store, err := s.dashboardStore()
+	if err != nil {
+		return nil, err
+	}
+	limit := input.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+
+	// sum the history per label set in the store. The values of a label key are summed here, over all label sets since a label set does not sort like the values it contains
+	filter := newHistoryFilter(input.InstanceAppIDs, input.From, input.To)
+	filter.Databases = input.Databases
+	filter.Types = input.Types
+	storeLimit := limit
+	if input.LabelKey != "" {
+		storeLimit = 0
+	}
+	rows, err := store.StatementSummary(filter, []string{_summaryLabels}, storeLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	// group the label sets by label
+	results := make([]*SQLLabelSummaryResult, 0, len(rows))
+	grouped := make(map[string]*SQLLabelSummaryResult, len(rows))
+	for _, row := range rows {
+		label := row.Labels
+		if input.LabelKey != "" {
+			label = decodeLabels(row.Labels)[input.LabelKey]
+		}
+		result, ok := grouped[label]
+		if !ok {
+			result = &SQLLabelSummaryResult{Label: label}
+			if input.LabelKey == "" {
+				result.Labels = decodeLabels(label)
+			}
+			grouped[label] = result
+			results = append(results, result)
+		}
+		result.Count += row.Count
+		result.Errors += row.Errors
+		result.RowsSum += row.RowsSum
+		result.TookSum += row.TookSum
+		if row.TookMax > result.TookMax {
+			result.TookMax = row.TookMax
+		}
+	}
+
+	// sort the results by total DB time, then limit them
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].TookSum > results[j].TookSum
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// SQLRepetitionSummaryRequest defines the input for the SQLRepetitionSummary method
+type SQLRepetitionSummaryRequest struct {
+	InstanceAppIDs []string
+	From           *time.Time
+	To             *time.Time
+	Limit          int // maximum number of results to return, defaults to 50
+}
+
+// SQLRepetitionSummaryResult defines a statement repeated within single units of work (N+1 queries) from the same caller over a period of time
+type SQLRepetitionSummaryResult struct {
+	HashID         string
+	Statement      string
+	Name           string // human readable name of the statement, set at the call site with the SettingName directive
+	Type           statType
+	CallerHash     string
+	Callers        []*callerInfo // call stack of the execution of the statement reaching the repetition threshold in a unit of work, where the loop originates
+	Occurrences    int           // number of units of work the statement was repeated in
+	RepetitionsMax int           // maximum number of executions within a single unit of work
+	RepetitionsAvg float64       // average number of executions within a single unit of work
+	Suggestion     string        // suggested batched alternative
+}
+
+// SQLRepetitionSummary returns the statements repeated within single units of work (N+1 queries) over a period of time, sorted by the total number of repeated executions descending
+func (s *SQLInsights) SQLRepetitionSummary(input *SQLRepetitionSummaryRequest) ([]*SQLRepetitionSummaryResult, error) {
+	if input == nil {
+		return nil, nil
+	}
+
+	store, err := s.dashboardStore()
+	if err != nil {
+		return nil, err
+	}
+
+	limit := input.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+
+	// sum the repetition history per statement and caller in the store, the most repeated first
+	rows, err := store.RepetitionSummary(newHistoryFilter(input.InstanceAppIDs, input.From, input.To), limit)
+	if err != nil {
+		return nil, err
+	}
+	hashIDs := make([]string, 0, len(rows))
+	for _, row := range rows {
+		hashIDs = append(hashIDs, row.HashID)
+	}
+
+	// look up the statements and their callers
+	statements := make(map[string]string, len(hashIDs))
+	names := make(map[string]string, len(hashIDs))
+	callers := make(map[string][]*callerInfo, len(hashIDs))
+	if len(hashIDs) > 0 {
+		keyHashes, err := store.Hashes(hashIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, keyHash := range keyHashes {
+			statements[keyHash.ID] = keyHash.Statement
+			names[keyHash.ID] = keyHash.Name
+		}
+		callerHistories, err := store.Callers(hashIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, callerHistory := range callerHistories {
+			callers[callerHistory.HashID+callerHistory.ID] = callerHistory.GetValue()
+		}
+	}
+
+	// build the results
+	results := make([]*SQLRepetitionSummaryResult, 0, len(rows))
+	for _, row := range rows {
+		result := &SQLRepetitionSummaryResult{
+			HashID:         row.HashID,
+			Statement:      statements[row.HashID],
+			Name:           names[row.HashID],
+			Type:           row.Type,
+			CallerHash:     row.CallerHash,
+			Callers:        callers[row.HashID+row.CallerHash],
+			Occurrences:    row.Occurrences,
+			RepetitionsMax: row.RepetitionsMax,
+			RepetitionsAvg: float64(row.RepetitionsSum) / float64(row.Occurrences),
+		}
+		result.Suggestion = suggestBatching(result.Type, result.Statement, result.RepetitionsMax)
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// SQLTransactionSummaryRequest defines the input for the SQLTransactionSummary method
+type SQLTransactionSummaryRequest struct {
+	InstanceAppIDs []string
+	From           *time.Time
+	To             *time.Time
+	OrderBy        string // took_max (slowest, default), took_sum (longest in total), took_avg, idle_max, idle_sum, count, or rollbacks
+	Limit          int    // maximum number of results to return, defaults to 50
+}
+
+// SQLTransactionSummaryResult defines a summary of transactions sharing the same first statement and caller over a period of time
+type SQLTransactionSummaryResult struct {
+	HashID        string   // hash ID of the first statement executed in the transactions
+	Statement     string   // first statement executed in the transactions
+	Name          string   // human readable name of the first statement, set at the call site with the SettingName directive
+	CallerHash    string   // caller hash of the first statement executed in the transactions
+	HashIDs       []string // hash IDs of the statements executed in the transactions
+	Count         int
+	Commits       int
+	Rollbacks     int
+	StatementsMax int
+	StatementsAvg float64
+	TookMin       float64
+	TookMax       float64
+	TookAvg       float64
+	TookSum       float64
+	IdleMax       float64
+	IdleSum       float64
+}
+
+// SQLTransactionSummary returns the slowest/longest transactions over a period of time, grouped by their first statement and caller
+func (s *SQLInsights) SQLTransactionSummary(input *SQLTransactionSummaryRequest) ([]*SQLTransactionSummaryResult, error) {
+	if input == nil {
+		return nil, nil
+	}
+
+	store, err := s.dashboardStore()
+	if err != nil {
+		return nil, err
+	}
+
+	limit := input.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+
+	// sum the transaction history per first statement and caller in the store, sorted by the requested value descending
+	rows, err := store.TxSummary(newHistoryFilter(input.InstanceAppIDs, input.From, input.To), strings.ToLower(strings.TrimSpace(input.OrderBy)), limit)
+	if err != nil {
+		return nil, err
+	}
+	hashIDs := make([]string, 0, len(rows))
+	for _, row := range rows {
+		hashIDs = append(hashIDs, row.HashID)
+	}
+
+	// look up the first statements
+	statements := make(map[string]string, len(hashIDs))
+	names := make(map[string]string, len(hashIDs))
+	if len(hashIDs) > 0 {
+		keyHashes, err := store.Hashes(hashIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, keyHash := range keyHashes {
+			statements[keyHash.ID] = keyHash.Statement
+			names[keyHash.ID] = keyHash.Name
+		}
+	}
+
+	// build the results
+	results := make([]*SQLTransactionSummaryResult, 0, len(rows))
+	for _, row := range rows {
+		results = append(results, &SQLTransactionSummaryResult{
+			HashID:        row.HashID,
+			Statement:     statements[row.HashID],
+			Name:          names[row.HashID],
+			CallerHash:    row.CallerHash,
+			HashIDs:       row.GetHashIDs(),
+			Count:         row.Count,
+			Commits:       row.Commits,
+			Rollbacks:     row.Rollbacks,
+			StatementsMax: row.StatementsMax,
+			StatementsAvg: float64(row.StatementsSum) / float64(row.Count),
+			TookMin:       row.TookMin,
+			TookMax:       row.TookMax,
+			TookAvg:       row.TookSum / float64(row.Count),
+			TookSum:       row.TookSum,
+			IdleMax:       row.IdleMax,
+			IdleSum:       row.IdleSum,
+		})
+	}
+
+	return results, nil
+}
+
+// SQLErrorSummaryRequest defines the input for the SQLErrorSummary method
+type SQLErrorSummaryRequest struct {
+	InstanceAppIDs []string
+	Databases      []string // database names to include, see SQLInsights.Database. Empty includes all databases
+	Classes        []string // optional list of error classes to limit the results to
+	From           *time.Time
+	To             *time.Time
+	Limit          int // maximum number of statements to return per error class, defaults to 10
+}
+
+// SQLErrorSummaryResult defines the errors of a single error class over a period of time
+type SQLErrorSummaryResult struct {
+	Class      string
+	Count      int
+	TookSum    float64
+	TookMax    float64
+	Statements []*SQLErrorSummaryStatement // statements with errors of this class, sorted by count descending
+}
+
+// SQLErrorSummaryStatement defines the errors of a single error class and code for a single statement over a period of time
+type SQLErrorSummaryStatement struct {
+	HashID    string
+	Statement string
+	Name      string // human readable name of the statement, set at the call site with the SettingName directive
+	Type      statType
+	Code      string
+	Count     int
+	TookSum   float64
+	TookMax   float64
+	Message   string // most recent sample error message
+}
+
+// SQLErrorSummary returns the errors by error class over a period of time, sorted by count descending
+func (s *SQLInsights) SQLErrorSummary(input *SQLErrorSummaryRequest) ([]*SQLErrorSummaryResult, error) {
+	if input == nil {
+		return nil, nil
+	}
+
+	store, err := s.dashboardStore()
+	if err != nil {
+		return nil, err
+	}
+
+	limit := input.Limit
+	if limit <= 0 {
+		limit = 10
+	}
+
+	// sum the error history per class in the store, then the top statements and codes of each class
+	filter := newHistoryFilter(input.InstanceAppIDs, input.From, input.To)
+	filter.Databases = input.Databases
+	filter.Classes = input.Classes
+	classes, err := store.ErrorSummary(filter, []string{_summaryClass}, 0)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*SQLErrorSummaryResult, 0, len(classes))
+	hashIDs := make([]string, 0, len(classes)*limit)
+	for _, class := range classes {
+		classFilter := *filter
+		classFilter.Classes = []string{class.Class}
+		rows, err := store.ErrorSummary(&classFilter, []string{_summaryClass, _summaryCode, _summaryHashID, _summaryType}, limit)
+		if err != nil {
+			return nil, err
+		}
+		result := &SQLErrorSummaryResult{
+			Class:      class.Class,
+			Count:      class.Count,
+			TookSum:    class.TookSum,
+			TookMax:    class.TookMax,
+			Statements: make([]*SQLErrorSummaryStatement, 0, len(rows)),
+		}
+		for _, row := range rows {
+			result.Statements = append(result.Statements, &SQLErrorSummaryStatement{
+				HashID:  row.HashID,
+				Type:    row.Type,
+				Code:    row.Code,
+				Count:   row.Count,
+				TookSum: row.TookSum,
+				TookMax: row.TookMax,
+				Message: row.Message,
+			})
+			hashIDs = append(hashIDs, row.HashID)
+		}
+		results = append(results, result)
+	}
+
+	// look up the statements
+	if len(hashIDs) > 0 {
+		keyHashes, err := store.Hashes(hashIDs)
+		if err != nil {
+			return nil, err
+		}
+		statements := make(map[string]*SQLInsightsHash, len(keyHashes))
+		for _, keyHash := range keyHashes {
+			statements[keyHash.ID] = keyHash
+		}
+		for _, result := range results {
+			for _, statement := range result.Statements {
+				if keyHash, ok := statements[statement.HashID]; ok {
+					statement.Statement = keyHash.Statement
+					statement.Name = keyHash.Name
+				}
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// SQLPoolHistoryRequest defines the input for the SQLPoolHistory method
+type SQLPoolHistoryRequest struct {
+	InstanceAppIDs []string
+	Databases      []string // database names to include, see SQLInsights.Database. Empty includes all databases
+	From           *time.Time
+	To             *time.Time
+}
+
+// SQLPoolHistoryResult defines the statistics of a connection pool of an instance at a single report along with the number of statements executed on it during that report
+type SQLPoolHistoryResult struct {
+	SQLInsightsPoolHistory
+	InstanceAppName string
+	Count           int // number of statements executed on the connection pool during the report, estimated when sampling
+}
+
+// SQLPoolHistory returns the connection pool statistics over a period of time to be graphed next to the query volume, sorted by time
+func (s *SQLInsights) SQLPoolHistory(input *SQLPoolHistoryRequest) ([]*SQLPoolHistoryResult, error) {
+	if input == nil {
+		return nil, nil
+	}
+
+	store, err := s.dashboardStore()
+	if err != nil {
+		return nil, err
+	}
+
+	// query the pool history along with the instance name
+	filter := newHistoryFilter(input.InstanceAppIDs, input.From, input.To)
+	filter.Databases = input.Databases
+	results, err := store.PoolHistory(filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return results, nil
+	}
+
+	// query the statement volume of the same reports and connection pools, which share their creation time with the pool history
+	counts, err := store.ConnectionCounts(filter)
+	if err != nil {
+		return nil, err
+	}
+	countsByReport := make(map[string]int, len(counts))
+	for _, count := range counts {
+		countsByReport[fmt.Sprintf("%d|%d|%s|%s", count.InstanceID, count.CreatedAt.UnixMicro(), count.Database, count.Connection)] = count.Count
+	}
+	for _, result := range results {
+		result.Count = countsByReport[fmt.Sprintf("%d|%d|%s|%s", result.InstanceID, result.CreatedAt.UnixMicro(), result.Database, result.Connection)]
+	}
+
+	return results, nil
+}
+
+// SQLLatencyHeatmapRequest defines the input for the SQLLatencyHeatmap method
+type SQLLatencyHeatmapRequest struct {
+	InstanceAppIDs  []string
+	Databases       []string // database names to include, see SQLInsights.Database. Empty includes all databases
+	HashID          string   // optional statement hash to build the heatmap for, otherwise all statements of the instances are included
+	Types           []string // statement types to include (query, raw, create, update, delete, row, sql_query, sql_exec). Empty includes all types
+	From            *time.Time
+	To              *time.Time
+	IntervalMinutes int // width of each time column in minutes, defaults to 1
+}
+
+// SQLLatencyHeatmapResult defines a time x latency bucket matrix of execution counts
+type SQLLatencyHeatmapResult struct {
+	Bounds []float64   // upper bounds of the latency buckets in fractional milliseconds, the last bucket counts executions slower than the last bound
+	Times  []time.Time // start of each time column with executions, oldest first
+	Counts [][]int     // executions per time column and latency bucket, estimated when sampling
+}
+
+// latencyHeatmapRow defines the latency buckets of a single history record
+type latencyHeatmapRow struct {
+	CreatedAt time.Time
+	Latency   string
+}
+
+// SQLLatencyHeatmap returns the number of executions per latency bucket over a period of time to be rendered as a heatmap, for a single statement or all statements of the instances
+func (s *SQLInsights) SQLLatencyHeatmap(input *SQLLatencyHeatmapRequest) (*SQLLatencyHeatmapResult, error) {
+	if input == nil {
+		return nil, nil
+	}
+
+	store, err := s.dashboardStore()
+	if err != nil {
+		return nil, err
+	}
+
+	// query the latency buckets of the history records
+	filter := newHistoryFilter(input.InstanceAppIDs, input.From, input.To)
+	filter.Databases = input.Databases
+	filter.Types = input.Types
+	if input.HashID != "" {
+		filter.HashIDs = []string{input.HashID}
+	}
+	histories, err := store.LatencyHistory(filter)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]*latencyHeatmapRow, len(histories))
+	for idx, history := range histories {
+		rows[idx] = &latencyHeatmapRow{CreatedAt: history.CreatedAt, Latency: history.Latency}
+	}
+
+	return buildLatencyHeatmap(time.Duration(input.IntervalMinutes)*time.Minute, rows), nil
+}
+
+// buildLatencyHeatmap sums the latency buckets of the history records into time columns of the specified interval, aligned to the wall clock like the report intervals. The records must be sorted by creation time
+func buildLatencyHeatmap(interval time.Duration, rows []*latencyHeatmapRow) *SQLLatencyHeatmapResult {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	result := &SQLLatencyHeatmapResult{
+		Bounds: LatencyBucketBounds(),
+		Times:  make([]time.Time, 0, 10),
+		Counts: make([][]int, 0, 10),
+	}
+	for _, row := range rows {
+		columnTime := row.CreatedAt.UTC().Truncate(interval)
+		if len(result.Times) == 0 || !result.Times[len(result.Times)-1].Equal(columnTime) {
+			result.Times = append(result.Times, columnTime)
+			result.Counts = append(result.Counts, make([]int, _latencyBucketCount))
+		}
+		decodeLatencyBuckets(row.Latency, result.Counts[len(result.Counts)-1])
+	}
+	return result
+}
+
+// SQLCallerSummaryRequest defines the input for the SQLCallerSummary method
+type SQLCallerSummaryRequest struct {
+	InstanceAppIDs []string
+	Databases      []string // database names to include, see SQLInsights.Database. Empty includes all databases
+	HashID         string   // statement hash to list the call sites of
+	From           *time.Time
+	To             *time.Time
+	Limit          int // maximum number of results to return, defaults to 20
+}
+
+// SQLCallerSummaryResult defines the executions of a statement from a single call site over a period of time
+type SQLCallerSummaryResult struct {
+	CallerHash string        // empty for executions recorded without their callers, see Config.MaxCallersPerHash
+	Callers    []*callerInfo // call stack of the call site
+	Count      int
+	Errors     int
+	Slow       int
+	RowsSum    int64
+	TookSum    float64
+	TookMax    float64
+	TookAvg    float64
+}
+
+// SQLCallerSummary returns the call sites of a statement over a period of time, sorted by the total execution duration descending, to tell which call site is responsible for the load
+func (s *SQLInsights) SQLCallerSummary(input *SQLCallerSummaryRequest) ([]*SQLCallerSummaryResult, error) {
+	if input == nil || input.HashID == "" {
+		return nil, nil
+	}
+
+	store, err := s.dashboardStore()
+	if err != nil {
+		return nil, err
+	}
+
+	limit := input.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+
+	// sum the history of the statement per caller in the store, the most DB time first
+	filter := newHistoryFilter(input.InstanceAppIDs, input.From, input.To)
+	filter.Databases = input.Databases
+	filter.HashIDs = []string{input.HashID}
+	rows, err := store.StatementSummary(filter, []string{_summaryCallerHash}, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// look up the callers
+	callers := make(map[string][]*callerInfo, len(rows))
+	if len(rows) > 0 {
+		callerHistories, err := store.Callers([]string{input.HashID})
+		if err != nil {
+			return nil, err
+		}
+		for _, callerHistory := range callerHistories {
+			callers[callerHistory.ID] = callerHistory.GetValue()
+		}
+	}
+
+	// build the results
+	results := make([]*SQLCallerSummaryResult, 0, len(rows))
+	for _, row := range rows {
+		result := &SQLCallerSummaryResult{
+			CallerHash: row.CallerHash,
+			Callers:    callers[row.CallerHash],
+			Count:      row.Count,
+			Errors:     row.Errors,
+			Slow:       row.Slow,
+			RowsSum:    row.RowsSum,
+			TookSum:    row.TookSum,
+			TookMax:    row.TookMax,
+		}
+		if result.Count > 0 {
+			result.TookAvg = result.TookSum / float64(result.Count)
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// SQLFunctionSummaryRequest defines the input for the SQLFunctionSummary method
+type SQLFunctionSummaryRequest struct {
+	InstanceAppIDs []string
+	Databases      []string // database names to include, see SQLInsights.Database. Empty includes all databases
+	Function       string   // fully qualified name of a function in the recorded call stacks, ex. github.com/myorg/myapp/users.(*Repository).Find
+	From           *time.Time
+	To             *time.Time
+	Limit          int // maximum number of results to return, defaults to 20
+}
+
+// SQLFunctionSummaryResult defines the executions of a statement from call sites including a function over a period of time
+type SQLFunctionSummaryResult struct {
+	HashID       string
+	Statement    string
+	Name         string // human readable name of the statement, set at the call site with the SettingName directive
+	Type         statType
+	CallerHashes []string // call sites of the statement whose call stack includes the function
+	Count        int
+	Errors       int
+	Slow         int
+	RowsSum      int64
+	TookSum      float64
+	TookMax      float64
+	TookAvg      float64
+}
+
+// SQLFunctionSummary returns the statements executed from call sites including a function over a period of time, sorted by the total execution duration descending
+func (s *SQLInsights) SQLFunctionSummary(input *SQLFunctionSummaryRequest) ([]*SQLFunctionSummaryResult, error) {
+	if input == nil || input.Function == "" {
+		return nil, nil
+	}
+
+	store, err := s.dashboardStore()
+	if err != nil {
+		return nil, err
+	}
+
+	// find the call sites including the function. The serialized callers narrow them down, the decoded callers are matched exactly
+	callerHistories, err := store.CallersContaining(input.Function)
+	if err != nil {
+		return nil, err
+	}
+	callSites := make(map[string]struct{}, len(callerHistories))
+	hashIDs := make([]string, 0, len(callerHistories))
+	callerHashes := make([]string, 0, len(callerHistories))
+	for _, callerHistory := range callerHistories {
+		if !callersInclude(callerHistory.GetValue(), input.Function) {
+			continue
+		}
+		if _, ok := callSites[callerHistory.HashID+callerHistory.ID]; !ok {
+			callSites[callerHistory.HashID+callerHistory.ID] = struct{}{}
+			hashIDs = append(hashIDs, callerHistory.HashID)
+			callerHashes = append(callerHashes, callerHistory.ID)
+		}
+	}
+	if len(hashIDs) == 0 {
+		return []*SQLFunctionSummaryResult{}, nil
+	}
+
+	// sum the history of the call sites per statement and caller in the store, then group the call sites including the function by statement
+	filter := newHistoryFilter(input.InstanceAppIDs, input.From, input.To)
+	filter.Databases = input.Databases
+	filter.HashIDs = hashIDs
+	filter.CallerHashes = callerHashes
+	rows, err := store.StatementSummary(filter, []string{_summaryHashID, _summaryType, _summaryCallerHash}, 0)
+	if err != nil {
+		return nil, err
+	}
+	grouped := make(map[string]*SQLFunctionSummaryResult, 10)
+	results := make([]*SQLFunctionSummaryResult, 0, 10)
+	for _, row := range rows {
+		if _, ok := callSites[row.HashID+row.CallerHash]; !ok {
+			// the caller hash of another statement
+			continue
+		}
+		result, ok := grouped[row.HashID]
+		if !ok {
+			result = &SQLFunctionSummaryResult{
+				HashID: row.HashID,
+				Type:   row.Type,
+			}
+			grouped[row.HashID] = result
+			results = append(results, result)
+		}
+		result.CallerHashes = append(result.CallerHashes, row.CallerHash)
+		result.Count += row.Count
+		result.Errors += row.Errors
+		result.Slow += row.Slow
+		result.RowsSum += row.RowsSum
+		result.TookSum += row.TookSum
+		if row.TookMax > result.TookMax {
+			result.TookMax = row.TookMax
+		}
+	}
+
+	// sort the results by total DB time, then limit them
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].TookSum > results[j].TookSum
+	})
+	limit := input.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	// look up the statements
+	if len(results) > 0 {
+		resultHashIDs := make([]string, len(results))
+		for idx, result := range results {
+			resultHashIDs[idx] = result.HashID
+		}
+		keyHashes, err := store.Hashes(resultHashIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, keyHash := range keyHashes {
+			if result, ok := grouped[keyHash.ID]; ok {
+				result.Statement = keyHash.Statement
+				result.Name = keyHash.Name
+			}
+		}
+	}
+	for _, result := range results {
+		if result.Count > 0 {
+			result.TookAvg = result.TookSum / float64(result.Count)
+		}
+	}
+
+	return results, nil
+}
+
+// callersInclude returns true if the call stack includes the specified function
+func callersInclude(callers []*callerInfo, function string) bool {
+	for _, caller := range callers {
+		if caller != nil && caller.Function == function {
+			return true
+		}
+	}
+	return false
+}
+
+// dashboardTimeRange returns the UTC time range for the specified optional from and to times, defaulting to the last 7 days
+func dashboardTimeRange(from, to *time.Time) (time.Time, time.Time) {
+	var fromTime, toTime time.Time
+	if from != nil && !from.IsZero() {
+		fromTime = from.UTC()
+	} else {
+		// default to 7 days ago
+		fromTime = time.Now().UTC().AddDate(0, 0, -7)
+	}
+	if to != nil && !to.IsZero() {
+		toTime = to.UTC()
+	} else {
+		// default to now
+		toTime = time.Now().UTC()
+	}
+	return fromTime, toTime
+}
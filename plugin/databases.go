@@ -0,0 +1,141 @@
+package insights
+
+import (
+	"database/sql"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// ConnectionSource is the connection name of statements executed on the connection pool of the monitored GORM DB itself, in a transaction, or on a source resolved by dbresolver
+	ConnectionSource = "source"
+	// ConnectionReplica is the connection name of statements resolved by dbresolver to a replica that was not named with DatabasePlugin.NameConnection
+	ConnectionReplica = "replica"
+	// ConnectionUnknown is the connection name of statements executed on a connection pool that was not named with DatabasePlugin.NameConnection and not resolved by dbresolver
+	ConnectionUnknown = ""
+)
+
+const (
+	// _resolverPlugin is the name dbresolver registers its GORM plugin under
+	_resolverPlugin = "gorm:db_resolver"
+	// _resolverWrite and _resolverRead are the statement settings dbresolver.Write and dbresolver.Read store to force a statement to a source or a replica
+	_resolverWrite = "gorm:db_resolver:write"
+	_resolverRead  = "gorm:db_resolver:read"
+)
+
+var (
+	// Register the database plugin
+	_ gorm.Plugin = &DatabasePlugin{}
+)
+
+// DatabasePlugin registers a SQLInsights plugin instance on a GORM DB under a database name, so a single plugin instance can monitor several databases. See SQLInsights.Database
+type DatabasePlugin struct {
+	s    *SQLInsights
+	name string
+}
+
+// monitoredDB defines a GORM DB instance the plugin is registered to
+type monitoredDB struct {
+	name string
+	db   *gorm.DB
+}
+
+// monitoredConn defines a connection pool whose statistics are sampled with every report
+type monitoredConn struct {
+	database  string
+	name      string
+	sqlDB     *sql.DB
+	lastStats *sql.DBStats
+}
+
+// Database returns a GORM plugin registering this plugin instance on a GORM DB under the specified database name, recorded with every statement executed through it.
+// Use it once per monitored database, ex. db.Use(sInsights.Database("main")) and analyticsDB.Use(sInsights.Database("analytics")). Using the plugin directly records an empty database name
+func (s *SQLInsights) Database(name string) *DatabasePlugin {
+	return &DatabasePlugin{s: s, name: name}
+}
+
+// Name returns the Name of this Gorm plugin
+func (d *DatabasePlugin) Name() string {
+	return d.s.Name()
+}
+
+// Initialize initializes the plugin with the specified Gorm DB instance
+func (d *DatabasePlugin) Initialize(db *gorm.DB) error {
+	return d.s.initialize(d.name, db)
+}
+
+// NameConnection names an additional connection pool of this database, such as a read replica registered with dbresolver, so the statements executed on it are recorded under this connection name instead of ConnectionSource or ConnectionReplica.
+// The connection pool statistics are sampled with every report as well. To get hold of a replica's *sql.DB, open it yourself and pass it to the dialector, ex. mysql.New(mysql.Config{Conn: replicaDB})
+func (d *DatabasePlugin) NameConnection(name string, sqlDB *sql.DB) *DatabasePlugin {
+	d.s.registerConnection(d.name, name, sqlDB)
+	return d
+}
+
+// registerConnection names the connection pool and samples its statistics with every report, replacing any previous registration of the same connection pool
+func (s *SQLInsights) registerConnection(database, name string, sqlDB *sql.DB) {
+	if sqlDB == nil {
+		return
+	}
+	s.connNames.Store(sqlDB, name)
+
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	for _, conn := range s.connections {
+		if conn.sqlDB == sqlDB {
+			conn.database, conn.name, conn.lastStats = database, name, nil
+			return
+		}
+	}
+	s.connections = append(s.connections, &monitoredConn{database: database, name: name, sqlDB: sqlDB})
+}
+
+// statementConnection returns the name of the connection pool the statement was executed on, resolved after any dbresolver callbacks switched it. Pools that were not named
+// are told apart by the decision dbresolver made for the statement, see resolvedConnection
+func (s *SQLInsights) statementConnection(db *gorm.DB, sType statType) string {
+	pool := db.Statement.ConnPool
+	tx := statementTx(db)
+	if tx != nil {
+		// use the connection pool the transaction was started on
+		pool = tx.parent
+	}
+	sqlDB, err := getDBConn(pool)
+	if err != nil {
+		// an untracked transaction, dbresolver runs these on the source
+		return ConnectionSource
+	}
+	if name, ok := s.connNames.Load(sqlDB); ok {
+		return name.(string)
+	}
+	if _, ok := db.Config.Plugins[_resolverPlugin]; !ok {
+		// some other plugin switched the connection pool, we can not tell what it is
+		return ConnectionUnknown
+	}
+	if tx != nil {
+		// dbresolver starts transactions on a source and leaves the statements executed in them alone
+		return ConnectionSource
+	}
+	return resolvedConnection(db, sType)
+}
+
+// resolvedConnection returns the connection dbresolver resolved the statement to, following its rules: statements forced with dbresolver.Write or dbresolver.Read, then
+// queries without locking and raw SELECT statements go to a replica and everything else to a source
+func resolvedConnection(db *gorm.DB, sType statType) string {
+	if _, ok := db.Statement.Settings.Load(_resolverWrite); ok {
+		return ConnectionSource
+	}
+	if _, ok := db.Statement.Settings.Load(_resolverRead); ok {
+		return ConnectionReplica
+	}
+	switch sType {
+	case _statTypeQuery, _statTypeRow, _statTypeRaw:
+		if _, locking := db.Statement.Clauses["FOR"]; locking {
+			return ConnectionSource
+		}
+		statement := strings.TrimSpace(db.Statement.SQL.String())
+		if len(statement) > 10 && strings.EqualFold(statement[:6], "select") && !strings.EqualFold(statement[len(statement)-10:], "for update") {
+			return ConnectionReplica
+		}
+	}
+	return ConnectionSource
+}
@@ -0,0 +1,94 @@
+package insights
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// SettingSkip is the gorm setting key used to exclude a statement from being recorded, ex. db.Set(SettingSkip, true)
+	SettingSkip = "sqlinsights:skip"
+	// SettingName is the gorm setting key used to give the statement fingerprint a human readable name, ex. db.Set(SettingName, "load-user-profile")
+	SettingName = "sqlinsights:name"
+	// SettingSlowMS is the gorm setting key used to set the slow threshold of the statement in milliseconds, ex. db.Set(SettingSlowMS, 50)
+	SettingSlowMS = "sqlinsights:slow_ms"
+
+	// _settingPrefix is the prefix shared by all of our setting keys
+	_settingPrefix = "sqlinsights:"
+
+	// _maxNameLength is the maximum length of a statement name, matching the size of the SQLInsightsHash.Name column
+	_maxNameLength = 191
+)
+
+// directives defines the per statement settings set at the call site with db.Set or db.InstanceSet
+type directives struct {
+	Skip   bool
+	Name   string
+	SlowMS float64 // slow threshold in fractional milliseconds, 0 when not set
+}
+
+// statementDirectives returns the directives set on the statement with db.Set or db.InstanceSet. Settings are scanned once without allocating unless one of our keys is present
+func statementDirectives(db *gorm.DB) directives {
+	var ret directives
+	var instancePrefix string
+	db.Statement.Settings.Range(func(k, v any) bool {
+		key, ok := k.(string)
+		if !ok {
+			return true
+		}
+		idx := strings.Index(key, _settingPrefix)
+		if idx < 0 {
+			return true
+		}
+		if idx > 0 {
+			// set with InstanceSet, which prefixes the key with the statement pointer. Only honor those set on this statement
+			if instancePrefix == "" {
+				instancePrefix = fmt.Sprintf("%p", db.Statement)
+			}
+			if key[:idx] != instancePrefix {
+				return true
+			}
+		}
+		switch key[idx:] {
+		case SettingSkip:
+			ret.Skip, _ = v.(bool)
+		case SettingName:
+			if name, ok := v.(string); ok {
+				name = strings.TrimSpace(name)
+				ret.Name = truncateUTF8(strings.ToValidUTF8(name, "\uFFFD"), _maxNameLength)
+			}
+		case SettingSlowMS:
+			ret.SlowMS = directiveMilliseconds(v)
+		}
+		return true
+	})
+	return ret
+}
+
+// directiveMilliseconds converts a slow threshold setting, a number of milliseconds or a time.Duration, into fractional milliseconds. Returns 0 for unsupported or negative values
+func directiveMilliseconds(v any) float64 {
+	var ms float64
+	switch value := v.(type) {
+	case time.Duration:
+		ms = durationMilliseconds(value)
+	case int:
+		ms = float64(value)
+	case int32:
+		ms = float64(value)
+	case int64:
+		ms = float64(value)
+	case uint:
+		ms = float64(value)
+	case float32:
+		ms = float64(value)
+	case float64:
+		ms = value
+	}
+	if ms < 0 {
+		return 0
+	}
+	return ms
+}
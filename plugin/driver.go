@@ -0,0 +1,377 @@
+package insights
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// Ensure our driver wrappers implement the database/sql interfaces we rely on
+	_ driver.Driver             = &insightsDriver{}
+	_ driver.DriverContext      = &insightsDriver{}
+	_ driver.Connector          = &insightsConnector{}
+	_ io.Closer                 = &insightsConnector{}
+	_ driver.Conn               = &insightsConn{}
+	_ driver.ConnBeginTx        = &insightsConn{}
+	_ driver.ConnPrepareContext = &insightsConn{}
+	_ driver.ExecerContext      = &insightsConn{}
+	_ driver.QueryerContext     = &insightsConn{}
+	_ driver.Pinger             = &insightsConn{}
+	_ driver.SessionResetter    = &insightsConn{}
+	_ driver.Validator          = &insightsConn{}
+	_ driver.NamedValueChecker  = &insightsConn{}
+	_ driver.Stmt               = &insightsStmt{}
+	_ driver.StmtExecContext    = &insightsStmt{}
+	_ driver.StmtQueryContext   = &insightsStmt{}
+	_ driver.NamedValueChecker  = &insightsStmt{}
+	_ driver.ColumnConverter    = &insightsStmt{}
+)
+
+// gormStatementContextKey is the context key marking statements executed by GORM, which are already recorded by our callbacks
+type gormStatementContextKey struct{}
+
+// WrapDriver returns the database/sql driver wrapped so statements executed through it, such as by code using the *sql.DB directly or sqlx/bun on the same pool, are recorded as sql_query and sql_exec statements.
+// Statements executed by a GORM DB instance this plugin is registered with are only recorded once, by the GORM callbacks
+func (s *SQLInsights) WrapDriver(d driver.Driver) driver.Driver {
+	s.wrapsDriver.Store(true)
+	return &insightsDriver{Driver: d, s: s}
+}
+
+// WrapConnector returns the database/sql connector wrapped so statements executed through it are recorded, see WrapDriver. Open the wrapped connector with sql.OpenDB
+func (s *SQLInsights) WrapConnector(c driver.Connector) driver.Connector {
+	s.wrapsDriver.Store(true)
+	return &insightsConnector{Connector: c, s: s, driver: &insightsDriver{Driver: c.Driver(), s: s}}
+}
+
+// insightsDriver wraps a database/sql driver to record the statements executed through its connections
+type insightsDriver struct {
+	driver.Driver
+	s *SQLInsights
+}
+
+// Open opens a new wrapped connection
+func (d *insightsDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &insightsConn{Conn: conn, s: d.s}, nil
+}
+
+// OpenConnector returns a wrapped connector for the data source name, using the connector of the wrapped driver when it has one
+func (d *insightsDriver) OpenConnector(name string) (driver.Connector, error) {
+	if driverContext, ok := d.Driver.(driver.DriverContext); ok {
+		connector, err := driverContext.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return &insightsConnector{Connector: connector, s: d.s, driver: d}, nil
+	}
+	return &insightsConnector{Connector: &dsnConnector{name: name, driver: d.Driver}, s: d.s, driver: d}, nil
+}
+
+// dsnConnector is a connector for drivers that do not implement driver.DriverContext
+type dsnConnector struct {
+	name   string
+	driver driver.Driver
+}
+
+// Connect opens a new connection using the data source name
+func (c *dsnConnector) Connect(_ context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.name)
+}
+
+// Driver returns the driver of the connector
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// insightsConnector wraps a database/sql connector to record the statements executed through its connections
+type insightsConnector struct {
+	driver.Connector
+	s      *SQLInsights
+	driver *insightsDriver
+}
+
+// Connect opens a new wrapped connection
+func (c *insightsConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &insightsConn{Conn: conn, s: c.s}, nil
+}
+
+// Driver returns the wrapped driver
+func (c *insightsConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Close closes the wrapped connector if it needs closing, called by sql.DB.Close
+func (c *insightsConnector) Close() error {
+	if closer, ok := c.Connector.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// insightsConn wraps a database/sql connection to record the statements executed through it. Optional interfaces the wrapped connection does not implement fall back to the database/sql defaults
+type insightsConn struct {
+	driver.Conn
+	s *SQLInsights
+}
+
+// Prepare returns a wrapped prepared statement
+func (c *insightsConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &insightsStmt{Stmt: stmt, s: c.s, query: query}, nil
+}
+
+// PrepareContext returns a wrapped prepared statement
+func (c *insightsConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	preparer, ok := c.Conn.(driver.ConnPrepareContext)
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return c.Prepare(query)
+	}
+	stmt, err := preparer.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &insightsStmt{Stmt: stmt, s: c.s, query: query}, nil
+}
+
+// BeginTx begins a transaction on the wrapped connection
+func (c *insightsConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) || opts.ReadOnly {
+		return nil, errors.New("sql: driver does not support non-default isolation level or read-only transactions")
+	}
+	return c.Conn.Begin()
+}
+
+// ExecContext executes and records a statement on the wrapped connection
+func (c *insightsConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		// let database/sql prepare the statement instead, which we record through our prepared statement
+		return nil, driver.ErrSkip
+	}
+	var result driver.Result
+	err := c.s.recordDriverStatement(ctx, _statTypeSQLExec, query, len(args), func() (int64, error) {
+		var err error
+		if result, err = execer.ExecContext(ctx, query, args); err != nil {
+			return 0, err
+		}
+		rows, _ := result.RowsAffected()
+		return rows, nil
+	})
+	return result, err
+}
+
+// QueryContext executes and records a query on the wrapped connection
+func (c *insightsConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		// let database/sql prepare the statement instead, which we record through our prepared statement
+		return nil, driver.ErrSkip
+	}
+	var rows driver.Rows
+	err := c.s.recordDriverStatement(ctx, _statTypeSQLQuery, query, len(args), func() (int64, error) {
+		var err error
+		rows, err = queryer.QueryContext(ctx, query, args)
+		return 0, err
+	})
+	return rows, err
+}
+
+// Ping pings the wrapped connection if it supports it
+func (c *insightsConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// ResetSession resets the wrapped connection if it supports it
+func (c *insightsConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid reports if the wrapped connection is still valid if it supports it
+func (c *insightsConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// CheckNamedValue checks the argument with the wrapped connection if it supports it, otherwise database/sql uses its default conversion
+func (c *insightsConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// insightsStmt wraps a prepared statement to record its executions
+type insightsStmt struct {
+	driver.Stmt
+	s     *SQLInsights
+	query string
+}
+
+// ExecContext executes and records the prepared statement
+func (st *insightsStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var result driver.Result
+	err := st.s.recordDriverStatement(ctx, _statTypeSQLExec, st.query, len(args), func() (int64, error) {
+		var err error
+		if execer, ok := st.Stmt.(driver.StmtExecContext); ok {
+			result, err = execer.ExecContext(ctx, args)
+		} else {
+			var values []driver.Value
+			if values, err = namedValuesToValues(args); err == nil {
+				result, err = st.Stmt.Exec(values)
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		rows, _ := result.RowsAffected()
+		return rows, nil
+	})
+	return result, err
+}
+
+// QueryContext executes and records the prepared query
+func (st *insightsStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	err := st.s.recordDriverStatement(ctx, _statTypeSQLQuery, st.query, len(args), func() (int64, error) {
+		var err error
+		if queryer, ok := st.Stmt.(driver.StmtQueryContext); ok {
+			rows, err = queryer.QueryContext(ctx, args)
+		} else {
+			var values []driver.Value
+			if values, err = namedValuesToValues(args); err == nil {
+				rows, err = st.Stmt.Query(values)
+			}
+		}
+		return 0, err
+	})
+	return rows, err
+}
+
+// CheckNamedValue checks the argument with the wrapped statement if it supports it, otherwise database/sql uses its default conversion
+func (st *insightsStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := st.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// ColumnConverter returns the column converter of the wrapped statement if it has one, otherwise the database/sql default
+func (st *insightsStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if converter, ok := st.Stmt.(driver.ColumnConverter); ok {
+		return converter.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+// namedValuesToValues converts named arguments to positional arguments for drivers without context support
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for idx, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[idx] = arg.Value
+	}
+	return values, nil
+}
+
+// recordDriverStatement executes a statement through a wrapped driver, recording it the same way our GORM callbacks do. The exec function returns the number of rows affected, if known
+func (s *SQLInsights) recordDriverStatement(ctx context.Context, sType statType, query string, numVars int, exec func() (int64, error)) error {
+	if ctx != nil && ctx.Value(gormStatementContextKey{}) != nil {
+		// executed by GORM, already recorded by our callbacks
+		_, err := exec()
+		return err
+	}
+	if s.filterStatement(ctx, "", sType, query) != _filterRecord {
+		_, err := exec()
+		return err
+	}
+	rate, sampled := s.sampler.sample(sType)
+	if !sampled && !s.needsUnsampledTiming() {
+		_, err := exec()
+		if !errors.Is(err, driver.ErrSkip) {
+			// only count the statement in its unit of work, if any
+			s.countUnitOfWork(ctx, sType, query, numVars, nil)
+		}
+		return err
+	}
+
+	// execute and time the statement
+	start := time.Now()
+	rows, err := exec()
+	now := time.Now().UTC()
+	if errors.Is(err, driver.ErrSkip) {
+		// not executed, database/sql falls back to preparing the statement which we record instead
+		return err
+	}
+	took := durationMilliseconds(now.Sub(start))
+	isError := err != nil && !errors.Is(err, sql.ErrNoRows)
+	slow := s.isSlow(took, 0)
+	override := s.keepUnsampled(isError, slow)
+	keep := sampled || override
+
+	s.countUnitOfWork(ctx, sType, query, numVars, nil)
+	if !keep {
+		// not sampled
+		return err
+	}
+
+	// weight sampled statements by the inverse of their sample rate so aggregated totals remain unbiased. Statements kept by an override are always recorded so they count once
+	weight := 1.0
+	if !override && rate > 0 {
+		weight = 1 / rate
+	}
+
+	// report our statement with execution details, using a pooled stat value
+	v := newStat()
+	v.TimeStamp = now
+	v.Type = sType
+	v.Key = query
+	v.NumVars = numVars
+	v.Took = took
+	v.Rows = rows
+	v.Error = isError
+	v.Slow = slow
+	if slow {
+		// keep the trace of slow executions as an exemplar
+		v.TraceID = statementTraceID(ctx, nil)
+	}
+	v.Weight = weight
+	v.LabelSet = LabelsFromContext(ctx)
+	v.pcs = s.callerPCs(v.pcs, s.config.CollectCallerDepth)
+	if isError {
+		// classify the error while we still have it
+		v.ErrorClass, v.ErrorCode = classifyError(err)
+		v.ErrorMessage = errorMessage(err)
+	}
+	s.insightsAddStat(v)
+	return err
+}
@@ -0,0 +1,160 @@
+package insights
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+const (
+	// error classes statements are categorized by
+	ErrorClassDeadlock      = "deadlock"
+	ErrorClassSerialization = "serialization"
+	ErrorClassLockTimeout   = "lock_timeout"
+	ErrorClassDuplicateKey  = "duplicate_key"
+	ErrorClassForeignKey    = "foreign_key"
+	ErrorClassConstraint    = "constraint"
+	ErrorClassSyntax        = "syntax"
+	ErrorClassConnection    = "connection"
+	ErrorClassResources     = "resources"
+	ErrorClassCanceled      = "canceled"
+	ErrorClassTimeout       = "timeout"
+	ErrorClassOther         = "other"
+
+	// _maxErrorMessageLength is the maximum length of a stored sample error message, matching the size of the SQLInsightsErrorHistory.Message column
+	_maxErrorMessageLength = 1024
+)
+
+// mysqlErrorClasses maps MySQL error numbers to their error class
+var mysqlErrorClasses = map[uint16]string{
+	1213: ErrorClassDeadlock,
+	1205: ErrorClassLockTimeout,
+	1062: ErrorClassDuplicateKey,
+	1586: ErrorClassDuplicateKey,
+	1216: ErrorClassForeignKey,
+	1217: ErrorClassForeignKey,
+	1451: ErrorClassForeignKey,
+	1452: ErrorClassForeignKey,
+	1048: ErrorClassConstraint,
+	1364: ErrorClassConstraint,
+	3819: ErrorClassConstraint,
+	1054: ErrorClassSyntax,
+	1064: ErrorClassSyntax,
+	1146: ErrorClassSyntax,
+	1040: ErrorClassConnection,
+	1317: ErrorClassCanceled,
+	3024: ErrorClassTimeout,
+}
+
+// postgresErrorClasses maps Postgres SQLSTATE codes to their error class
+var postgresErrorClasses = map[string]string{
+	"40P01": ErrorClassDeadlock,
+	"40001": ErrorClassSerialization,
+	"55P03": ErrorClassLockTimeout,
+	"23505": ErrorClassDuplicateKey,
+	"23503": ErrorClassForeignKey,
+	"23502": ErrorClassConstraint,
+	"23514": ErrorClassConstraint,
+	"57014": ErrorClassCanceled,
+}
+
+// postgresErrorClassPrefixes maps Postgres SQLSTATE classes (the first two characters) to their error class when the specific code is not mapped
+var postgresErrorClassPrefixes = map[string]string{
+	"08": ErrorClassConnection,
+	"23": ErrorClassConstraint,
+	"40": ErrorClassSerialization,
+	"42": ErrorClassSyntax,
+	"53": ErrorClassResources,
+}
+
+// classifyError returns the error class and driver specific error code, such as "mysql:1213" or "pg:40P01", for the specified error
+func classifyError(err error) (string, string) {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		code := "mysql:" + strconv.Itoa(int(mysqlErr.Number))
+		if class, ok := mysqlErrorClasses[mysqlErr.Number]; ok {
+			return class, code
+		}
+		return ErrorClassOther, code
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		code := "pg:" + pgErr.Code
+		if class, ok := postgresErrorClasses[pgErr.Code]; ok {
+			return class, code
+		}
+		if len(pgErr.Code) >= 2 {
+			if class, ok := postgresErrorClassPrefixes[pgErr.Code[:2]]; ok {
+				return class, code
+			}
+		}
+		return ErrorClassOther, code
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled, ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassTimeout, ""
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn):
+		return ErrorClassConnection, ""
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return ErrorClassDuplicateKey, ""
+	case errors.Is(err, gorm.ErrForeignKeyViolated):
+		return ErrorClassForeignKey, ""
+	case errors.Is(err, gorm.ErrCheckConstraintViolated):
+		return ErrorClassConstraint, ""
+	}
+	return ErrorClassOther, ""
+}
+
+// errorMessage returns the error message as valid UTF-8 truncated to the maximum stored length, databases reject invalid UTF-8 which would fail storing the whole report
+func errorMessage(err error) string {
+	return truncateUTF8(strings.ToValidUTF8(strings.TrimSpace(err.Error()), "\uFFFD"), _maxErrorMessageLength)
+}
+
+// truncateUTF8 truncates the string to at most maxLength bytes without cutting a multi-byte rune in half
+func truncateUTF8(value string, maxLength int) string {
+	if len(value) <= maxLength {
+		return value
+	}
+	end := maxLength
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end]
+}
+
+// buildErrorHistory builds the error history, one record per error class and code, from the specified aggregate
+func (s *SQLInsights) buildErrorHistory(bucket reportBucket, sType statType, agg *statAggregate) []*SQLInsightsErrorHistory {
+	if len(agg.errors) == 0 {
+		return nil
+	}
+	errorHistory := make([]*SQLInsightsErrorHistory, 0, len(agg.errors))
+	for _, errorValue := range agg.errors {
+		errorHistory = append(errorHistory, &SQLInsightsErrorHistory{
+			InstanceID: s.instanceAppID,
+			CreatedAt:  bucket.Start,
+			EndedAt:    bucket.End,
+			HashID:     agg.KeyHash,
+			Type:       sType,
+			Database:   agg.Database,
+			Connection: agg.Connection,
+			Class:      errorValue.Class,
+			Code:       errorValue.Code,
+			Count:      int(math.Round(errorValue.count)),
+			TookMax:    errorValue.tookMax,
+			TookSum:    errorValue.tookSum,
+			Message:    errorValue.Message,
+		})
+	}
+	return errorHistory
+}
@@ -0,0 +1,162 @@
+package insights
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// filterResult is the outcome of evaluating the filter rules for a statement
+type filterResult int
+
+const (
+	_filterRecord  filterResult = iota // the statement is recorded
+	_filterSkip                        // the statement is not recorded
+	_filterPending                     // the outcome depends on the SQL text, which is not built yet
+)
+
+// FilterRule defines a rule that includes or excludes statements from being recorded. All criteria set on a rule must match for the rule to match a statement, a rule without any criteria matches every statement.
+// Statements matching any exclude rule are not recorded. When there are include rules, only statements matching at least one of them are recorded
+type FilterRule struct {
+	// Exclude specifies if statements matching this rule are excluded, otherwise they are included
+	Exclude bool
+
+	// Types matches the statement types (query, raw, create, update, delete, row, sql_query, sql_exec)
+	Types []string
+
+	// Tables matches the table name of the statement (db.Statement.Table). Patterns use path.Match syntax, such as "sql_insights_*". Statements executed through a wrapped database/sql driver have no table name
+	Tables []string
+
+	// SQL matches the SQL text of the statement. Statements built by gorm only have their SQL text once executed, so rules using SQL are evaluated after those statements run
+	SQL *regexp.Regexp
+
+	// CallerPackagePrefixes matches the function of the first caller outside of gorm, this package, and Config.CallerSkipPackagePrefixes, such as "github.com/myorg/myapp/migrations"
+	CallerPackagePrefixes []string
+
+	// Labels matches context labels, set with WithLabels. All labels must be present with the specified values
+	Labels map[string]string
+}
+
+// filterMatch is the outcome of evaluating a single filter rule for a statement
+type filterMatch int
+
+const (
+	_filterNoMatch filterMatch = iota
+	_filterMatch
+	_filterUnknown // everything else matches but the SQL text is not built yet
+)
+
+// matchWithoutSQL evaluates all criteria except the SQL text, which is more expensive and may not be available yet
+func (r *FilterRule) matchWithoutSQL(ctx context.Context, table string, sType statType, caller func() string) bool {
+	if len(r.Types) > 0 && !slices.Contains(r.Types, sType.String()) {
+		return false
+	}
+	if len(r.Tables) > 0 {
+		matched := false
+		for _, pattern := range r.Tables {
+			if ok, _ := path.Match(pattern, table); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.Labels) > 0 {
+		labels := LabelsFromContext(ctx)
+		for k, v := range r.Labels {
+			if value, ok := labels[k]; !ok || value != v {
+				return false
+			}
+		}
+	}
+	if len(r.CallerPackagePrefixes) > 0 {
+		function := caller()
+		matched := false
+		for _, prefix := range r.CallerPackagePrefixes {
+			if strings.HasPrefix(function, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// match evaluates the rule for the statement. An empty sql means the SQL text is not built yet
+func (r *FilterRule) match(ctx context.Context, table string, sType statType, sql string, caller func() string) filterMatch {
+	if !r.matchWithoutSQL(ctx, table, sType, caller) {
+		return _filterNoMatch
+	}
+	if r.SQL == nil {
+		return _filterMatch
+	}
+	if sql == "" {
+		return _filterUnknown
+	}
+	if r.SQL.MatchString(sql) {
+		return _filterMatch
+	}
+	return _filterNoMatch
+}
+
+// filterStatement evaluates the configured filter rules for the statement executed with the specified context against the specified table. An empty sql means the SQL text is not built yet, in which case the outcome may be pending
+func (s *SQLInsights) filterStatement(ctx context.Context, table string, sType statType, sql string) filterResult {
+	if len(s.config.Filters) == 0 {
+		return _filterRecord
+	}
+
+	// only look up the caller once, and only if a rule needs it
+	var function string
+	var callerLoaded bool
+	caller := func() string {
+		if !callerLoaded {
+			callerLoaded = true
+			if callers := s.getCallers(1); len(callers) > 0 {
+				function = unescapeFunction(callers[0].Function)
+			}
+		}
+		return function
+	}
+
+	pendingExclude, pendingInclude := false, false
+	hasInclude, included := false, false
+	for _, rule := range s.config.Filters {
+		if rule == nil {
+			continue
+		}
+		if !rule.Exclude {
+			hasInclude = true
+			if included {
+				// already included, only exclude rules matter now
+				continue
+			}
+		}
+		switch rule.match(ctx, table, sType, sql, caller) {
+		case _filterMatch:
+			if rule.Exclude {
+				return _filterSkip
+			}
+			included = true
+		case _filterUnknown:
+			if rule.Exclude {
+				pendingExclude = true
+			} else {
+				pendingInclude = true
+			}
+		}
+	}
+	if pendingExclude || (hasInclude && !included && pendingInclude) {
+		return _filterPending
+	}
+	if hasInclude && !included {
+		return _filterSkip
+	}
+	return _filterRecord
+}
@@ -0,0 +1,511 @@
+package insights
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GormStore stores the statistics in the tables of a GORM DB, see autoMigration. It is the store used when Config.DB is set
+type GormStore struct {
+	db *gorm.DB
+}
+
+// NewGormStore creates a new store using the specified GORM DB instance, which does not have to be the one being monitored
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{db: db}
+}
+
+// DB returns the DB instance used to store/query statistics, skipping hooks, just in case the same DB instance being monitored is used to store the statistics
+func (g *GormStore) DB() *gorm.DB {
+	return g.db.Session(&gorm.Session{NewDB: true, SkipHooks: true, Context: _statDBContext})
+}
+
+// Migrate performs the automigration of the statistics tables, then converts the statistics stored by earlier versions, see migrateSchema
+func (g *GormStore) Migrate() error {
+	if err := g.DB().AutoMigrate(autoMigration()...); err != nil {
+		return err
+	}
+	return g.migrateSchema()
+}
+
+// migrateSchema converts the stored statistics up to _schemaVersion, recording the version so each conversion runs exactly once. The version row is locked
+// so instances migrating at the same time wait for each other
+func (g *GormStore) migrateSchema() error {
+	// make sure our version row exists, tables without one were created by earlier versions or are empty
+	if err := g.DB().Clauses(clause.OnConflict{DoNothing: true}).Create(&SQLInsightsSchema{ID: 1}).Error; err != nil {
+		return err
+	}
+	return g.DB().Transaction(func(tx *gorm.DB) error {
+		var schema SQLInsightsSchema
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&schema, 1).Error; err != nil {
+			return err
+		}
+		if schema.Version >= _schemaVersion {
+			// already converted
+			return nil
+		}
+		if schema.Version < 1 {
+			// earlier versions stored the execution durations in seconds, convert them to milliseconds
+			if err := tx.Model(&SQLInsightsHistory{}).Where("1 = 1").Updates(map[string]any{
+				"took_min": gorm.Expr("took_min * 1000"),
+				"took_max": gorm.Expr("took_max * 1000"),
+				"took_avg": gorm.Expr("took_avg * 1000"),
+				"took_med": gorm.Expr("took_med * 1000"),
+				"took_sum": gorm.Expr("took_sum * 1000"),
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&schema).Update("version", _schemaVersion).Error
+	})
+}
+
+// InstanceAppID returns the ID of the instance name, creating it if it does not exist yet
+func (g *GormStore) InstanceAppID(instanceID string) (uint, error) {
+	appInstance := SQLInsightsApp{
+		InstanceAppName: instanceID,
+	}
+	if err := g.DB().Where("instance_app_name = ?", instanceID).FirstOrCreate(&appInstance).Error; err != nil {
+		return 0, err
+	}
+	return appInstance.ID, nil
+}
+
+// KnownHashes returns all stored statement hashes
+func (g *GormStore) KnownHashes() ([]*SQLInsightsHash, error) {
+	var keyHashes []*SQLInsightsHash
+	if err := g.DB().Find(&keyHashes).Error; err != nil {
+		return nil, err
+	}
+	return keyHashes, nil
+}
+
+// KnownCallers returns all stored callers
+func (g *GormStore) KnownCallers() ([]*SQLInsightsCallerHistory, error) {
+	var callerHashes []*SQLInsightsCallerHistory
+	if err := g.DB().Find(&callerHashes).Error; err != nil {
+		return nil, err
+	}
+	return callerHashes, nil
+}
+
+// SaveReport stores the statistics of a report interval, storing as much as possible and returning the errors encountered
+func (g *GormStore) SaveReport(report *Report) error {
+	var errs []error
+	create := func(value interface{}) {
+		if err := g.DB().Create(value).Error; err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(report.Hashes) > 0 {
+		// check if we have these SQLInsightsHash values in the DB and insert if we don't
+		keyHashes := make(map[string]*SQLInsightsHash, len(report.Hashes))
+		keyHashIDs := make([]string, 0, len(report.Hashes))
+		for _, keyHash := range report.Hashes {
+			keyHashes[keyHash.ID] = keyHash
+			keyHashIDs = append(keyHashIDs, keyHash.ID)
+		}
+		var existingKeyHashes []string
+		_ = g.DB().Model(&SQLInsightsHash{}).Select("id").Where("id IN ?", keyHashIDs).Scan(&existingKeyHashes)
+		// removing existing values from keyHashes where we already have them in the DB, keeping their names up to date
+		for _, existingKeyHash := range existingKeyHashes {
+			if keyHash, ok := keyHashes[existingKeyHash]; ok && keyHash.Name != "" {
+				if err := g.DB().Model(&SQLInsightsHash{}).Where("id = ?", existingKeyHash).Update("name", keyHash.Name).Error; err != nil {
+					errs = append(errs, err)
+				}
+			}
+			delete(keyHashes, existingKeyHash)
+		}
+		if len(keyHashes) > 0 {
+			toInsert := make([]*SQLInsightsHash, 0, len(keyHashes))
+			for _, keyHash := range keyHashes {
+				toInsert = append(toInsert, keyHash)
+			}
+			create(toInsert)
+		}
+	}
+
+	// update the names of existing key hashes
+	for keyHash, name := range report.HashNames {
+		if err := g.DB().Model(&SQLInsightsHash{}).Where("id = ?", keyHash).Update("name", name).Error; err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(report.Callers) > 0 {
+		// check if we have these SQLInsightsCallerHistory values in the DB and insert if we don't, keyed by hash ID + caller hash on both sides
+		callerHistories := make(map[string]*SQLInsightsCallerHistory, len(report.Callers))
+		hashIDs := make([]string, 0, len(report.Callers))
+		for _, callerHistory := range report.Callers {
+			callerHistories[callerHistory.HashID+callerHistory.ID] = callerHistory
+			hashIDs = append(hashIDs, callerHistory.HashID)
+		}
+		slices.Sort(hashIDs)
+		var existingCallers []*SQLInsightsCallerHistory
+		if err := g.DB().Select("id", "hash_id").Where("hash_id IN ?", slices.Compact(hashIDs)).Find(&existingCallers).Error; err != nil {
+			// without knowing which callers exist, inserting them could duplicate them
+			errs = append(errs, err)
+			clear(callerHistories)
+		}
+		// removing existing values from callerHistories where we already have them in the DB
+		for _, existingCaller := range existingCallers {
+			delete(callerHistories, existingCaller.HashID+existingCaller.ID)
+		}
+		if len(callerHistories) > 0 {
+			toInsert := make([]*SQLInsightsCallerHistory, 0, len(callerHistories))
+			for _, callerHistory := range callerHistories {
+				toInsert = append(toInsert, callerHistory)
+			}
+			create(toInsert)
+		}
+	}
+
+	if len(report.Repetitions) > 0 {
+		create(report.Repetitions)
+	}
+	if len(report.Transactions) > 0 {
+		create(report.Transactions)
+	}
+	if len(report.Pools) > 0 {
+		create(report.Pools)
+	}
+	if report.Drops != nil {
+		create(report.Drops)
+	}
+	if len(report.Errors) > 0 {
+		create(report.Errors)
+	}
+	if len(report.Statements) > 0 {
+		create(report.Statements)
+	}
+	return errors.Join(errs...)
+}
+
+// Purge removes the history of the instance created before the specified time from every history table, purging as much as possible and returning the errors encountered
+func (g *GormStore) Purge(instanceAppID uint, before time.Time) error {
+	var errs []error
+	for _, model := range historyModels() {
+		if err := g.DB().Where("instance_id = ? AND created_at < ?", instanceAppID, before).Unscoped().Delete(model).Error; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StatementHistory returns the statement history matching the filter, along with the instance name and statement name
+func (g *GormStore) StatementHistory(filter *HistoryFilter) ([]*SQLInsightsQueryQueryHistoryDBResult, error) {
+	// create query
+	query := g.DB().Select("sql_insights_app.instance_app_name, sql_insights_hash.name, sql_insights_history.*")
+
+	// join on the SQLInsightsApp table to get the InstanceID and the SQLInsightsHash table to get the statement name
+	query = query.Joins("INNER JOIN sql_insights_app ON sql_insights_history.instance_id = sql_insights_app.id")
+	query = query.Joins("LEFT JOIN sql_insights_hash ON sql_insights_history.hash_id = sql_insights_hash.id")
+	query = query.Model(&SQLInsightsHistory{}).Where("sql_insights_history.created_at >= ? AND sql_insights_history.created_at <= ?", filter.From, filter.To)
+	if len(filter.InstanceAppIDs) > 0 {
+		query = query.Where("instance_id IN (?)", filter.InstanceAppIDs)
+	}
+	if len(filter.Databases) > 0 {
+		query = query.Where("sql_insights_history.database IN (?)", filter.Databases)
+	}
+	if len(filter.Types) > 0 {
+		query = query.Where("sql_insights_history.type IN (?)", filter.Types)
+	}
+	if len(filter.HashIDs) > 0 {
+		query = query.Where("sql_insights_history.hash_id IN (?)", filter.HashIDs)
+	}
+
+	var results []*SQLInsightsQueryQueryHistoryDBResult
+	if err := query.Find(&results).Error; err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ConnectionCounts returns the number of statements per instance, report, database, and connection matching the filter
+func (g *GormStore) ConnectionCounts(filter *HistoryFilter) ([]*SQLInsightsHistory, error) {
+	query := g.DB().Model(&SQLInsightsHistory{}).Select("instance_id, created_at, sql_insights_history.database, connection, SUM(count) AS count").Where("created_at >= ? AND created_at <= ?", filter.From, filter.To)
+	if len(filter.InstanceAppIDs) > 0 {
+		query = query.Where("instance_id IN (?)", filter.InstanceAppIDs)
+	}
+	if len(filter.Databases) > 0 {
+		query = query.Where("sql_insights_history.database IN (?)", filter.Databases)
+	}
+	var counts []*SQLInsightsHistory
+	if err := query.Group("instance_id, created_at, sql_insights_history.database, connection").Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// LatencyHistory returns the creation time and latency buckets of the statement history matching the filter, sorted by creation time
+func (g *GormStore) LatencyHistory(filter *HistoryFilter) ([]*SQLInsightsHistory, error) {
+	query := g.DB().Model(&SQLInsightsHistory{}).Select("created_at, latency").Where("created_at >= ? AND created_at <= ? AND latency <> ''", filter.From, filter.To)
+	if len(filter.InstanceAppIDs) > 0 {
+		query = query.Where("instance_id IN (?)", filter.InstanceAppIDs)
+	}
+	if len(filter.Databases) > 0 {
+		query = query.Where("sql_insights_history.database IN (?)", filter.Databases)
+	}
+	if len(filter.HashIDs) > 0 {
+		query = query.Where("hash_id IN (?)", filter.HashIDs)
+	}
+	if len(filter.Types) > 0 {
+		query = query.Where("type IN (?)", filter.Types)
+	}
+	var rows []*SQLInsightsHistory
+	if err := query.Order("created_at").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// StatementSummary returns the statement history matching the filter summed per group of the groupBy columns, sorted by the total execution duration descending
+func (g *GormStore) StatementSummary(filter *HistoryFilter, groupBy []string, limit int) ([]*SQLInsightsHistory, error) {
+	if err := checkSummaryGroup(groupBy, _summaryHashID, _summaryType, _summaryCallerHash, _summaryLabels); err != nil {
+		return nil, err
+	}
+	query := g.DB().Model(&SQLInsightsHistory{}).Select(summarySelect(groupBy, "SUM(count) AS count, SUM(errors) AS errors, SUM(slow) AS slow, SUM(rows_sum) AS rows_sum, SUM(took_sum) AS took_sum, MAX(took_max) AS took_max"))
+	query = summaryQuery(filterStatementHistory(query, filter), groupBy, "SUM(took_sum) DESC", limit)
+	var rows []*SQLInsightsHistory
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// ErrorSummary returns the error history matching the filter summed per group of the groupBy columns, sorted by count descending
+func (g *GormStore) ErrorSummary(filter *HistoryFilter, groupBy []string, limit int) ([]*SQLInsightsErrorHistory, error) {
+	if err := checkSummaryGroup(groupBy, _summaryClass, _summaryCode, _summaryHashID, _summaryType); err != nil {
+		return nil, err
+	}
+	query := g.DB().Model(&SQLInsightsErrorHistory{}).Select(summarySelect(groupBy, "SUM(count) AS count, SUM(took_sum) AS took_sum, MAX(took_max) AS took_max"))
+	query = summaryQuery(filterErrorHistory(query, filter), groupBy, "SUM(count) DESC", limit)
+	var rows []*SQLInsightsErrorHistory
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	if !slices.Contains(groupBy, _summaryHashID) {
+		return rows, nil
+	}
+
+	// look up the most recent sample message of each group, the number of groups is bounded by the limit
+	for _, row := range rows {
+		query := filterErrorHistory(g.DB().Model(&SQLInsightsErrorHistory{}), filter).Where("message <> ''")
+		for _, column := range groupBy {
+			query = query.Where(column+" = ?", errorSummaryValue(row, column))
+		}
+		var messages []string
+		if err := query.Order("created_at DESC").Limit(1).Pluck("message", &messages).Error; err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 {
+			row.Message = messages[0]
+		}
+	}
+	return rows, nil
+}
+
+// TxSummary returns the transaction history matching the filter summed per first statement and caller, sorted descending by orderBy
+func (g *GormStore) TxSummary(filter *HistoryFilter, orderBy string, limit int) ([]*SQLInsightsTxHistory, error) {
+	order, ok := _txSummaryOrders[orderBy]
+	if !ok {
+		order = _txSummaryOrders[_txOrderTookMax]
+	}
+	groupBy := []string{_summaryHashID, _summaryCallerHash}
+	query := g.DB().Model(&SQLInsightsTxHistory{}).Select(summarySelect(groupBy, "SUM(count) AS count, SUM(commits) AS commits, SUM(rollbacks) AS rollbacks, "+
+		"MAX(statements_max) AS statements_max, SUM(statements_sum) AS statements_sum, MIN(took_min) AS took_min, MAX(took_max) AS took_max, SUM(took_sum) AS took_sum, "+
+		"MAX(idle_max) AS idle_max, SUM(idle_sum) AS idle_sum"))
+	query = summaryQuery(filterTxHistory(query, filter), groupBy, order, limit)
+	var rows []*SQLInsightsTxHistory
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return rows, nil
+	}
+
+	// merge the distinct hash ID lists of the groups, the JSON lists can not be merged in SQL
+	hashIDs := make([]string, len(rows))
+	for idx, row := range rows {
+		hashIDs[idx] = row.HashID
+	}
+	var lists []*SQLInsightsTxHistory
+	listQuery := filterTxHistory(g.DB().Model(&SQLInsightsTxHistory{}), filter).Distinct("hash_id", "caller_hash", "hash_ids").Where("hash_id IN (?)", hashIDs)
+	if err := listQuery.Scan(&lists).Error; err != nil {
+		return nil, err
+	}
+	merged := make(map[string][]string, len(rows))
+	for _, list := range lists {
+		merged[list.HashID+list.CallerHash] = append(merged[list.HashID+list.CallerHash], list.GetHashIDs()...)
+	}
+	for _, row := range rows {
+		rowHashIDs := merged[row.HashID+row.CallerHash]
+		slices.Sort(rowHashIDs)
+		row.SetHashIDs(slices.Compact(rowHashIDs))
+	}
+	return rows, nil
+}
+
+// RepetitionSummary returns the repetition history matching the filter summed per statement and caller, sorted by the total number of repeated executions descending
+func (g *GormStore) RepetitionSummary(filter *HistoryFilter, limit int) ([]*SQLInsightsRepetitionHistory, error) {
+	groupBy := []string{_summaryHashID, _summaryCallerHash, _summaryType}
+	query := g.DB().Model(&SQLInsightsRepetitionHistory{}).Select(summarySelect(groupBy, "SUM(occurrences) AS occurrences, SUM(repetitions_sum) AS repetitions_sum, MAX(repetitions_max) AS repetitions_max"))
+	query = query.Where("created_at >= ? AND created_at <= ? AND occurrences > 0", filter.From, filter.To)
+	if len(filter.InstanceAppIDs) > 0 {
+		query = query.Where("instance_id IN (?)", filter.InstanceAppIDs)
+	}
+	query = summaryQuery(query, groupBy, "SUM(repetitions_sum) DESC", limit)
+	var rows []*SQLInsightsRepetitionHistory
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// _txSummaryOrders maps the orders of the transaction summary to their SQL expression
+var _txSummaryOrders = map[string]string{
+	_txOrderTookMax:   "MAX(took_max) DESC",
+	_txOrderTookSum:   "SUM(took_sum) DESC",
+	_txOrderTookAvg:   "SUM(took_sum) / SUM(count) DESC",
+	_txOrderIdleMax:   "MAX(idle_max) DESC",
+	_txOrderIdleSum:   "SUM(idle_sum) DESC",
+	_txOrderCount:     "SUM(count) DESC",
+	_txOrderRollbacks: "SUM(rollbacks) DESC",
+}
+
+// summarySelect returns the select list of a summary query, the groupBy columns followed by the aggregates
+func summarySelect(groupBy []string, aggregates string) string {
+	if len(groupBy) == 0 {
+		return aggregates
+	}
+	return strings.Join(groupBy, ", ") + ", " + aggregates
+}
+
+// summaryQuery groups the query by the groupBy columns, then sorts the groups by the order, breaking ties by the groupBy columns, and keeps up to limit groups
+func summaryQuery(query *gorm.DB, groupBy []string, order string, limit int) *gorm.DB {
+	query = query.Order(order)
+	if len(groupBy) > 0 {
+		columns := strings.Join(groupBy, ", ")
+		query = query.Group(columns).Order(columns)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	return query
+}
+
+// errorSummaryValue returns the value of a groupBy column of a summed error history record
+func errorSummaryValue(row *SQLInsightsErrorHistory, column string) string {
+	switch column {
+	case _summaryClass:
+		return row.Class
+	case _summaryCode:
+		return row.Code
+	case _summaryHashID:
+		return row.HashID
+	case _summaryType:
+		return row.Type.String()
+	}
+	return ""
+}
+
+// filterStatementHistory applies the filter to a query of the statement history
+func filterStatementHistory(query *gorm.DB, filter *HistoryFilter) *gorm.DB {
+	query = query.Where("created_at >= ? AND created_at <= ?", filter.From, filter.To)
+	if len(filter.InstanceAppIDs) > 0 {
+		query = query.Where("instance_id IN (?)", filter.InstanceAppIDs)
+	}
+	if len(filter.Databases) > 0 {
+		query = query.Where("sql_insights_history.database IN (?)", filter.Databases)
+	}
+	if len(filter.Types) > 0 {
+		query = query.Where("type IN (?)", filter.Types)
+	}
+	if len(filter.HashIDs) > 0 {
+		query = query.Where("hash_id IN (?)", filter.HashIDs)
+	}
+	if len(filter.CallerHashes) > 0 {
+		query = query.Where("caller_hash IN (?)", filter.CallerHashes)
+	}
+	return query
+}
+
+// filterErrorHistory applies the filter to a query of the error history
+func filterErrorHistory(query *gorm.DB, filter *HistoryFilter) *gorm.DB {
+	query = query.Where("created_at >= ? AND created_at <= ?", filter.From, filter.To)
+	if len(filter.InstanceAppIDs) > 0 {
+		query = query.Where("instance_id IN (?)", filter.InstanceAppIDs)
+	}
+	if len(filter.Databases) > 0 {
+		query = query.Where("sql_insights_error_history.database IN (?)", filter.Databases)
+	}
+	if len(filter.Classes) > 0 {
+		query = query.Where("class IN (?)", filter.Classes)
+	}
+	return query
+}
+
+// filterTxHistory applies the filter to a query of the transaction history, skipping empty records
+func filterTxHistory(query *gorm.DB, filter *HistoryFilter) *gorm.DB {
+	query = query.Where("created_at >= ? AND created_at <= ? AND count > 0", filter.From, filter.To)
+	if len(filter.InstanceAppIDs) > 0 {
+		query = query.Where("instance_id IN (?)", filter.InstanceAppIDs)
+	}
+	return query
+}
+
+// PoolHistory returns the connection pool history matching the filter, along with the instance name, oldest first
+func (g *GormStore) PoolHistory(filter *HistoryFilter) ([]*SQLPoolHistoryResult, error) {
+	// join on the SQLInsightsApp table to get the instance name
+	query := g.DB().Select("sql_insights_app.instance_app_name, sql_insights_pool_history.*")
+	query = query.Joins("INNER JOIN sql_insights_app ON sql_insights_pool_history.instance_id = sql_insights_app.id")
+	query = query.Model(&SQLInsightsPoolHistory{}).Where("created_at >= ? AND created_at <= ?", filter.From, filter.To)
+	if len(filter.InstanceAppIDs) > 0 {
+		query = query.Where("instance_id IN (?)", filter.InstanceAppIDs)
+	}
+	if len(filter.Databases) > 0 {
+		query = query.Where("sql_insights_pool_history.database IN (?)", filter.Databases)
+	}
+	var results []*SQLPoolHistoryResult
+	if err := query.Order("created_at").Find(&results).Error; err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Hashes returns the statement hashes with the specified IDs
+func (g *GormStore) Hashes(ids []string) ([]*SQLInsightsHash, error) {
+	var keyHashes []*SQLInsightsHash
+	if err := g.DB().Where("id IN (?)", ids).Find(&keyHashes).Error; err != nil {
+		return nil, err
+	}
+	return keyHashes, nil
+}
+
+// Callers returns the callers of the statements with the specified hash IDs
+func (g *GormStore) Callers(hashIDs []string) ([]*SQLInsightsCallerHistory, error) {
+	var callerHistories []*SQLInsightsCallerHistory
+	if err := g.DB().Where("hash_id IN (?)", hashIDs).Find(&callerHistories).Error; err != nil {
+		return nil, err
+	}
+	return callerHistories, nil
+}
+
+// _likeEscaper escapes the LIKE wildcards and our escape character so text is matched literally
+var _likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// CallersContaining returns the callers whose serialized value contains the text, matched literally. The escape character is bound as a parameter so it is
+// not subject to the string literal escaping rules of each database
+func (g *GormStore) CallersContaining(text string) ([]*SQLInsightsCallerHistory, error) {
+	var callerHistories []*SQLInsightsCallerHistory
+	if err := g.DB().Where("value LIKE ? ESCAPE ?", "%"+_likeEscaper.Replace(text)+"%", `\`).Find(&callerHistories).Error; err != nil {
+		return nil, err
+	}
+	return callerHistories, nil
+}
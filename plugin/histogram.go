@@ -0,0 +1,61 @@
+package insights
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// _latencyBucketBounds are the upper bounds, in fractional milliseconds, of the latency buckets stored with each history record. A final bucket counts executions slower than the last bound.
+// They are fixed, the stored counts of existing history records are only meaningful with the bounds they were counted with
+var _latencyBucketBounds = [...]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// _latencyBucketCount is the number of latency buckets, one per bound plus the final bucket
+const _latencyBucketCount = len(_latencyBucketBounds) + 1
+
+// LatencyBucketBounds returns the upper bounds, in fractional milliseconds, of the latency buckets stored with each history record. A final bucket counts executions slower than the last bound
+func LatencyBucketBounds() []float64 {
+	return slices.Clone(_latencyBucketBounds[:])
+}
+
+// latencyHistogram counts executions, weighted by the number of executions each sampled stat represents, per latency bucket
+type latencyHistogram [_latencyBucketCount]float64
+
+// add counts the execution duration in its latency bucket
+func (h *latencyHistogram) add(took, weight float64) {
+	h[sort.SearchFloat64s(_latencyBucketBounds[:], took)] += weight
+}
+
+// encode returns the rounded counts as a comma separated list, trailing empty buckets omitted. Returns an empty string if all buckets are empty
+func (h *latencyHistogram) encode() string {
+	last := -1
+	for idx, count := range h {
+		if math.Round(count) > 0 {
+			last = idx
+		}
+	}
+	if last < 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for idx := 0; idx <= last; idx++ {
+		if idx > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatInt(int64(math.Round(h[idx])), 10))
+	}
+	return sb.String()
+}
+
+// decodeLatencyBuckets adds the encoded latency bucket counts to counts, which must hold _latencyBucketCount values. Invalid values are ignored
+func decodeLatencyBuckets(encoded string, counts []int) {
+	for idx := 0; encoded != "" && idx < len(counts); idx++ {
+		value, rest, _ := strings.Cut(encoded, ",")
+		if count, err := strconv.Atoi(value); err == nil {
+			counts[idx] += count
+		}
+		encoded = rest
+	}
+}
@@ -1,66 +1,173 @@
 package insights
 
 import (
+	"context"
 	"errors"
 	"time"
-	"unsafe"
 
 	"gorm.io/gorm"
 )
 
-// getTimeTaken calculates the time taken for a query to execute, returning the duration in fractional milliseconds, the current time, and any error that occurred
-func (s *SQLInsights) getTimeTaken(ctxMapKey string, db *gorm.DB) (float64, time.Time, error) {
-	// set the current time and retrieve the "in time" from our statement map for comparison
-	now := time.Now().UTC()
+const (
+	// _settingStartTimePrefix is the prefix of the statement setting key used to carry the "in time" of a statement between our before and after callbacks
+	_settingStartTimePrefix = "gorm-SQLInsights:start_time:"
+)
+
+// startTimeKey returns the statement setting key used to store the start time for the specified stat type
+func startTimeKey(sType statType) string {
+	return _settingStartTimePrefix + sType.String()
+}
+
+// durationMilliseconds returns the duration in fractional milliseconds with microsecond precision. Earlier versions stored seconds, converted by GormStore.Migrate
+func durationMilliseconds(d time.Duration) float64 {
+	return float64(int64(float64(d.Nanoseconds())/1e3)) / 1000
+}
 
-	// calculate the execution duration in fractional milliseconds
-	var took float64
-	if inTimeA, ok := s.statementMaps[ctxMapKey].LoadAndDelete(*(*uint64)(unsafe.Pointer(db.Statement))); ok {
-		if inTime, ok := inTimeA.(time.Time); ok {
-			took = float64(int64(float64(now.Sub(inTime).Nanoseconds())/1e6)) / 1000 // fractional milliseconds
-			// return our execution duration
-			return took, now, nil
+// getTimeTaken calculates the time taken for a query to execute, returning the duration in fractional milliseconds, the current time, the statement start details, and any error that occurred
+func (s *SQLInsights) getTimeTaken(startKey string, db *gorm.DB) (float64, time.Time, statementStart, error) {
+	// retrieve the "in time" from the statement settings and compare it with the current time
+	if startA, ok := db.Statement.Settings.LoadAndDelete(startKey); ok {
+		if start, ok := startA.(statementStart); ok {
+			if start.Counted {
+				// not timed, the statement is only counted in its unit of work
+				return 0, time.Time{}, start, nil
+			}
+			// calculate and return the execution duration in fractional milliseconds
+			now := time.Now().UTC()
+			return durationMilliseconds(now.Sub(start.At)), now, start, nil
 		}
 	}
 
-	return 0, now, gorm.ErrInvalidData
+	return 0, time.Time{}, statementStart{}, gorm.ErrInvalidData
 }
 
 // insightsBefore is a generic callback that is called before a query is executed to inject the current time into the context
 func (s *SQLInsights) insightsBefore(sType statType) func(*gorm.DB) {
-	ctxMapKey := sType.String()
+	startKey := startTimeKey(sType)
 	return func(db *gorm.DB) {
 		if db == nil || db.Statement == nil || db.Config == nil || db.Config.DryRun {
 			// dont track with a nil db, statement, and/or missing config or if this is a dry run
 			return
 		}
 
-		// store our current time in our statement map using the statement pointer address as the key as this should be unique for each statement, at least in the context of a single request
-		s.statementMaps[ctxMapKey].Store(*(*uint64)(unsafe.Pointer(db.Statement)), time.Now().UTC())
+		if s.wrapsDriver.Load() && db.Statement.Context.Value(gormStatementContextKey{}) == nil {
+			// mark the statement as executed by GORM so a wrapped database/sql driver does not record it again, once per statement
+			db.Statement.Context = context.WithValue(db.Statement.Context, gormStatementContextKey{}, struct{}{})
+		}
+
+		// honor directives set at the call site, then evaluate our filter rules so excluded statements are not timed or sampled
+		dirs := statementDirectives(db)
+		if dirs.Skip {
+			db.Statement.Settings.Delete(startKey)
+			return
+		}
+		filter := s.filterStatement(db.Statement.Context, db.Statement.Table, sType, db.Statement.SQL.String())
+		if filter == _filterSkip {
+			db.Statement.Settings.Delete(startKey)
+			return
+		}
+
+		// decide if this statement is sampled. Unsampled statements are only timed when something else still needs their timing, traced and logged statements are always timed
+		rate, sampled := s.sampler.sample(sType)
+		if !sampled && filter != _filterPending && dirs.SlowMS <= 0 && s.tracer == nil && !s.logsStatements() && !s.needsUnsampledTiming() && statementTx(db) == nil {
+			if unitOfWorkFromContext(db.Statement.Context) != nil {
+				// only count this statement in its unit of work, which needs neither its timing nor its callers
+				db.Statement.Settings.Store(startKey, statementStart{Counted: true})
+				return
+			}
+			// make sure a start time left behind by a cloned statement is not picked up by our after callback
+			db.Statement.Settings.Delete(startKey)
+			return
+		}
+
+		// start the span of the statement, then store our current time on the statement itself. Each executing statement has its own settings so this is safe under concurrency and is released along with the statement if the after callback never fires
+		span, parent := s.startSpan(db, sType)
+		db.Statement.Settings.Store(startKey, statementStart{At: time.Now().UTC(), Rate: rate, Sampled: sampled, Filter: filter == _filterPending, Span: span, Context: parent})
 	}
 }
 
-// insightsAfter is a generic callback that is called after a query is executed to collect the execution details
-func (s *SQLInsights) insightsAfter(sType statType) func(*gorm.DB) {
-	ctxMapKey := sType.String()
+// insightsAfter is a generic callback that is called after a query is executed to collect the execution details, recorded under the specified database name
+func (s *SQLInsights) insightsAfter(database string, sType statType) func(*gorm.DB) {
+	startKey := startTimeKey(sType)
 	return func(db *gorm.DB) {
 		if db == nil || db.Statement == nil || db.Config == nil || db.Config.DryRun {
 			// dont track with a nil db, statement, and/or missing config or if this is a dry run
 			return
 		}
-		if took, now, err := s.getTimeTaken(ctxMapKey, db); err == nil {
-			// report our non parametrized SQL statement with execution details
-			v := &stat{
-				TimeStamp: now,
-				Type:      sType,
-				Key:       db.Statement.SQL.String(),
-				NumVars:   len(db.Statement.Vars),
-				Took:      took,
-				Rows:      db.RowsAffected,
-				Error:     db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound),
-				Callers:   getCallers(s.config.CollectCallerDepth),
-			}
-			go s.insightsAddStat(v)
+		took, now, start, err := s.getTimeTaken(startKey, db)
+		if err != nil {
+			return
+		}
+		key := db.Statement.SQL.String()
+		if start.Counted {
+			// unsampled statement only counted in its unit of work
+			s.countUnitOfWork(db.Statement.Context, sType, key, len(db.Statement.Vars), nil)
+			return
+		}
+		isError := db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound)
+		s.endSpan(db, start, database, sType, key, isError)
+		if start.Filter && s.filterStatement(db.Statement.Context, db.Statement.Table, sType, key) != _filterRecord {
+			// excluded by a rule matching the SQL text
+			return
+		}
+		dirs := statementDirectives(db)
+		slow := s.isSlow(took, dirs.SlowMS)
+		override := s.keepUnsampled(isError, slow)
+		keep := start.Sampled || override
+		tx := statementTx(db)
+		if s.logsStatements() {
+			// log slow and failed statements as they complete
+			s.logStatement(db, start, database, sType, key, took, now, isError)
+		}
+
+		// collect our callers if this is the first statement of a transaction, recorded statements only capture their program counters here and are resolved by the collector
+		var callers []*callerInfo
+		if tx != nil && tx.firstStatementPending() {
+			callers = s.getCallers(s.config.CollectCallerDepth)
+		}
+
+		s.countUnitOfWork(db.Statement.Context, sType, key, len(db.Statement.Vars), callers)
+		if tx != nil {
+			// record this statement against the transaction it is executing in
+			tx.recordStatement(key, took, now, callers)
+		}
+		if !keep {
+			// not sampled
+			return
+		}
+
+		// weight sampled statements by the inverse of their sample rate so aggregated totals remain unbiased. Statements kept by an override are always recorded so they count once
+		weight := 1.0
+		if !override && start.Rate > 0 {
+			weight = 1 / start.Rate
+		}
+
+		// report our non parametrized SQL statement with execution details, using a pooled stat value
+		v := newStat()
+		v.TimeStamp = now
+		v.Type = sType
+		v.Key = key
+		v.Table = db.Statement.Table
+		v.Database = database
+		v.Connection = s.statementConnection(db, sType)
+		v.NumVars = len(db.Statement.Vars)
+		v.Took = took
+		v.Rows = db.RowsAffected
+		v.Error = isError
+		v.Slow = slow
+		if slow {
+			// keep the trace of slow executions as an exemplar
+			v.TraceID = statementTraceID(db.Statement.Context, start.Span)
+		}
+		v.Name = dirs.Name
+		v.Weight = weight
+		v.LabelSet = LabelsFromContext(db.Statement.Context)
+		v.pcs = s.callerPCs(v.pcs, s.config.CollectCallerDepth)
+		if isError {
+			// classify the error while we still have it
+			v.ErrorClass, v.ErrorCode = classifyError(db.Error)
+			v.ErrorMessage = errorMessage(db.Error)
 		}
+		s.insightsAddStat(v)
 	}
 }
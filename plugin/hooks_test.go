@@ -1,12 +1,41 @@
 package insights
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -26,20 +55,38 @@ func BenchmarkSQLInsights(b *testing.B) {
 
 	// test query without our plugin hooks
 	b.Run("queryNoHooks", func(b *testing.B) {
+		b.ReportAllocs()
 		for i := 0; i < b.N; i++ {
 			db.Where("id = ?", i).Order("id ASC").Find(&mockTestUser{})
 		}
 	})
+	b.Run("queryNoHooksParallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				db.Where("id = ?", i).Order("id ASC").Find(&mockTestUser{})
+			}
+		})
+	})
 
 	// add our plugin
 	db.Use(sInsights)
 
 	// test query with our plugin hooks
 	b.Run("queryHooks", func(b *testing.B) {
+		b.ReportAllocs()
 		for i := 0; i < b.N; i++ {
 			_ = db.Where("id = ?", i).Order("id ASC").Find(&mockTestUser{}).Error
 		}
 	})
+	b.Run("queryHooksParallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				_ = db.Where("id = ?", i).Order("id ASC").Find(&mockTestUser{}).Error
+			}
+		})
+	})
 
 	// stop insights
 	if err := sInsights.Stop(0); err != nil {
@@ -47,12 +94,304 @@ func BenchmarkSQLInsights(b *testing.B) {
 	}
 }
 
+func BenchmarkCallers(b *testing.B) {
+	sInsights := newTestInsights(b, Config{
+		InstanceID:         "test",
+		CollectCallerDepth: 5,
+	})
+
+	// capture and resolve callers of stacks seen before, as for every statement once warmed up
+	b.Run("getCallers", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sInsights.getCallers(5)
+		}
+	})
+	b.Run("getCallersParallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				sInsights.getCallers(5)
+			}
+		})
+	})
+
+	// resolve a new stack, with and without its program counters resolved before
+	pcs := make([]uintptr, 32)
+	pcs = pcs[:runtime.Callers(1, pcs)]
+	b.Run("resolveStack", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			clear(sInsights.callerCache.stacks)
+			sInsights.lookupCallers(pcs, 5, false)
+		}
+	})
+	b.Run("resolveStackCold", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			clear(sInsights.callerCache.stacks)
+			clear(sInsights.callerCache.frames)
+			sInsights.lookupCallers(pcs, 5, false)
+		}
+	})
+
+	// the previous implementation, capturing a new buffer and resolving each program counter with runtime.FuncForPC for every statement
+	b.Run("funcForPC", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			fptrs := make([]uintptr, 15+5)
+			n := runtime.Callers(1, fptrs)
+			callers := make([]*callerInfo, 0, 5)
+			for _, pc := range fptrs[:n] {
+				if f := runtime.FuncForPC(pc); f != nil {
+					fileName, fileLine := f.FileLine(pc)
+					callers = append(callers, &callerInfo{Filename: fileName, Line: fileLine, Function: f.Name()})
+					if len(callers) >= 5 {
+						break
+					}
+				}
+			}
+			_, _ = sInsights.hashCallers(callers)
+		}
+	})
+}
+
+// captureInlined captures the program counters of its own frame, it is small enough to be inlined into its caller
+func captureInlined(pcs []uintptr) int {
+	return runtime.Callers(1, pcs)
+}
+
+// captureDeep captures the program counters of its frame below the specified number of recursive frames
+func captureDeep(depth int, capture func()) {
+	if depth <= 0 {
+		capture()
+		return
+	}
+	captureDeep(depth-1, capture)
+}
+
+func TestCallerFrames(t *testing.T) {
+	sInsights := newTestInsights(t, Config{
+		InstanceID:                "test",
+		CollectCallerDepth:        1,
+		CallerSkipPackagePrefixes: []string{"testing."},
+	})
+
+	// inlined functions are resolved as their own frame
+	pcs := make([]uintptr, 1)
+	captureInlined(pcs)
+	if frames := sInsights.resolveFrames(pcs[0]); len(frames) == 0 || frames[0].info.Function != "github.com/viocle/go-gorm-sql-insights/plugin.captureInlined" || !frames[0].skip {
+		t.Fatalf("expected the inlined function as the first frame, got %+v", frames)
+	}
+
+	// stacks deeper than we capture grow the number of program counters captured until the callers are found
+	var callers []*callerInfo
+	for i := 0; i < 5 && len(callers) == 0; i++ {
+		captureDeep(40, func() {
+			callers = sInsights.getCallers(1)
+		})
+	}
+	if len(callers) != 1 || callers[0].Function != "runtime.goexit" || sInsights.captureFrames() <= _minCallerFrames {
+		t.Fatalf("expected the capture to grow past the recursive frames, got %+v with %d frames", callers, sInsights.captureFrames())
+	}
+
+	// callers of stacks seen before are resolved without allocating
+	captured := func() {
+		callers = sInsights.getCallers(1)
+	}
+	captured()
+	if allocs := testing.AllocsPerRun(100, captured); allocs != 0 {
+		t.Fatalf("expected no allocations resolving callers seen before, got %f", allocs)
+	}
+}
+
+func TestStatQueue(t *testing.T) {
+	q := newStatQueue(100)
+	if q.size() != 128 {
+		t.Fatalf("expected queue size to be rounded up to 128, got %d", q.size())
+	}
+
+	// fill the queue from many producers while a single consumer pops
+	const producers, perProducer = 8, 1000
+	wg := sync.WaitGroup{}
+	wg.Add(producers)
+	for p := 0; p < producers; p++ {
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				v := &stat{NumVars: p*perProducer + i}
+				for !q.push(v) {
+					// full, wait for the consumer
+					time.Sleep(time.Microsecond)
+				}
+			}
+		}(p)
+	}
+	seen := make(map[int]struct{}, producers*perProducer)
+	deadline := time.Now().Add(10 * time.Second)
+	for len(seen) < producers*perProducer && time.Now().Before(deadline) {
+		v, ok := q.pop()
+		if !ok {
+			time.Sleep(time.Microsecond)
+			continue
+		}
+		if _, ok := seen[v.NumVars]; ok {
+			t.Fatalf("stat %d popped more than once", v.NumVars)
+		}
+		seen[v.NumVars] = struct{}{}
+	}
+	wg.Wait()
+	if len(seen) != producers*perProducer {
+		t.Fatalf("expected %d stats, got %d", producers*perProducer, len(seen))
+	}
+	if _, ok := q.pop(); ok || q.len() != 0 {
+		t.Fatalf("expected queue to be empty, has %d", q.len())
+	}
+
+	// a full queue rejects new stats
+	for i := 0; i < q.size(); i++ {
+		if !q.push(&stat{}) {
+			t.Fatalf("expected push %d to succeed", i)
+		}
+	}
+	if q.push(&stat{}) {
+		t.Fatal("expected push to a full queue to fail")
+	}
+}
+
+func TestSketchAccuracy(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	quantiles := []float64{0.5, 0.9, 0.95, 0.99, 0.999}
+	distributions := map[string]func() float64{
+		// latencies with a long tail, in milliseconds
+		"lognormal": func() float64 { return math.Exp(rng.NormFloat64()*1.5 + 1) },
+		// bimodal latencies, cache hits and misses
+		"bimodal": func() float64 {
+			if rng.Intn(10) < 8 {
+				return 0.2 + rng.Float64()*0.1
+			}
+			return 40 + rng.Float64()*20
+		},
+		// row counts, many of them zero
+		"rows": func() float64 { return float64(max(0, int(rng.ExpFloat64()*50)-10)) },
+	}
+	for name, next := range distributions {
+		t.Run(name, func(t *testing.T) {
+			const n = 100000
+			values := make([]float64, n)
+			var whole, first, second sketch
+			var sum float64
+			for i := range values {
+				values[i] = next()
+				sum += values[i]
+				whole.add(values[i], 1)
+				if i%2 == 0 {
+					first.add(values[i], 1)
+				} else {
+					second.add(values[i], 1)
+				}
+			}
+			sort.Float64s(values)
+			first.merge(&second)
+
+			for _, q := range quantiles {
+				exact := values[min(int(q*n), n-1)]
+				for sketchName, k := range map[string]*sketch{"whole": &whole, "merged": &first} {
+					estimate := k.quantile(q)
+					if math.Abs(estimate-exact) > exact*_sketchRelativeAccuracy+1e-9 {
+						t.Fatalf("%s p%g: expected %f within %g, got %f", sketchName, q*100, exact, _sketchRelativeAccuracy, estimate)
+					}
+				}
+			}
+			if whole.min != values[0] || whole.max != values[n-1] || first.min != values[0] || first.max != values[n-1] {
+				t.Fatalf("expected min %f and max %f, got %f/%f and %f/%f", values[0], values[n-1], whole.min, whole.max, first.min, first.max)
+			}
+
+			// standard deviation matches the exact computation
+			mean := sum / n
+			var squares float64
+			for _, v := range values {
+				squares += (v - mean) * (v - mean)
+			}
+			exactStdDev := math.Sqrt(squares / n)
+			for sketchName, k := range map[string]*sketch{"whole": &whole, "merged": &first} {
+				if math.Abs(k.stdDev()-exactStdDev) > exactStdDev*1e-6 {
+					t.Fatalf("%s: expected standard deviation %f, got %f", sketchName, exactStdDev, k.stdDev())
+				}
+			}
+		})
+	}
+
+	// weighted values count as many values, and a reset sketch keeps its bins
+	var weighted, repeated sketch
+	for i := 1; i <= 100; i++ {
+		weighted.add(float64(i), 4)
+		for j := 0; j < 4; j++ {
+			repeated.add(float64(i), 1)
+		}
+	}
+	for _, q := range quantiles {
+		if weighted.quantile(q) != repeated.quantile(q) {
+			t.Fatalf("p%g: expected weighted %f to match repeated %f", q*100, weighted.quantile(q), repeated.quantile(q))
+		}
+	}
+	if math.Abs(weighted.stdDev()-repeated.stdDev()) > 1e-9 {
+		t.Fatalf("expected weighted standard deviation %f to match repeated %f", weighted.stdDev(), repeated.stdDev())
+	}
+	bins := len(weighted.bins)
+	weighted.reset()
+	if weighted.quantile(0.5) != 0 || weighted.stdDev() != 0 || len(weighted.bins) != bins {
+		t.Fatalf("expected an empty sketch keeping %d bins, got p50 %f with %d bins", bins, weighted.quantile(0.5), len(weighted.bins))
+	}
+}
+
+func TestLatencyHeatmap(t *testing.T) {
+	// bimodal latencies are kept apart in their buckets
+	agg := &statAggregate{}
+	for i := 0; i < 30; i++ {
+		agg.add(&stat{Key: "SELECT 1", KeyHash: "hash", Took: 0.3})
+	}
+	for i := 0; i < 10; i++ {
+		agg.add(&stat{Key: "SELECT 1", KeyHash: "hash", Took: 40, Weight: 2})
+	}
+	agg.add(&stat{Key: "SELECT 1", KeyHash: "hash", Took: 20000})
+	statHistory, _ := (&SQLInsights{}).buildStatHistory(newTestReportBucket(), _statTypeQuery, agg)
+	if statHistory.Latency != "0,0,30,0,0,0,0,0,20,0,0,0,0,0,0,0,1" {
+		t.Fatalf("expected 30 executions up to 0.5ms, 20 up to 50ms, and 1 over 10s, got %q", statHistory.Latency)
+	}
+	agg.reset()
+	agg.add(&stat{Key: "SELECT 1", KeyHash: "hash", Took: 0.05})
+	if statHistory, _ = (&SQLInsights{}).buildStatHistory(newTestReportBucket(), _statTypeQuery, agg); statHistory.Latency != "1" {
+		t.Fatalf("expected trailing empty buckets to be omitted, got %q", statHistory.Latency)
+	}
+
+	// history records are summed into time columns
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := []*latencyHeatmapRow{
+		{CreatedAt: from.Add(time.Minute), Latency: "1,2"},
+		{CreatedAt: from.Add(2 * time.Minute), Latency: "0,1,3"},
+		{CreatedAt: from.Add(7 * time.Minute), Latency: "5,x,0,0,0,0,0,0,0,0,0,0,0,0,0,0,4,9"},
+	}
+	heatmap := buildLatencyHeatmap(5*time.Minute, rows)
+	if len(heatmap.Bounds) != len(_latencyBucketBounds) || len(heatmap.Times) != 2 || len(heatmap.Counts) != 2 {
+		t.Fatalf("expected 2 time columns, got %d times and %d counts", len(heatmap.Times), len(heatmap.Counts))
+	}
+	if !heatmap.Times[0].Equal(from) || !heatmap.Times[1].Equal(from.Add(5*time.Minute)) {
+		t.Fatalf("expected time columns aligned to the interval, got %v", heatmap.Times)
+	}
+	if heatmap.Counts[0][0] != 1 || heatmap.Counts[0][1] != 3 || heatmap.Counts[0][2] != 3 || len(heatmap.Counts[0]) != _latencyBucketCount {
+		t.Fatalf("expected the first column to sum its records, got %v", heatmap.Counts[0])
+	}
+	if heatmap.Counts[1][0] != 5 || heatmap.Counts[1][1] != 0 || heatmap.Counts[1][_latencyBucketCount-1] != 4 {
+		t.Fatalf("expected invalid and extra buckets to be ignored, got %v", heatmap.Counts[1])
+	}
+}
+
 func TestSQLInsights(t *testing.T) {
-	sqlDB, db, _ := newMock(t, nil)
-	defer sqlDB.Close()
+	_, db, _ := newMock(t, nil)
 
 	// create our new insights monitor
-	sInsights := New(Config{
+	sInsights := useTestInsights(t, db, Config{
 		DB:                     db,
 		InstanceID:             "test",
 		CollectCallerDepth:     5,
@@ -79,9 +418,6 @@ func TestSQLInsights(t *testing.T) {
 		t.Fatalf("expected SkipAutomigration to be false, got %t", sInsights.config.SkipAutomigration)
 	}
 
-	// setup plugin
-	db.Use(sInsights)
-
 	wg := sync.WaitGroup{}
 	wg.Add(10)
 	for idx := 0; idx < 10; idx++ {
@@ -92,64 +428,2078 @@ func TestSQLInsights(t *testing.T) {
 	}
 	wg.Wait()
 
-	// give time for background workers to process
-	time.Sleep(10 * time.Millisecond)
-
-	// drain the stats channel
-	sInsights.DrainStatsChannel(10 * time.Second)
+	// collect the queued statistics
+	drainTestStats(t, sInsights)
 
 	// we should have 1 hash and 10 stats entries
-	sInsights.statsLock.Lock()
+	unlock := lockTestStats(t, sInsights)
 	if len(sInsights.stats) != 1 {
 		t.Fatalf("expected 1 statement type entry, got %d", len(sInsights.stats))
 	}
 	if statements := len(sInsights.stats[_statTypeQuery]); statements != 1 {
 		t.Fatalf("expected 1 statement hash entry, got %d", statements)
 	}
-	for _, stats := range sInsights.stats[_statTypeQuery] {
-		if len(stats) != 10 {
-			t.Fatalf("expected 10 stats entries, got %d", len(stats))
+	for _, agg := range sInsights.stats[_statTypeQuery] {
+		if agg.samples != 10 {
+			t.Fatalf("expected 10 stats entries, got %d", agg.samples)
+		}
+	}
+	unlock()
+
+}
+
+func TestSQLInsightsWriteCallbacks(t *testing.T) {
+	_, db, _ := newMock(t, nil)
+
+	// create our new insights monitor without a storage DB
+	sInsights := useTestInsights(t, db, Config{
+		InstanceID: "test",
+	})
+
+	// skip the default transaction so each statement is built without mock begin/commit expectations
+	db = db.Session(&gorm.Session{SkipDefaultTransaction: true})
+
+	// perform one statement of each write type along with a row query
+	db.Create(&mockTestUser{FullName: "Test User"})
+	db.Model(&mockTestUser{ID: 1}).Update("full_name", "Updated User")
+	db.Delete(&mockTestUser{ID: 1})
+	db.Model(&mockTestUser{}).Where("id = ?", 1).Row()
+
+	// collect the queued statistics
+	drainTestStats(t, sInsights)
+
+	unlock := lockTestStats(t, sInsights)
+	for _, sType := range []statType{_statTypeCreate, _statTypeUpdate, _statTypeDelete, _statTypeRow} {
+		if statements := len(sInsights.stats[sType]); statements != 1 {
+			t.Fatalf("expected 1 %s statement hash entry, got %d", sType, statements)
+		}
+	}
+	unlock()
+
+	// unregister and stop insights
+	if err := sInsights.unregister(); err != nil {
+		t.Fatalf("failed to unregister sql insights plugin: %s", err)
+	}
+}
+
+func TestSQLInsightsConcurrentTiming(t *testing.T) {
+	_, db, mock := newMock(t, nil)
+
+	// expect our queries in any order, each one delayed so we have a known minimum duration
+	const queries = 2000
+	const delay = 2 * time.Millisecond
+	mock.MatchExpectationsInOrder(false)
+	for idx := 0; idx < queries; idx++ {
+		mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillDelayFor(delay).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(idx))
+	}
+
+	// create our new insights monitor without a storage DB
+	sInsights := useTestInsights(t, db, Config{
+		InstanceID:              "test",
+		MaxStatisticsBufferSize: queries,
+	})
+
+	// check that no start time remains on the statement once our after callback has run
+	var residual atomic.Int64
+	if err := db.Callback().Query().After(_eventAfterQuery).Register("test:residual", func(db *gorm.DB) {
+		if _, ok := db.Statement.Settings.Load(startTimeKey(_statTypeQuery)); ok {
+			residual.Add(1)
+		}
+	}); err != nil {
+		t.Fatalf("failed to register residual check callback: %s", err)
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(queries)
+	for idx := 0; idx < queries; idx++ {
+		go func(i int) {
+			defer wg.Done()
+			db.Where("id = ?", i).Find(&mockTestUser{})
+		}(idx)
+	}
+	wg.Wait()
+
+	// collect the queued statistics
+	drainTestStats(t, sInsights)
+
+	if r := residual.Load(); r != 0 {
+		t.Fatalf("expected no residual start times, got %d", r)
+	}
+
+	unlock := lockTestStats(t, sInsights)
+	count := 0
+	for _, agg := range sInsights.stats[_statTypeQuery] {
+		count += agg.samples
+		if agg.errorCount > 0 {
+			t.Fatalf("expected no errors, got %f errors for %s", agg.errorCount, agg.Key)
+		}
+		if agg.took.min < float64(delay.Milliseconds()) {
+			t.Fatalf("expected duration of at least %dms, got %fms", delay.Milliseconds(), agg.took.min)
+		}
+	}
+	unlock()
+	if count != queries {
+		t.Fatalf("expected %d stats entries, got %d", queries, count)
+	}
+
+}
+
+func TestSQLInsightsTransactions(t *testing.T) {
+	_, db, mock := newMock(t, nil)
+
+	// create our new insights monitor without a storage DB, collecting transactions
+	sInsights := useTestInsights(t, db, Config{
+		InstanceID:          "test",
+		CollectTransactions: true,
+	})
+
+	// one committed transaction with two statements and one rolled back transaction with a single statement
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillDelayFor(2 * time.Millisecond).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectRollback()
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ?", 1).Find(&mockTestUser{}).Error; err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond)
+		return tx.Where("id = ? AND user_name = ?", 2, "test").Find(&mockTestUser{}).Error
+	}); err != nil {
+		t.Fatalf("expected transaction to commit, got %s", err)
+	}
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		tx.Where("id = ?", 1).Find(&mockTestUser{})
+		return gorm.ErrInvalidData
+	}); err == nil {
+		t.Fatalf("expected transaction to roll back")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %s", err)
+	}
+
+	// DB() should still resolve through our wrapped connection pool
+	if _, err := db.DB(); err != nil {
+		t.Fatalf("expected DB() to resolve the wrapped connection pool, got %s", err)
+	}
+
+	// collect the queued statistics, waiting for both transactions
+	waitTestStats(t, sInsights, func() bool {
+		count := 0
+		for _, txValues := range sInsights.txStats {
+			count += len(txValues)
+		}
+		return count == 2
+	})
+
+	// both transactions start with the same statement and caller so they share a group
+	unlock := lockTestStats(t, sInsights)
+	if len(sInsights.txStats) != 1 {
+		t.Fatalf("expected 1 transaction group, got %d", len(sInsights.txStats))
+	}
+	for _, txValues := range sInsights.txStats {
+		txHistory := sInsights.buildTxHistory(newTestReportBucket(), txValues)
+		if txHistory.Count != 2 || txHistory.Commits != 1 || txHistory.Rollbacks != 1 {
+			t.Fatalf("expected 2 transactions with 1 commit and 1 rollback, got %d with %d commits and %d rollbacks", txHistory.Count, txHistory.Commits, txHistory.Rollbacks)
+		}
+		if txHistory.StatementsMax != 2 || txHistory.StatementsSum != 3 {
+			t.Fatalf("expected max of 2 and total of 3 statements, got %d and %d", txHistory.StatementsMax, txHistory.StatementsSum)
 		}
+		if len(txHistory.GetHashIDs()) != 2 {
+			t.Fatalf("expected 2 distinct statement hashes, got %d", len(txHistory.GetHashIDs()))
+		}
+		if txHistory.TookMax < 3 || txHistory.IdleMax < 1 {
+			t.Fatalf("expected a transaction of at least 3ms with at least 1ms idle, got %fms with %fms idle", txHistory.TookMax, txHistory.IdleMax)
+		}
+	}
+	unlock()
+
+	// unregister and stop insights, restoring the original connection pool
+	if err := sInsights.unregister(); err != nil {
+		t.Fatalf("failed to unregister sql insights plugin: %s", err)
+	}
+	if _, ok := db.ConnPool.(*txConnPool); ok {
+		t.Fatalf("expected original connection pool to be restored")
+	}
+}
+
+func TestSQLInsightsLabels(t *testing.T) {
+	_, db, _ := newMock(t, nil)
+
+	// create our new insights monitor without a storage DB, only recording route labels with a maximum of 2 label sets
+	sInsights := useTestInsights(t, db, Config{
+		InstanceID:   "test",
+		LabelKeys:    []string{LabelRoute},
+		MaxLabelSets: 2,
+	})
+
+	// labels merge over existing labels
+	ctx := WithLabels(context.Background(), map[string]string{LabelRoute: "/a", "tenant": "t1"})
+	if labels := LabelsFromContext(WithLabels(ctx, map[string]string{"tenant": "t2"})); labels[LabelRoute] != "/a" || labels["tenant"] != "t2" {
+		t.Fatalf("expected merged labels, got %v", labels)
+	}
+
+	// requests through our middleware are labeled with the matched pattern
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		db.WithContext(r.Context()).Where("id = ?", r.PathValue("id")).Find(&mockTestUser{})
+	})
+	for _, path := range []string{"/users/1", "/users/2"} {
+		LabelsMiddleware(mux).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// gRPC requests are labeled with their full method name
+	_, _ = UnaryServerInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/users.Users/Get"}, func(ctx context.Context, req any) (any, error) {
+		return nil, db.WithContext(ctx).Where("id = ?", 1).Find(&mockTestUser{}).Error
+	})
+
+	// collect our first two label sets before adding more
+	drainTestStats(t, sInsights)
+
+	// a third distinct label set exceeds our limit and is recorded as overflow, unlabeled statements are unaffected
+	db.WithContext(WithLabels(context.Background(), map[string]string{LabelRoute: "/other"})).Where("id = ?", 1).Find(&mockTestUser{})
+	db.Where("id = ?", 1).Find(&mockTestUser{})
+
+	// collect the queued statistics
+	drainTestStats(t, sInsights)
+
+	sInsights.statsLock.Lock()
+	counts := make(map[string]int, 4)
+	for _, agg := range sInsights.stats[_statTypeQuery] {
+		counts[agg.Labels] += agg.samples
 	}
 	sInsights.statsLock.Unlock()
+	expected := map[string]int{
+		"route=GET+%2Fusers%2F%7Bid%7D": 2,
+		"route=%2Fusers.Users%2FGet":    1,
+		_labelsOverflow:                 1,
+		"":                              1,
+	}
+	for labels, count := range expected {
+		if counts[labels] != count {
+			t.Fatalf("expected %d stats for labels %q, got %d (%v)", count, labels, counts[labels], counts)
+		}
+	}
 
-	// stop insights
-	if err := sInsights.Stop(0); err != nil {
-		t.Fatalf("failed to stop sql insights plugin: %s", err)
+}
+
+func TestSQLInsightsRepetitions(t *testing.T) {
+	_, db, _ := newMock(t, nil)
+
+	// create our new insights monitor without a storage DB, flagging statements repeated 5 or more times
+	sInsights := useTestInsights(t, db, Config{
+		InstanceID:          "test",
+		RepetitionThreshold: 5,
+	})
+
+	// loop over a query within a unit of work, along with a query below the threshold
+	ctx, done := WithUnitOfWork(context.Background())
+	for idx := 0; idx < 8; idx++ {
+		db.WithContext(ctx).Where("id = ?", idx).Find(&mockTestUser{})
+	}
+	for idx := 0; idx < 3; idx++ {
+		db.WithContext(ctx).Where("user_name = ?", idx).Find(&mockTestUser{})
+	}
+	done()
+
+	// the same loop outside of a unit of work is not flagged
+	for idx := 0; idx < 8; idx++ {
+		db.Where("id = ?", idx).Find(&mockTestUser{})
+	}
+
+	// collect the queued statistics, waiting for the repetition finding
+	waitTestStats(t, sInsights, func() bool { return len(sInsights.repetitions) != 0 })
+
+	unlock := lockTestStats(t, sInsights)
+	if len(sInsights.repetitions) != 1 {
+		t.Fatalf("expected 1 repetition finding, got %d", len(sInsights.repetitions))
+	}
+	for _, repValues := range sInsights.repetitions {
+		repHistory := sInsights.buildRepetitionHistory(newTestReportBucket(), repValues)
+		if repHistory.Occurrences != 1 || repHistory.RepetitionsMax != 8 {
+			t.Fatalf("expected 1 occurrence of 8 repetitions, got %d of %d", repHistory.Occurrences, repHistory.RepetitionsMax)
+		}
+		if len(repValues[0].Callers) == 0 || repHistory.CallerHash == "" {
+			t.Fatalf("expected the callers of the repeated statement to be recorded")
+		}
+		if suggestion := suggestBatching(repHistory.Type, repValues[0].Key, repHistory.RepetitionsMax); !strings.Contains(suggestion, "id IN (?)") {
+			t.Fatalf("expected suggestion to batch by id, got %q", suggestion)
+		}
 	}
+	unlock()
+
 }
 
-type mockTestUser struct {
-	ID       uint   `gorm:"primarykey"`
-	FullName string `json:"full_name"`
-	UserName string `json:"user_name"`
-	Password string `json:"password"`
+func TestSQLInsightsRepetitionsLabels(t *testing.T) {
+	sInsights := newTestInsights(t, Config{InstanceID: "test"})
+
+	// the same loop hit from two routes is reported once per route
+	sInsights.statsLock.Lock()
+	defer sInsights.statsLock.Unlock()
+	for _, route := range []string{"/users", "/orders", "/users"} {
+		sInsights.unsafeAddRepetition(&repetitionStat{
+			Type:        _statTypeQuery,
+			KeyHash:     hash("SELECT * FROM users WHERE id = ?"),
+			CallerHash:  "caller",
+			Repetitions: 10,
+			Labels:      sInsights.encodeLabels(map[string]string{"route": route}),
+		})
+	}
+	if len(sInsights.repetitions) != 2 {
+		t.Fatalf("expected 2 repetition groups, got %d", len(sInsights.repetitions))
+	}
+	for _, repValues := range sInsights.repetitions {
+		repHistory := sInsights.buildRepetitionHistory(newTestReportBucket(), repValues)
+		route := decodeLabels(repHistory.Labels)["route"]
+		if expected := map[string]int{"/users": 2, "/orders": 1}[route]; repHistory.Occurrences != expected {
+			t.Fatalf("expected %d occurrences for route %q, got %d", expected, route, repHistory.Occurrences)
+		}
+	}
 }
 
-// newMock creates a new mock database and gorm connection for testing/benchmarking purposes. Ignore expectations
-func newMock(t *testing.T, b *testing.B) (*sql.DB, *gorm.DB, sqlmock.Sqlmock) {
-	sqldb, mock, err := sqlmock.New()
-	if err != nil {
-		if t != nil {
-			t.Fatal(err)
-		} else if b != nil {
-			b.Fatal(err)
+func TestSQLInsightsRepetitionsUnsampled(t *testing.T) {
+	_, db, _ := newMock(t, nil)
+
+	// create our new insights monitor without a storage DB, sampling practically nothing and flagging statements repeated 5 or more times
+	sInsights := useTestInsights(t, db, Config{
+		InstanceID:          "test",
+		SampleRate:          1e-9,
+		RepetitionThreshold: 5,
+	})
+	callerStacks := func() int {
+		sInsights.callerCache.lock.RLock()
+		defer sInsights.callerCache.lock.RUnlock()
+		return len(sInsights.callerCache.stacks)
+	}
+
+	// unsampled repeats below the threshold are only counted, their callers are not collected
+	ctx, done := WithUnitOfWork(context.Background())
+	for idx := 0; idx < 4; idx++ {
+		db.WithContext(ctx).Where("id = ?", idx).Find(&mockTestUser{})
+	}
+	if stacks := callerStacks(); stacks != 0 {
+		t.Fatalf("expected no callers collected below the repetition threshold, got %d stacks", stacks)
+	}
+
+	// the execution reaching the threshold collects its callers once
+	for idx := 4; idx < 8; idx++ {
+		db.WithContext(ctx).Where("id = ?", idx).Find(&mockTestUser{})
+	}
+	if stacks := callerStacks(); stacks != 1 {
+		t.Fatalf("expected the callers to be collected once, got %d stacks", stacks)
+	}
+	done()
+
+	// collect the queued statistics, waiting for the repetition finding
+	waitTestStats(t, sInsights, func() bool { return len(sInsights.repetitions) != 0 })
+
+	unlock := lockTestStats(t, sInsights)
+	if len(sInsights.stats) != 0 {
+		t.Fatalf("expected no statistics for unsampled statements, got %d", len(sInsights.stats))
+	}
+	if len(sInsights.repetitions) != 1 {
+		t.Fatalf("expected 1 repetition finding, got %d", len(sInsights.repetitions))
+	}
+	for _, repValues := range sInsights.repetitions {
+		if repValues[0].Repetitions != 8 || len(repValues[0].Callers) == 0 {
+			t.Fatalf("expected 8 repetitions with callers, got %d with %d callers", repValues[0].Repetitions, len(repValues[0].Callers))
 		}
 	}
-	gormdb, err := gorm.Open(postgres.New(postgres.Config{
-		Conn: sqldb,
-	}), &gorm.Config{
-		// silence log output, we're not using expectations
-		Logger: logger.Default.LogMode(logger.Silent),
+	unlock()
+
+}
+
+func TestSQLInsightsSampling(t *testing.T) {
+	_, db, mock := newMock(t, nil)
+
+	// create our new insights monitor without a storage DB, sampling a quarter of our queries but keeping all errors
+	const queries = 2000
+	sInsights := useTestInsights(t, db, Config{
+		InstanceID:              "test",
+		SampleRate:              0.25,
+		SampleKeepErrors:        true,
+		MaxStatisticsBufferSize: queries,
 	})
 
-	if err != nil {
-		if t != nil {
-			t.Fatal(err)
-		} else if b != nil {
-			b.Fatal(err)
+	// successful queries are sampled
+	mock.MatchExpectationsInOrder(false)
+	for idx := 0; idx < queries; idx++ {
+		mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(idx))
+	}
+	for idx := 0; idx < queries; idx++ {
+		db.Where("id = ?", idx).Find(&mockTestUser{})
+	}
+
+	// failing queries, without expectations, are always kept
+	for idx := 0; idx < 10; idx++ {
+		db.Where("user_name = ?", idx).Find(&mockTestUser{})
+	}
+
+	// collect the queued statistics
+	drainTestStats(t, sInsights)
+
+	unlock := lockTestStats(t, sInsights)
+	for _, agg := range sInsights.stats[_statTypeQuery] {
+		statHistory, _ := sInsights.buildStatHistory(newTestReportBucket(), _statTypeQuery, agg)
+		if strings.Contains(agg.Key, "user_name") {
+			if statHistory.Count != 10 || statHistory.Errors != 10 || statHistory.SampleRate != 1 {
+				t.Fatalf("expected all 10 errors to be kept at a sample rate of 1, got %d errors of %d at %f", statHistory.Errors, statHistory.Count, statHistory.SampleRate)
+			}
+			continue
+		}
+		if agg.samples < queries/8 || agg.samples > queries/2 {
+			t.Fatalf("expected roughly a quarter of %d queries to be sampled, got %d", queries, agg.samples)
+		}
+		if statHistory.Count < queries*8/10 || statHistory.Count > queries*12/10 {
+			t.Fatalf("expected an estimated count of roughly %d, got %d", queries, statHistory.Count)
+		}
+		if statHistory.SampleRate != 0.25 {
+			t.Fatalf("expected a sample rate of 0.25, got %f", statHistory.SampleRate)
 		}
 	}
+	unlock()
 
-	return sqldb, gormdb, mock
+	// adaptive sampling lowers the rate when over the max QPS or when the buffer backs up, then recovers
+	adaptive := &AdaptiveSamplingConfig{MaxQPS: 100}
+	adaptive.applyDefaults()
+	smp := newSampler(&Config{AdaptiveSampling: adaptive})
+	now := smp.lastAdjust.Add(time.Second)
+	smp.executions.Store(400)
+	smp.adjust(now, 0, 100)
+	if rate := smp.rate(_statTypeQuery); rate != 0.25 {
+		t.Fatalf("expected a sample rate of 0.25 at 4x the max QPS, got %f", rate)
+	}
+	smp.adjust(now.Add(time.Second), 90, 100)
+	if rate := smp.rate(_statTypeQuery); rate != 0.125 {
+		t.Fatalf("expected the sample rate to halve when the buffer backs up, got %f", rate)
+	}
+	smp.adjust(now.Add(2*time.Second), 0, 100)
+	if rate := smp.rate(_statTypeQuery); rate != 0.25 {
+		t.Fatalf("expected the sample rate to recover gradually, got %f", rate)
+	}
+}
+
+func TestSQLInsightsErrors(t *testing.T) {
+	_, db, mock := newMock(t, nil)
+
+	// errors are classified by their driver error code, or by their type when there is none
+	for _, tc := range []struct {
+		err   error
+		class string
+		code  string
+	}{
+		{&mysql.MySQLError{Number: 1213, Message: "Deadlock found"}, ErrorClassDeadlock, "mysql:1213"},
+		{fmt.Errorf("wrapped: %w", &mysql.MySQLError{Number: 1062}), ErrorClassDuplicateKey, "mysql:1062"},
+		{&mysql.MySQLError{Number: 9999}, ErrorClassOther, "mysql:9999"},
+		{&pgconn.PgError{Code: "40P01"}, ErrorClassDeadlock, "pg:40P01"},
+		{&pgconn.PgError{Code: "23505"}, ErrorClassDuplicateKey, "pg:23505"},
+		{&pgconn.PgError{Code: "42P01"}, ErrorClassSyntax, "pg:42P01"},
+		{context.Canceled, ErrorClassCanceled, ""},
+		{context.DeadlineExceeded, ErrorClassTimeout, ""},
+		{driver.ErrBadConn, ErrorClassConnection, ""},
+		{errors.New("boom"), ErrorClassOther, ""},
+	} {
+		if class, code := classifyError(tc.err); class != tc.class || code != tc.code {
+			t.Fatalf("expected %v to be classified as %s/%s, got %s/%s", tc.err, tc.class, tc.code, class, code)
+		}
+	}
+
+	// stored error messages are valid UTF-8, truncated without cutting a multi-byte rune in half
+	for _, message := range []string{strings.Repeat("a", _maxErrorMessageLength-1) + "é and more", "invalid \xff byte"} {
+		if stored := errorMessage(errors.New(message)); len(stored) > _maxErrorMessageLength || !utf8.ValidString(stored) {
+			t.Fatalf("expected a valid message of at most %d bytes, got %d bytes %q", _maxErrorMessageLength, len(stored), stored[max(0, len(stored)-8):])
+		}
+	}
+
+	// create our new insights monitor without a storage DB
+	sInsights := useTestInsights(t, db, Config{
+		InstanceID: "test",
+	})
+
+	// one successful and two deadlocked queries
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillDelayFor(5 * time.Millisecond).WillReturnError(&pgconn.PgError{Code: "40P01", Message: "deadlock detected"})
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillDelayFor(5 * time.Millisecond).WillReturnError(&pgconn.PgError{Code: "40P01", Message: "deadlock detected"})
+	for idx := 0; idx < 3; idx++ {
+		db.Where("id = ?", idx).Find(&mockTestUser{})
+	}
+
+	// collect the queued statistics
+	drainTestStats(t, sInsights)
+
+	sInsights.statsLock.Lock()
+	defer sInsights.statsLock.Unlock()
+	if len(sInsights.stats[_statTypeQuery]) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(sInsights.stats[_statTypeQuery]))
+	}
+	for _, agg := range sInsights.stats[_statTypeQuery] {
+		bucket := newTestReportBucket()
+		statHistory, _ := sInsights.buildStatHistory(bucket, _statTypeQuery, agg)
+		if statHistory.Count != 3 || statHistory.Errors != 2 {
+			t.Fatalf("expected 2 errors of 3 queries, got %d errors of %d", statHistory.Errors, statHistory.Count)
+		}
+		if statHistory.TookMax < 5 {
+			t.Fatalf("expected errors to keep their timings, got a max of %fms", statHistory.TookMax)
+		}
+
+		errorHistory := sInsights.buildErrorHistory(bucket, _statTypeQuery, agg)
+		if len(errorHistory) != 1 {
+			t.Fatalf("expected 1 error history record, got %d", len(errorHistory))
+		}
+		if errorHistory[0].Class != ErrorClassDeadlock || errorHistory[0].Code != "pg:40P01" || errorHistory[0].Count != 2 {
+			t.Fatalf("expected 2 pg:40P01 deadlocks, got %d %s/%s", errorHistory[0].Count, errorHistory[0].Class, errorHistory[0].Code)
+		}
+		if !strings.Contains(errorHistory[0].Message, "deadlock detected") {
+			t.Fatalf("expected a sample error message, got %q", errorHistory[0].Message)
+		}
+		if errorHistory[0].TookSum < 10 {
+			t.Fatalf("expected the error timings to be summed, got %fms", errorHistory[0].TookSum)
+		}
+	}
+}
+
+func TestSQLInsightsFilters(t *testing.T) {
+	_, db, _ := newMock(t, nil)
+
+	// create our new insights monitor without a storage DB, excluding our own tables, health checks and anything labeled as a migration while only including queries and row statements
+	sInsights := useTestInsights(t, db, Config{
+		InstanceID: "test",
+		Filters: []*FilterRule{
+			{Exclude: true, Tables: []string{"sql_insights_*"}},
+			{Exclude: true, SQL: regexp.MustCompile(`^SELECT 1$`)},
+			{Exclude: true, Labels: map[string]string{"job": "migration"}},
+			{Types: []string{"query", "row"}},
+		},
+	})
+
+	// recorded
+	db.Where("id = ?", 1).Find(&mockTestUser{})
+	db.Raw("SELECT 2").Scan(&struct{}{})
+
+	// excluded
+	db.Raw("SELECT 1").Scan(&struct{}{})
+	db.Find(&SQLInsightsHash{})
+	db.WithContext(WithLabels(context.Background(), map[string]string{"job": "migration"})).Find(&mockTestUser{})
+	db.Session(&gorm.Session{SkipDefaultTransaction: true}).Create(&mockTestUser{UserName: "test"})
+
+	// collect the queued statistics
+	drainTestStats(t, sInsights)
+
+	sInsights.statsLock.Lock()
+	recorded := make([]string, 0, 2)
+	for _, statTypeMap := range sInsights.stats {
+		for _, agg := range statTypeMap {
+			for i := 0; i < agg.samples; i++ {
+				recorded = append(recorded, agg.Key)
+			}
+		}
+	}
+	sInsights.statsLock.Unlock()
+	sort.Strings(recorded)
+	if len(recorded) != 2 || recorded[0] != "SELECT * FROM \"mock_test_users\" WHERE id = $1" || recorded[1] != "SELECT 2" {
+		t.Fatalf("expected only the included statements to be recorded, got %q", recorded)
+	}
+
+	// caller rules match the first caller outside of gorm and this package, which is the testing package here
+	filtered := &SQLInsights{config: Config{Filters: []*FilterRule{{Exclude: true, CallerPackagePrefixes: []string{"testing."}}}}, callerCache: newCallerCache()}
+	stmt := db.Session(&gorm.Session{DryRun: true}).Find(&mockTestUser{})
+	if result := filtered.filterStatement(stmt.Statement.Context, stmt.Statement.Table, _statTypeQuery, ""); result != _filterSkip {
+		t.Fatalf("expected the statement to be excluded by its caller, got %d", result)
+	}
+	filtered.config.Filters[0].CallerPackagePrefixes = []string{"github.com/example/"}
+	if result := filtered.filterStatement(stmt.Statement.Context, stmt.Statement.Table, _statTypeQuery, ""); result != _filterRecord {
+		t.Fatalf("expected the statement to be recorded, got %d", result)
+	}
+}
+
+func TestSQLInsightsDirectives(t *testing.T) {
+	_, db, mock := newMock(t, nil)
+
+	// create our new insights monitor without a storage DB, sampling almost nothing so only statements kept by their slow threshold are recorded
+	sInsights := useTestInsights(t, db, Config{
+		InstanceID: "test",
+		SampleRate: 0.000001,
+	})
+
+	// long names are truncated to the stored length without cutting a multi-byte rune in half
+	if name := statementDirectives(db.Set(SettingName, strings.Repeat("é", _maxNameLength))).Name; len(name) > _maxNameLength || !utf8.ValidString(name) {
+		t.Fatalf("expected a valid name of at most %d bytes, got %d bytes", _maxNameLength, len(name))
+	}
+
+	// skipped, too fast for its slow threshold, and slow statements
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users" WHERE id = \$1`).WillDelayFor(5 * time.Millisecond).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users" WHERE user_name = \$1`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users" WHERE full_name = \$1`).WillDelayFor(5 * time.Millisecond).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	db.Set(SettingSkip, true).Set(SettingSlowMS, 1).Where("id = ?", 1).Find(&mockTestUser{})
+	db.Set(SettingSlowMS, time.Hour).Where("user_name = ?", 1).Find(&mockTestUser{})
+	db.InstanceSet(SettingName, "load-user-by-name").Set(SettingSlowMS, 1).Where("full_name = ?", 1).Find(&mockTestUser{})
+
+	// collect the queued statistics
+	drainTestStats(t, sInsights)
+
+	sInsights.statsLock.Lock()
+	defer sInsights.statsLock.Unlock()
+	if len(sInsights.stats[_statTypeQuery]) != 1 {
+		t.Fatalf("expected only the slow statement to be recorded, got %d statements", len(sInsights.stats[_statTypeQuery]))
+	}
+	for _, agg := range sInsights.stats[_statTypeQuery] {
+		if agg.samples != 1 || !strings.Contains(agg.Key, "full_name") {
+			t.Fatalf("expected the slow statement to be recorded, got %d of %q", agg.samples, agg.Key)
+		}
+		if agg.Name != "load-user-by-name" || agg.slowCount != 1 {
+			t.Fatalf("expected a slow statement named load-user-by-name, got %q slow=%f", agg.Name, agg.slowCount)
+		}
+		statHistory, _ := sInsights.buildStatHistory(newTestReportBucket(), _statTypeQuery, agg)
+		if statHistory.Slow != 1 || statHistory.Count != 1 {
+			t.Fatalf("expected 1 slow execution of 1, got %d of %d", statHistory.Slow, statHistory.Count)
+		}
+	}
+}
+
+func TestSQLInsightsPoolStatistics(t *testing.T) {
+	sqlDB, db, _ := newMock(t, nil)
+
+	// create our new insights monitor without a storage DB
+	sInsights := useTestInsights(t, db, Config{
+		InstanceID: "test",
+	})
+
+	// hold the only connection so the next one has to wait for it
+	sqlDB.SetMaxOpenConns(1)
+	conn, err := sqlDB.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waited := make(chan struct{})
+	go func() {
+		defer close(waited)
+		if waitConn, err := sqlDB.Conn(context.Background()); err == nil {
+			waitConn.Close()
+		}
+	}()
+
+	// once the second connection is waiting, keep it waiting for more than the 10ms the wait duration is checked against below
+	for sqlDB.Stats().WaitCount == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	sInsights.statsLock.Lock()
+	defer sInsights.statsLock.Unlock()
+	poolHistories := sInsights.unsafeBuildPoolHistory(newTestReportBucket())
+	if len(poolHistories) != 1 || poolHistories[0].Connection != ConnectionSource {
+		t.Fatalf("expected the source connection pool to be sampled, got %+v", poolHistories)
+	}
+	poolHistory := poolHistories[0]
+	if poolHistory.MaxOpenConnections != 1 || poolHistory.OpenConnections != 1 || poolHistory.InUse != 1 || poolHistory.WaitCount != 1 {
+		t.Fatalf("expected 1 open connection in use and 1 waiting, got %+v", poolHistory)
+	}
+	conn.Close()
+	<-waited
+
+	// counters are reported as deltas since the previous sample, the wait duration is added once the wait is over
+	poolHistory = sInsights.unsafeBuildPoolHistory(newTestReportBucket())[0]
+	if poolHistory.WaitCount != 0 || poolHistory.WaitDuration < 10 || poolHistory.InUse != 0 || poolHistory.Idle != 1 {
+		t.Fatalf("expected the wait to complete with an idle connection, got %+v", poolHistory)
+	}
+	poolHistory = sInsights.unsafeBuildPoolHistory(newTestReportBucket())[0]
+	if poolHistory.WaitCount != 0 || poolHistory.WaitDuration != 0 {
+		t.Fatalf("expected no new waits, got %+v", poolHistory)
+	}
+}
+
+func TestSQLInsightsPoolStatisticsIdle(t *testing.T) {
+	_, db, _ := newMock(t, nil)
+
+	// create our new insights monitor storing in memory, without executing any statement
+	store := NewMemoryStore(10)
+	useTestInsights(t, db, Config{
+		InstanceID:     "test",
+		Store:          store,
+		ReportInterval: time.Second,
+	})
+
+	// the connection pool is sampled every report interval even though no statement was executed
+	filter := &HistoryFilter{To: time.Now().Add(time.Hour)}
+	deadline := time.Now().Add(5 * time.Second)
+	var poolHistories []*SQLPoolHistoryResult
+	for len(poolHistories) < 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		poolHistories, _ = store.PoolHistory(filter)
+	}
+	if len(poolHistories) < 2 {
+		t.Fatalf("expected a pool history record per report interval, got %d", len(poolHistories))
+	}
+	if poolHistories[1].CreatedAt.Sub(poolHistories[0].CreatedAt) != time.Second || poolHistories[0].EndedAt.Sub(poolHistories[0].CreatedAt) != time.Second {
+		t.Fatalf("expected consecutive 1s intervals, got %+v and %+v", poolHistories[0], poolHistories[1])
+	}
+}
+
+// fakeResolver registers under the plugin name of dbresolver, its routing is done by the callbacks of the test
+type fakeResolver struct{}
+
+func (fakeResolver) Name() string {
+	return _resolverPlugin
+}
+
+func (fakeResolver) Initialize(*gorm.DB) error {
+	return nil
+}
+
+func TestSQLInsightsDatabases(t *testing.T) {
+	_, mainDB, mainMock := newMock(t, nil)
+	_, analyticsDB, _ := newMock(t, nil)
+	replicaSQLDB, _, _ := newMock(t, nil)
+	otherReplicaSQLDB, _, _ := newMock(t, nil)
+	sourceSQLDB, _, sourceMock := newMock(t, nil)
+
+	// route statements like dbresolver does, by switching the connection pool of the statement before it executes: queries to a replica unless forced to the source, writes
+	// outside of transactions to the source
+	if err := mainDB.Use(fakeResolver{}); err != nil {
+		t.Fatal(err)
+	}
+	replica := replicaSQLDB
+	mainDB.Callback().Query().Before("*").Register("test:resolver", func(tx *gorm.DB) {
+		if _, write := tx.Statement.Settings.Load(_resolverWrite); write {
+			tx.Statement.ConnPool = sourceSQLDB
+			return
+		}
+		tx.Statement.ConnPool = replica
+	})
+	mainDB.Callback().Create().Before("*").Register("test:resolver", func(tx *gorm.DB) {
+		if _, inTx := tx.Statement.ConnPool.(gorm.TxCommitter); !inTx {
+			tx.Statement.ConnPool = sourceSQLDB
+		}
+	})
+
+	// switch the connection pool of the other database without dbresolver, it can not be told apart
+	analyticsDB.Callback().Query().Before("*").Register("test:switch", func(tx *gorm.DB) {
+		if _, other := tx.Get("test:other"); other {
+			tx.Statement.ConnPool = otherReplicaSQLDB
+		}
+	})
+
+	// monitor both databases with a single plugin instance, naming one of the replicas
+	sInsights := newTestInsights(t, Config{
+		InstanceID:          "test",
+		CollectTransactions: true,
+	})
+	if err := mainDB.Use(sInsights.Database("main").NameConnection("replica-1", replicaSQLDB)); err != nil {
+		t.Fatal(err)
+	}
+	if err := analyticsDB.Use(sInsights.Database("analytics")); err != nil {
+		t.Fatal(err)
+	}
+
+	mainDB.Where("id = ?", 1).Find(&mockTestUser{})
+	replica = otherReplicaSQLDB
+	mainDB.Where("id = ?", 2).Find(&mockTestUser{})
+	mainDB.Set(_resolverWrite, struct{}{}).Where("id = ?", 3).Find(&mockTestUser{})
+	sourceMock.ExpectBegin()
+	sourceMock.ExpectQuery(`INSERT INTO "mock_test_users"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	sourceMock.ExpectCommit()
+	if err := mainDB.Create(&mockTestUser{UserName: "test"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	mainMock.ExpectBegin()
+	mainDB.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(&mockTestUser{UserName: "test"}).Error
+	})
+	analyticsDB.Where("id = ?", 4).Find(&mockTestUser{})
+	analyticsDB.Set("test:other", true).Where("id = ?", 5).Find(&mockTestUser{})
+
+	drainTestStats(t, sInsights)
+	sInsights.statsLock.Lock()
+	defer sInsights.statsLock.Unlock()
+
+	// the same statement is aggregated separately per database and connection
+	counts := make(map[string]int)
+	for _, sType := range []statType{_statTypeQuery, _statTypeCreate} {
+		for _, agg := range sInsights.stats[sType] {
+			counts[sType.String()+":"+agg.Database+"/"+agg.Connection] += agg.samples
+		}
+	}
+	expected := map[string]int{
+		"query:main/replica-1":   1,
+		"query:main/replica":     1,
+		"query:main/source":      1,
+		"create:main/source":     2,
+		"query:analytics/source": 1,
+		"query:analytics/":       1,
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("expected %v, got %v", expected, counts)
+	}
+
+	// the source pools of both databases and the named replica are sampled
+	connections := make(map[string]bool)
+	for _, poolHistory := range sInsights.unsafeBuildPoolHistory(newTestReportBucket()) {
+		connections[poolHistory.Database+"/"+poolHistory.Connection] = true
+	}
+	if !reflect.DeepEqual(connections, map[string]bool{"main/source": true, "main/replica-1": true, "analytics/source": true}) {
+		t.Fatalf("expected the pools of both databases and the named replica to be sampled, got %v", connections)
+	}
+}
+
+func TestSQLInsightsTracing(t *testing.T) {
+	_, db, mock := newMock(t, nil)
+
+	// record the spans in memory, every statement is slow so it keeps its trace as an exemplar
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	sInsights := newTestInsights(t, Config{
+		InstanceID:           "test",
+		TracerProvider:       provider,
+		SampleKeepSlowerThan: time.Nanosecond,
+	})
+	if err := db.Use(sInsights.Database("main")); err != nil {
+		t.Fatal(err)
+	}
+
+	// one successful and one failing query within a request span
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillReturnError(&pgconn.PgError{Code: "40P01", Message: "deadlock detected"})
+	query := db.WithContext(ctx).Where("id = ?", 1)
+	query.Find(&mockTestUser{})
+	db.WithContext(ctx).Where("id = ?", 2).Find(&mockTestUser{})
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 2 statement spans and the request span, got %d spans", len(spans))
+	}
+	key := `SELECT * FROM "mock_test_users" WHERE id = $1`
+	for idx, span := range spans[:2] {
+		if span.Name() != "SELECT mock_test_users" || span.SpanKind() != trace.SpanKindClient {
+			t.Fatalf("expected a SELECT mock_test_users client span, got %s %s", span.SpanKind(), span.Name())
+		}
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Fatalf("expected the statement span to be a child of the request span")
+		}
+		attrs := make(map[attribute.Key]attribute.Value)
+		for _, attr := range span.Attributes() {
+			attrs[attr.Key] = attr.Value
+		}
+		for attrKey, expected := range map[attribute.Key]string{
+			AttributeDBSystem:    "postgresql",
+			AttributeDBName:      "main",
+			AttributeDBStatement: key,
+			AttributeDBOperation: "SELECT",
+			AttributeDBTable:     "mock_test_users",
+			AttributeHash:        hash(key),
+			AttributeConnection:  ConnectionSource,
+		} {
+			if attrs[attrKey].AsString() != expected {
+				t.Fatalf("expected %s to be %q, got %q", attrKey, expected, attrs[attrKey].AsString())
+			}
+		}
+		if attrs[AttributeCodeFunction].AsString() == "" {
+			t.Fatalf("expected the caller to be recorded")
+		}
+		if idx == 0 && (attrs[AttributeDBRowsAffected].AsInt64() != 1 || span.Status().Code != codes.Unset) {
+			t.Fatalf("expected 1 row and no error, got %d rows and %s", attrs[AttributeDBRowsAffected].AsInt64(), span.Status().Code)
+		}
+		if idx == 1 && (span.Status().Code != codes.Error || attrs[AttributeErrorType].AsString() != ErrorClassDeadlock || len(span.Events()) != 1) {
+			t.Fatalf("expected a deadlock error status and event, got %s %q", span.Status().Code, attrs[AttributeErrorType].AsString())
+		}
+	}
+
+	// the statement context is restored so a reused statement is not a child of its previous span
+	if query.Statement.Context != ctx {
+		t.Fatalf("expected the statement context to be restored")
+	}
+
+	// the trace of the slowest execution is stored with the statement history
+	drainTestStats(t, sInsights)
+	sInsights.statsLock.Lock()
+	defer sInsights.statsLock.Unlock()
+	for _, agg := range sInsights.stats[_statTypeQuery] {
+		statHistory, _ := sInsights.buildStatHistory(newTestReportBucket(), _statTypeQuery, agg)
+		if statHistory.TraceID != parent.SpanContext().TraceID().String() {
+			t.Fatalf("expected trace ID %s, got %q", parent.SpanContext().TraceID(), statHistory.TraceID)
+		}
+	}
+}
+
+func TestSQLInsightsCallers(t *testing.T) {
+	// create our new insights monitor without a storage DB, aggregating by at most 2 callers per statement
+	sInsights := newTestInsights(t, Config{
+		InstanceID:         "test",
+		CollectCallerDepth: 1,
+		MaxCallersPerHash:  2,
+	})
+
+	// the same statement from 3 call sites, the first one twice. Our own package is skipped when resolving callers, so the stats carry resolved callers
+	sInsights.statsLock.Lock()
+	defer sInsights.statsLock.Unlock()
+	for _, function := range []string{"app.first", "app.first", "app.second", "app.third"} {
+		callers := []*callerInfo{{Filename: "app.go", Line: 1, Function: function}}
+		statValue := newStat()
+		statValue.Type = _statTypeQuery
+		statValue.Key = `SELECT * FROM "mock_test_users" WHERE id = $1`
+		statValue.Took = 1
+		statValue.Callers = callers
+		statValue.CallerJSON, statValue.CallerHash = sInsights.hashCallers(callers)
+		sInsights.unsafeAddStat(statValue)
+	}
+
+	// each call site is aggregated separately until the limit is reached, the rest are recorded without their callers
+	samples := make(map[string]int, 3)
+	for _, agg := range sInsights.stats[_statTypeQuery] {
+		function := ""
+		history, callerHistory := sInsights.buildStatHistory(newTestReportBucket(), _statTypeQuery, agg)
+		if agg.CallerHash != "" {
+			if history.CallerHash != agg.CallerHash || len(callerHistory) != 1 || callerHistory[0].ID != agg.CallerHash {
+				t.Fatalf("expected the history and caller history of caller %s, got %+v and %+v", agg.CallerHash, history, callerHistory)
+			}
+			function = callerHistory[0].GetValue()[0].Function
+		} else if history.CallerHash != "" || len(callerHistory) != 0 {
+			t.Fatalf("expected no caller history, got %+v and %+v", history, callerHistory)
+		}
+		samples[function] += agg.samples
+	}
+	if !reflect.DeepEqual(samples, map[string]int{"app.first": 2, "app.second": 1, "": 1}) {
+		t.Fatalf("expected 2 call sites and 1 execution without callers, got %v", samples)
+	}
+
+	if !callersInclude([]*callerInfo{{Function: "app.first"}, {Function: "app.handler"}}, "app.handler") || callersInclude([]*callerInfo{{Function: "app.first"}}, "app") {
+		t.Fatal("expected callers to include exact function names only")
+	}
+}
+
+func TestCallerIdentity(t *testing.T) {
+	// file names are relative to the import path of the package, versioned for dependencies
+	for _, tc := range []struct{ function, fileName, expected string }{
+		{"github.com/viocle/go-gorm-sql-insights/plugin.(*SQLInsights).Initialize", "/home/build/src/plugin/plugin.go", "github.com/viocle/go-gorm-sql-insights/plugin/plugin.go"},
+		{"gorm.io/gorm.(*DB).Find", "/root/go/pkg/mod/gorm.io/gorm@v1.25.12/finisher_api.go", "gorm.io/gorm@v1.25.12/finisher_api.go"},
+		{"gorm.io/gorm/clause.Where.Build", "/vendor/gorm.io/gorm/clause/where.go", "gorm.io/gorm@v1.25.12/clause/where.go"},
+		{"net/http.HandlerFunc.ServeHTTP", "/usr/local/go/src/net/http/server.go", "net/http/server.go"},
+		{"main.main.func1", "/app/main.go", "main/main.go"},
+		{"gopkg.in/yaml%2ev3.(*decoder).unmarshal", "/root/go/pkg/mod/gopkg.in/yaml.v3@v3.0.1/decode.go", "gopkg.in/yaml.v3/decode.go"},
+		{"unknown", "/app/unknown.go", "/app/unknown.go"},
+	} {
+		if fileName := callerFilename(tc.function, tc.fileName); fileName != tc.expected {
+			t.Errorf("expected %s for %s, got %s", tc.expected, tc.function, fileName)
+		}
+	}
+
+	byLine := newTestInsights(t, Config{})
+
+	// skipped packages are passed over like our own package
+	pcs := make([]uintptr, 10)
+	pcs = pcs[:runtime.Callers(1, pcs)]
+	if callers := byLine.lookupCallers(pcs, 1, false).callers; len(callers) != 1 || callers[0].Function != "testing.tRunner" || callers[0].Filename != "testing/testing.go" {
+		t.Fatalf("expected the test runner as the first caller outside of our package, got %+v", callers)
+	}
+	skipping := newTestInsights(t, Config{CallerSkipPackagePrefixes: []string{"testing."}})
+	if callers := skipping.lookupCallers(pcs, 1, false).callers; len(callers) != 1 || callers[0].Function != "runtime.goexit" {
+		t.Fatalf("expected the test runner to be skipped, got %+v", callers)
+	}
+	skipping = newTestInsights(t, Config{CallerSkipPackagePrefixes: []string{"gopkg.in/yaml.v3."}})
+	if !skipping.skipCallerPackage("gopkg.in/yaml%2ev3.Unmarshal") || skipping.skipCallerPackage("gopkg.in/yaml%2ev2.Unmarshal") {
+		t.Fatal("expected the escaped dots of the package path to match the skipped package prefix")
+	}
+
+	// callers can be hashed by function, ignoring lines
+	moved := [][]*callerInfo{
+		{{Filename: "app/users.go", Line: 10, Function: "app.(*Users).Find"}},
+		{{Filename: "app/users.go", Line: 12, Function: "app.(*Users).Find"}},
+	}
+	_, lineHash0 := byLine.hashCallers(moved[0])
+	_, lineHash1 := byLine.hashCallers(moved[1])
+	if lineHash0 == lineHash1 {
+		t.Fatal("expected callers on different lines to hash differently")
+	}
+	byFunction := newTestInsights(t, Config{HashCallersByFunction: true})
+	json0, hash0 := byFunction.hashCallers(moved[0])
+	_, hash1 := byFunction.hashCallers(moved[1])
+	if hash0 != hash1 || !strings.Contains(string(json0), `"Line":10`) {
+		t.Fatalf("expected callers on different lines of the same function to hash the same while keeping their lines, got %s and %s", hash0, hash1)
+	}
+}
+
+func TestSQLInsightsMetrics(t *testing.T) {
+	// create our new insights monitor without a storage DB, tracking 3 fingerprints and exposing the top 2
+	sInsights := newTestInsights(t, Config{
+		InstanceID:             "test",
+		MetricsMaxFingerprints: 3,
+		MetricsTopN:            2,
+	})
+
+	// 4 fingerprints by total execution time a, b, d, c. d is beyond the tracked fingerprints
+	sInsights.statsLock.Lock()
+	for _, tc := range []struct {
+		key   string
+		took  float64
+		class string
+	}{
+		{"SELECT a", 10, ""},
+		{"SELECT a", 30, ErrorClassDeadlock},
+		{"SELECT b", 5, ""},
+		{"SELECT c", 1, ""},
+		{"SELECT d", 2, ""},
+	} {
+		statValue := newStat()
+		statValue.Type = _statTypeQuery
+		statValue.Key = tc.key
+		statValue.Table = "users"
+		statValue.Took = tc.took
+		statValue.Rows = 1
+		statValue.Error = tc.class != ""
+		statValue.ErrorClass = tc.class
+		sInsights.unsafeAddStat(statValue)
+	}
+	sInsights.statsLock.Unlock()
+	sInsights.droppedStats.Add(3)
+
+	scrape := func(accept string) string {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		request.Header.Set("Accept", accept)
+		sInsights.DashboardMux().ServeHTTP(recorder, request)
+		return recorder.Body.String()
+	}
+	body := scrape("text/plain")
+	labels := func(keyHash, table string) string {
+		return `{instance_id="test",database="",type="query",hash="` + keyHash + `",table="` + table + `"}`
+	}
+	for _, expected := range []string{
+		"# TYPE gorm_sql_insights_statements_total counter\n",
+		"gorm_sql_insights_statements_total" + labels(hash("SELECT a"), "users") + " 2\n",
+		"gorm_sql_insights_statements_total" + labels(hash("SELECT b"), "users") + " 1\n",
+		"gorm_sql_insights_statements_total" + labels(_metricsOtherHash, "") + " 2\n",
+		"gorm_sql_insights_statement_errors_total" + labels(hash("SELECT a"), "users") + " 1\n",
+		"gorm_sql_insights_statement_rows_total" + labels(hash("SELECT a"), "users") + " 1\n",
+		`gorm_sql_insights_statement_duration_seconds_bucket{instance_id="test",database="",type="query",hash="` + hash("SELECT a") + `",table="users",le="0.01"} 1` + "\n",
+		`gorm_sql_insights_statement_duration_seconds_bucket{instance_id="test",database="",type="query",hash="` + hash("SELECT a") + `",table="users",le="+Inf"} 2` + "\n",
+		"gorm_sql_insights_statement_duration_seconds_sum" + labels(hash("SELECT a"), "users") + " 0.04\n",
+		`gorm_sql_insights_errors_total{instance_id="test",database="",type="query",class="deadlock"} 1` + "\n",
+		`gorm_sql_insights_buffer_capacity{instance_id="test",buffer="stats"} 4096` + "\n",
+		`gorm_sql_insights_dropped_total{instance_id="test",buffer="stats"} 3` + "\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("expected the metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, hash("SELECT c")) || strings.Contains(body, hash("SELECT d")) || strings.Contains(body, "# EOF") {
+		t.Fatalf("expected only the top 2 fingerprints in the Prometheus text format, got:\n%s", body)
+	}
+
+	// OpenMetrics names counter families without their suffix and terminates the exposition
+	body = scrape("application/openmetrics-text; version=1.0.0")
+	if !strings.Contains(body, "# TYPE gorm_sql_insights_statements counter\n") || !strings.HasSuffix(body, "# EOF\n") {
+		t.Fatalf("expected the OpenMetrics format, got:\n%s", body)
+	}
+	if escapeLabelValue("a\\b\"c\nd") != `a\\b\"c\nd` {
+		t.Fatalf("expected label values to be escaped, got %s", escapeLabelValue("a\\b\"c\nd"))
+	}
+}
+
+func TestSQLInsightsMetricsSeries(t *testing.T) {
+	// create our new insights monitor exposing a single fingerprint with its own series
+	sInsights := newTestInsights(t, Config{
+		InstanceID:  "test",
+		MetricsTopN: 1,
+	})
+
+	addStats := func(stats map[string]float64) {
+		sInsights.statsLock.Lock()
+		defer sInsights.statsLock.Unlock()
+		for key, took := range stats {
+			statValue := newStat()
+			statValue.Type = _statTypeQuery
+			statValue.Key = key
+			statValue.Took = took
+			sInsights.unsafeAddStat(statValue)
+		}
+	}
+	scrape := func() map[string]float64 {
+		recorder := httptest.NewRecorder()
+		sInsights.DashboardMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		samples := make(map[string]float64, 10)
+		for _, line := range strings.Split(recorder.Body.String(), "\n") {
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			series, value, _ := strings.Cut(line, " ")
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("invalid sample %q", line)
+			}
+			samples[series] = number
+		}
+		return samples
+	}
+
+	// a is exposed and b is summed under other, then b overtakes a and a new fingerprint c arrives
+	addStats(map[string]float64{"SELECT a": 10, "SELECT b": 1})
+	first := scrape()
+	addStats(map[string]float64{"SELECT b": 100, "SELECT c": 50})
+	second := scrape()
+
+	// every counter is still exposed and did not decrease
+	for series, value := range first {
+		if strings.Contains(series, "buffer_depth") {
+			continue
+		}
+		if second[series] < value {
+			t.Fatalf("expected %s to not decrease, got %v then %v", series, value, second[series])
+		}
+	}
+	labels := func(keyHash string) string {
+		return `{instance_id="test",database="",type="query",hash="` + keyHash + `",table=""}`
+	}
+	if second["gorm_sql_insights_statements_total"+labels(hash("SELECT a"))] != 1 || second["gorm_sql_insights_statements_total"+labels(_metricsOtherHash)] != 3 {
+		t.Fatalf("expected a to keep its series and b and c to be summed under other, got %v", second)
+	}
+	for series := range second {
+		if strings.Contains(series, hash("SELECT b")) || strings.Contains(series, hash("SELECT c")) {
+			t.Fatalf("expected b and c to not be exposed with their own series, got %s", series)
+		}
+	}
+}
+
+func TestSQLInsightsStatsD(t *testing.T) {
+	// listen for the metrics like a local agent would
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// create our new insights monitor without a storage DB, batching the metrics into small packets
+	sInsights := newTestInsights(t, Config{
+		InstanceID: "test",
+		StatsD: &StatsDConfig{
+			Address:       listener.LocalAddr().String(),
+			Prefix:        "app.",
+			Tags:          []string{"env:ci"},
+			MaxPacketSize: 256,
+		},
+	})
+
+	// a statement executed twice, failing once, and a statement sampled at 1/4
+	unlock := lockTestStats(t, sInsights)
+	for _, tc := range []struct {
+		key    string
+		took   float64
+		weight float64
+		class  string
+	}{
+		{"SELECT a", 10, 1, ""},
+		{"SELECT a", 30, 1, ErrorClassDeadlock},
+		{"SELECT b", 5, 4, ""},
+	} {
+		statValue := newStat()
+		statValue.Type = _statTypeQuery
+		statValue.Key = tc.key
+		statValue.Table = "users"
+		statValue.Took = tc.took
+		statValue.Weight = tc.weight
+		statValue.Error = tc.class != ""
+		statValue.ErrorClass = tc.class
+		sInsights.unsafeAddStat(statValue)
+	}
+	sInsights.droppedStats.Add(2)
+	sInsights.unsafeAddTxStat(&txStat{Key: "SELECT a", KeyHash: hash("SELECT a"), Statements: 1, Committed: true})
+	sInsights.unsafeAddRepetition(&repetitionStat{Key: "SELECT a", KeyHash: hash("SELECT a"), Repetitions: 5})
+	sInsights.unsafeReportStatistics(newTestReportBucket())
+	for _, agg := range sInsights.stats[_statTypeQuery] {
+		if agg.samples != 0 {
+			t.Fatalf("expected the aggregates to be reset once sent, got %d samples", agg.samples)
+		}
+	}
+	if len(sInsights.txStats) != 0 || len(sInsights.repetitions) != 0 {
+		t.Fatalf("expected the transactions and repetitions to be dropped without a store, got %d and %d", len(sInsights.txStats), len(sInsights.repetitions))
+	}
+	unlock()
+
+	// read every packet sent
+	var lines []string
+	packet := make([]byte, 65536)
+	for {
+		_ = listener.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := listener.ReadFrom(packet)
+		if err != nil {
+			break
+		}
+		if n > 256 {
+			t.Fatalf("expected packets of at most 256 bytes, got %d", n)
+		}
+		lines = append(lines, strings.Split(string(packet[:n]), "\n")...)
+	}
+	tagsA := "|#instance_id:test,env:ci,type:query,hash:" + hash("SELECT a") + ",table:users"
+	tagsB := "|#instance_id:test,env:ci,type:query,hash:" + hash("SELECT b") + ",table:users"
+	expected := []string{
+		"app.statements:2|c" + tagsA,
+		"app.errors:1|c" + tagsA + ",error_class:deadlock",
+		"app.statements:4|c" + tagsB,
+		"app.dropped:2|c|#instance_id:test,env:ci,buffer:stats",
+	}
+	for _, line := range expected {
+		if !slices.Contains(lines, line) {
+			t.Fatalf("expected %q, got %v", line, lines)
+		}
+	}
+	var durations []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "app.duration:") {
+			durations = append(durations, line)
+		}
+	}
+	if len(durations) != 3 || !slices.ContainsFunc(durations, func(line string) bool { return strings.HasSuffix(line, "|d|@0.25"+tagsB) }) {
+		t.Fatalf("expected 3 duration distributions, the sampled one with a sample rate, got %v", durations)
+	}
+	if len(lines) != len(expected)+len(durations) {
+		t.Fatalf("expected %d metrics, got %v", len(expected)+len(durations), lines)
+	}
+}
+
+func TestSQLInsightsSlowQueryLog(t *testing.T) {
+	_, db, mock := newMock(t, nil)
+
+	// log every statement as slow, at most once an hour per statement
+	var logs bytes.Buffer
+	sInsights := useTestInsights(t, db, Config{
+		InstanceID:           "test",
+		Logger:               slog.New(slog.NewJSONHandler(&logs, nil)),
+		SlowQueryThreshold:   time.Nanosecond,
+		SlowQueryLogInterval: time.Hour,
+	})
+
+	// the same statement 3 times, then a failing statement
+	ctx := WithLabels(context.Background(), map[string]string{"route": "/users"})
+	for idx := 0; idx < 3; idx++ {
+		mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		db.WithContext(ctx).Where("id = ?", idx).Find(&mockTestUser{})
+	}
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillReturnError(&pgconn.PgError{Code: "40P01", Message: "deadlock detected"})
+	db.Where("user_name = ?", "test").Find(&mockTestUser{})
+
+	type record struct {
+		Level      string
+		Msg        string
+		Hash       string
+		SQL        string
+		Type       string
+		Duration   int64
+		Rows       int64
+		Table      string
+		ErrorClass string `json:"error_class"`
+		Callers    []string
+		Labels     map[string]string
+		Suppressed int
+	}
+	readRecords := func() []*record {
+		var records []*record
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var r record
+			if err := json.Unmarshal([]byte(line), &r); err != nil {
+				t.Fatalf("failed to decode log record %q: %s", line, err)
+			}
+			records = append(records, &r)
+		}
+		logs.Reset()
+		return records
+	}
+	records := readRecords()
+	if len(records) != 2 {
+		t.Fatalf("expected the repeated statement to be logged once along with the error, got %d records", len(records))
+	}
+	key := `SELECT * FROM "mock_test_users" WHERE id = $1`
+	if r := records[0]; r.Level != "WARN" || r.Msg != "slow query" || r.SQL != key || r.Hash != hash(key) || r.Type != "query" || r.Duration <= 0 || r.Rows != 1 || r.Table != "mock_test_users" || r.Labels["route"] != "/users" || len(r.Callers) == 0 {
+		t.Fatalf("expected a slow query record, got %+v", r)
+	}
+	if r := records[1]; r.Level != "ERROR" || r.Msg != "query error" || r.SQL != `SELECT * FROM "mock_test_users" WHERE user_name = $1` || r.ErrorClass != ErrorClassDeadlock {
+		t.Fatalf("expected a query error record, got %+v", r)
+	}
+
+	// once the interval passed, the next record reports the suppressed records
+	sInsights.slowLogLock.Lock()
+	sInsights.slowLog[key].last = time.Now().Add(-time.Hour)
+	sInsights.slowLogLock.Unlock()
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	db.Where("id = ?", 4).Find(&mockTestUser{})
+	if records = readRecords(); len(records) != 1 || records[0].Suppressed != 2 {
+		t.Fatalf("expected 1 record reporting 2 suppressed records, got %d records", len(records))
+	}
+}
+
+func TestSQLInsightsMemoryStore(t *testing.T) {
+	// create our new insights monitor storing the statistics in memory, keeping at most 3 statement records
+	store := NewMemoryStore(3)
+	sInsights := newTestInsights(t, Config{
+		InstanceID:         "test",
+		Store:              store,
+		CollectCallerDepth: 5,
+	})
+	if sInsights.instanceAppID == 0 {
+		t.Fatal("expected the instance to be registered in the store")
+	}
+
+	// report a statement executed twice from the same caller, failing once
+	callerJSON, callerHash := sInsights.hashCallers([]*callerInfo{{Filename: "users.go", Line: 42, Function: "app.loadUsers"}})
+	sInsights.statsLock.Lock()
+	for _, class := range []string{"", ErrorClassDeadlock} {
+		statValue := newStat()
+		statValue.Type = _statTypeQuery
+		statValue.Key = "SELECT * FROM users"
+		statValue.Database = "main"
+		statValue.Took = 10
+		statValue.Weight = 1
+		statValue.Error = class != ""
+		statValue.ErrorClass = class
+		statValue.CallerHash, statValue.CallerJSON = callerHash, callerJSON
+		sInsights.unsafeAddStat(statValue)
+	}
+	sInsights.unsafeReportStatistics(newTestReportBucket())
+	sInsights.statsLock.Unlock()
+
+	// the dashboard API reads the statistics back from the store
+	keyHash := hash("SELECT * FROM users")
+	history, err := sInsights.SQLQueryHistory(&SQLQueryHistoryRequest{Databases: []string{"main"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].HashID != keyHash || history[0].Count != 2 || history[0].Errors != 1 || history[0].InstanceAppName != "test" {
+		t.Fatalf("unexpected statement history %+v", history)
+	}
+	if history, _ := sInsights.SQLQueryHistory(&SQLQueryHistoryRequest{Databases: []string{"other"}}); len(history) != 0 {
+		t.Fatalf("expected the database filter to exclude the history, got %+v", history)
+	}
+	callers, err := sInsights.SQLCallerSummary(&SQLCallerSummaryRequest{HashID: keyHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(callers) != 1 || callers[0].CallerHash != callerHash || len(callers[0].Callers) != 1 || callers[0].Callers[0].Function != "app.loadUsers" {
+		t.Fatalf("unexpected caller summary %+v", callers)
+	}
+	functions, err := sInsights.SQLFunctionSummary(&SQLFunctionSummaryRequest{Function: "app.loadUsers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(functions) != 1 || functions[0].Statement != "SELECT * FROM users" || functions[0].Count != 2 {
+		t.Fatalf("unexpected function summary %+v", functions)
+	}
+	errorSummary, err := sInsights.SQLErrorSummary(&SQLErrorSummaryRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errorSummary) != 1 || errorSummary[0].Class != ErrorClassDeadlock || errorSummary[0].Count != 1 {
+		t.Fatalf("unexpected error summary %+v", errorSummary)
+	}
+	heatmap, err := sInsights.SQLLatencyHeatmap(&SQLLatencyHeatmapRequest{HashID: keyHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(heatmap.Times) != 1 {
+		t.Fatalf("expected a single heatmap column, got %+v", heatmap)
+	}
+	counts, err := sInsights.SQLQueryCounts(&SQLQueryCountsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || len(counts[0].Counts) != 1 || counts[0].Counts[0].Count != 2 {
+		t.Fatalf("expected the 2 executions of the day to be counted, got %+v", counts)
+	}
+
+	// the oldest records are overwritten once the ring buffer is full
+	start := time.Now().UTC().Truncate(time.Minute)
+	for idx := range 4 {
+		createdAt := start.Add(time.Duration(idx-4) * time.Minute)
+		if err := store.SaveReport(&Report{Statements: []*SQLInsightsHistory{{InstanceID: sInsights.instanceAppID, CreatedAt: createdAt, HashID: keyHash, Count: 1}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, _ = sInsights.SQLQueryHistory(&SQLQueryHistoryRequest{})
+	if len(history) != 3 || !history[0].CreatedAt.Equal(start.Add(-3*time.Minute)) {
+		t.Fatalf("expected the 3 most recent records, got %+v", history)
+	}
+
+	// purging removes the records older than the specified time
+	if err := store.Purge(sInsights.instanceAppID, start.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	history, _ = sInsights.SQLQueryHistory(&SQLQueryHistoryRequest{})
+	if len(history) != 1 || !history[0].CreatedAt.Equal(start.Add(-time.Minute)) {
+		t.Fatalf("expected a single record left after purging, got %+v", history)
+	}
+}
+
+func TestSQLInsightsPurge(t *testing.T) {
+	// seed every kind of history of the memory store with a record before and after the cutoff, and a record of another instance
+	cutoff := time.Now().UTC().Truncate(time.Minute)
+	store := NewMemoryStore(10)
+	for _, createdAt := range []time.Time{cutoff.Add(-time.Hour), cutoff} {
+		for _, instanceID := range []uint{1, 2} {
+			if err := store.SaveReport(&Report{
+				Statements:   []*SQLInsightsHistory{{InstanceID: instanceID, CreatedAt: createdAt}},
+				Errors:       []*SQLInsightsErrorHistory{{InstanceID: instanceID, CreatedAt: createdAt}},
+				Transactions: []*SQLInsightsTxHistory{{InstanceID: instanceID, CreatedAt: createdAt}},
+				Repetitions:  []*SQLInsightsRepetitionHistory{{InstanceID: instanceID, CreatedAt: createdAt}},
+				Pools:        []*SQLInsightsPoolHistory{{InstanceID: instanceID, CreatedAt: createdAt}},
+				Drops:        &SQLInsightsDropHistory{InstanceID: instanceID, CreatedAt: createdAt},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := store.Purge(1, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Time{cutoff.Add(-time.Hour), cutoff, cutoff}
+	checkCreatedAt := func(kind string, createdAt []time.Time) {
+		t.Helper()
+		if !slices.EqualFunc(createdAt, expected, time.Time.Equal) {
+			t.Fatalf("expected the %s of instance 1 before the cutoff to be purged, got %v", kind, createdAt)
+		}
+	}
+	var createdAt []time.Time
+	store.statements.each(func(history *SQLInsightsHistory) { createdAt = append(createdAt, history.CreatedAt) })
+	checkCreatedAt("statement history", createdAt)
+	createdAt = nil
+	store.errors.each(func(history *SQLInsightsErrorHistory) { createdAt = append(createdAt, history.CreatedAt) })
+	checkCreatedAt("error history", createdAt)
+	createdAt = nil
+	store.transactions.each(func(history *SQLInsightsTxHistory) { createdAt = append(createdAt, history.CreatedAt) })
+	checkCreatedAt("transaction history", createdAt)
+	createdAt = nil
+	store.repetitions.each(func(history *SQLInsightsRepetitionHistory) { createdAt = append(createdAt, history.CreatedAt) })
+	checkCreatedAt("repetition history", createdAt)
+	createdAt = nil
+	store.pools.each(func(history *SQLInsightsPoolHistory) { createdAt = append(createdAt, history.CreatedAt) })
+	checkCreatedAt("pool history", createdAt)
+	createdAt = nil
+	store.drops.each(func(history *SQLInsightsDropHistory) { createdAt = append(createdAt, history.CreatedAt) })
+	checkCreatedAt("drop history", createdAt)
+
+	// the GORM store deletes from every history table
+	_, gormdb, mock := newMock(t, nil)
+	for _, table := range []string{"sql_insights_histories", "sql_insights_tx_histories", "sql_insights_repetition_histories", "sql_insights_error_histories", "sql_insights_pool_histories", "sql_insights_drop_histories"} {
+		mock.ExpectBegin()
+		mock.ExpectExec(`DELETE FROM "`+table+`" WHERE instance_id = \$1 AND created_at < \$2`).WithArgs(1, cutoff).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	if err := NewGormStore(gormdb).Purge(1, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLInsightsStoreSummaries(t *testing.T) {
+	store := NewMemoryStore(20)
+	sInsights := newTestInsights(t, Config{
+		InstanceID: "test",
+		Store:      store,
+	})
+
+	// seed 3 statements over 2 reports, the records of each report are split by caller and labels
+	instanceID := sInsights.instanceAppID
+	start := time.Now().UTC().Truncate(time.Minute).Add(-time.Hour)
+	hashIDs := []string{hash("SELECT 1"), hash("SELECT 2"), hash("SELECT 3")}
+	for idx, createdAt := range []time.Time{start, start.Add(time.Minute)} {
+		tx := &SQLInsightsTxHistory{InstanceID: instanceID, CreatedAt: createdAt, HashID: hashIDs[0], CallerHash: "a", Count: 2, Commits: 2, StatementsSum: 4, StatementsMax: 2, TookMin: float64(idx + 1), TookMax: float64(idx + 5), TookSum: 8}
+		tx.SetHashIDs([]string{hashIDs[idx], hashIDs[2]})
+		if err := store.SaveReport(&Report{
+			Hashes: []*SQLInsightsHash{{ID: hashIDs[0], Statement: "SELECT 1"}, {ID: hashIDs[1], Statement: "SELECT 2"}, {ID: hashIDs[2], Statement: "SELECT 3"}},
+			Statements: []*SQLInsightsHistory{
+				{InstanceID: instanceID, CreatedAt: createdAt, HashID: hashIDs[0], Type: _statTypeQuery, CallerHash: "a", Labels: "route=/a", Count: 1, TookSum: 10, TookMax: 10},
+				{InstanceID: instanceID, CreatedAt: createdAt, HashID: hashIDs[0], Type: _statTypeQuery, CallerHash: "b", Labels: "route=/b", Count: 1, TookSum: 1, TookMax: 1},
+				{InstanceID: instanceID, CreatedAt: createdAt, HashID: hashIDs[1], Type: _statTypeQuery, CallerHash: "a", Labels: "route=/b", Count: 3, TookSum: 3, TookMax: 2},
+			},
+			Errors: []*SQLInsightsErrorHistory{
+				{InstanceID: instanceID, CreatedAt: createdAt, HashID: hashIDs[0], Class: ErrorClassDeadlock, Code: "pg:40P01", Count: 1, Message: "deadlock " + strconv.Itoa(idx)},
+				{InstanceID: instanceID, CreatedAt: createdAt, HashID: hashIDs[1], Class: ErrorClassDeadlock, Code: "pg:40P01", Count: 2},
+				{InstanceID: instanceID, CreatedAt: createdAt, HashID: hashIDs[2], Class: ErrorClassTimeout, Count: 1},
+			},
+			Transactions: []*SQLInsightsTxHistory{tx},
+			Repetitions: []*SQLInsightsRepetitionHistory{
+				{InstanceID: instanceID, CreatedAt: createdAt, HashID: hashIDs[0], CallerHash: "a", Labels: "route=/a", Occurrences: 1, RepetitionsSum: 5, RepetitionsMax: 5},
+				{InstanceID: instanceID, CreatedAt: createdAt, HashID: hashIDs[0], CallerHash: "a", Labels: "route=/b", Occurrences: 1, RepetitionsSum: 3, RepetitionsMax: 3},
+				{InstanceID: instanceID, CreatedAt: createdAt, HashID: hashIDs[1], CallerHash: "b", Occurrences: 1, RepetitionsSum: 4, RepetitionsMax: 4},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the store sums the records of each group and keeps the top groups
+	labels, err := sInsights.SQLLabelSummary(&SQLLabelSummaryRequest{LabelKey: "route", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 1 || labels[0].Label != "/a" || labels[0].Count != 2 || labels[0].TookSum != 20 || labels[0].TookMax != 10 {
+		t.Fatalf("unexpected label summary %+v", labels)
+	}
+	if labels, _ = sInsights.SQLLabelSummary(&SQLLabelSummaryRequest{LabelKey: "route"}); len(labels) != 2 || labels[1].Label != "/b" || labels[1].Count != 8 || labels[1].TookSum != 8 {
+		t.Fatalf("expected the label sets to be summed per route, got %+v", labels)
+	}
+	repetitions, err := sInsights.SQLRepetitionSummary(&SQLRepetitionSummaryRequest{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repetitions) != 1 || repetitions[0].HashID != hashIDs[0] || repetitions[0].Statement != "SELECT 1" || repetitions[0].Occurrences != 4 || repetitions[0].RepetitionsMax != 5 || repetitions[0].RepetitionsAvg != 4 {
+		t.Fatalf("unexpected repetition summary %+v", repetitions)
+	}
+	transactions, err := sInsights.SQLTransactionSummary(&SQLTransactionSummaryRequest{OrderBy: " Took_Avg "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transactions) != 1 || transactions[0].Count != 4 || transactions[0].TookMin != 1 || transactions[0].TookMax != 6 || transactions[0].TookAvg != 4 || transactions[0].StatementsAvg != 2 || !slices.Equal(transactions[0].HashIDs, slices.Sorted(slices.Values(hashIDs))) {
+		t.Fatalf("unexpected transaction summary %+v", transactions)
+	}
+	errorSummary, err := sInsights.SQLErrorSummary(&SQLErrorSummaryRequest{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errorSummary) != 2 || errorSummary[0].Class != ErrorClassDeadlock || errorSummary[0].Count != 6 || len(errorSummary[0].Statements) != 1 || errorSummary[0].Statements[0].HashID != hashIDs[1] || errorSummary[0].Statements[0].Count != 4 {
+		t.Fatalf("unexpected error summary %+v", errorSummary)
+	}
+	if errorSummary, _ = sInsights.SQLErrorSummary(&SQLErrorSummaryRequest{Classes: []string{ErrorClassDeadlock}}); len(errorSummary) != 1 || len(errorSummary[0].Statements) != 2 || errorSummary[0].Statements[1].Message != "deadlock 1" {
+		t.Fatalf("expected the most recent sample message, got %+v", errorSummary)
+	}
+	if _, err := store.StatementSummary(newHistoryFilter(nil, nil, nil), []string{"database"}, 0); !errors.Is(err, ErrSummaryGroup) {
+		t.Fatalf("expected an unsupported summary group to fail, got %v", err)
+	}
+
+	// the GORM store groups, sorts, and limits in SQL
+	_, gormdb, mock := newMock(t, nil)
+	mock.ExpectQuery(`SELECT caller_hash, SUM\(count\) AS count, .*MAX\(took_max\) AS took_max FROM "sql_insights_histories" WHERE \(created_at >= \$1 AND created_at <= \$2\) AND hash_id IN \(\$3\) GROUP BY "caller_hash" ORDER BY SUM\(took_sum\) DESC,caller_hash LIMIT \$4`).
+		WillReturnRows(sqlmock.NewRows([]string{"caller_hash", "count", "took_sum"}).AddRow("a", 3, 12.5))
+	filter := newHistoryFilter(nil, nil, nil)
+	filter.HashIDs = []string{hashIDs[0]}
+	rows, err := NewGormStore(gormdb).StatementSummary(filter, []string{_summaryCallerHash}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].CallerHash != "a" || rows[0].Count != 3 || rows[0].TookSum != 12.5 {
+		t.Fatalf("unexpected statement summary %+v", rows)
+	}
+	mock.ExpectQuery(`SELECT hash_id, caller_hash, SUM\(count\) AS count, .* FROM "sql_insights_tx_histories" WHERE created_at >= \$1 AND created_at <= \$2 AND count > 0 GROUP BY hash_id, caller_hash ORDER BY SUM\(took_sum\) / SUM\(count\) DESC,hash_id, caller_hash LIMIT \$3`).
+		WillReturnRows(sqlmock.NewRows([]string{"hash_id", "caller_hash", "count"}).AddRow(hashIDs[0], "a", 4))
+	mock.ExpectQuery(`SELECT DISTINCT "hash_id","caller_hash","hash_ids" FROM "sql_insights_tx_histories" WHERE \(created_at >= \$1 AND created_at <= \$2 AND count > 0\) AND hash_id IN \(\$3\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"hash_id", "caller_hash", "hash_ids"}).AddRow(hashIDs[0], "a", `["b","a"]`).AddRow(hashIDs[0], "a", `["a","c"]`))
+	txRows, err := NewGormStore(gormdb).TxSummary(newHistoryFilter(nil, nil, nil), _txOrderTookAvg, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txRows) != 1 || !slices.Equal(txRows[0].GetHashIDs(), []string{"a", "b", "c"}) {
+		t.Fatalf("expected the hash IDs of the group to be merged, got %+v", txRows)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLInsightsMemoryStoreEviction(t *testing.T) {
+	// save more distinct statements than the store keeps records of, each with its hash and caller
+	store := NewMemoryStore(2)
+	for idx := 0; idx < 5; idx++ {
+		hashID := hash("SELECT " + strconv.Itoa(idx))
+		if err := store.SaveReport(&Report{
+			Hashes:     []*SQLInsightsHash{{ID: hashID}},
+			Callers:    []*SQLInsightsCallerHistory{{ID: "caller", HashID: hashID}},
+			Statements: []*SQLInsightsHistory{{InstanceID: 1, HashID: hashID, CallerHash: "caller"}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the hashes and callers of the kept records remain
+	keyHashes, _ := store.KnownHashes()
+	callerHistories, _ := store.KnownCallers()
+	if len(keyHashes) != 2 || len(callerHistories) != 2 {
+		t.Fatalf("expected unreferenced hashes and callers to be evicted, got %d hashes and %d callers", len(keyHashes), len(callerHistories))
+	}
+	for idx := 3; idx < 5; idx++ {
+		hashID := hash("SELECT " + strconv.Itoa(idx))
+		if keyHashes, _ := store.Hashes([]string{hashID}); len(keyHashes) != 1 {
+			t.Fatalf("expected the hash of kept statement %d to remain", idx)
+		}
+		if callerHistories, _ := store.Callers([]string{hashID}); len(callerHistories) != 1 {
+			t.Fatalf("expected the caller of kept statement %d to remain", idx)
+		}
+	}
+}
+
+func TestSQLInsightsSaveReportCallers(t *testing.T) {
+	// only callers missing from the DB are inserted, matched by hash ID and caller hash
+	_, gormdb, mock := newMock(t, nil)
+	mock.ExpectQuery(`SELECT "id","hash_id" FROM "sql_insights_caller_histories" WHERE hash_id IN \(\$1,\$2\)`).
+		WithArgs("hash1", "hash2").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hash_id"}).AddRow("caller1", "hash1"))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO "sql_insights_caller_histories"`).
+		WithArgs("caller1", sqlmock.AnyArg(), "hash2", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := NewGormStore(gormdb).SaveReport(&Report{
+		Callers: []*SQLInsightsCallerHistory{
+			{ID: "caller1", HashID: "hash1"},
+			{ID: "caller1", HashID: "hash2"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLInsightsCallersContaining(t *testing.T) {
+	// LIKE wildcards and the escape character in the text are matched literally
+	_, gormdb, mock := newMock(t, nil)
+	mock.ExpectQuery(`SELECT \* FROM "sql_insights_caller_histories" WHERE value LIKE \$1 ESCAPE \$2`).
+		WithArgs(`%100\%\_done\\%`, `\`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hash_id"}).AddRow("caller", "hash"))
+	callerHistories, err := NewGormStore(gormdb).CallersContaining(`100%_done\`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(callerHistories) != 1 {
+		t.Fatalf("expected 1 caller, got %d", len(callerHistories))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLInsightsMigrateSchema(t *testing.T) {
+	// statement history stored in seconds by earlier versions is converted to milliseconds once, then the version is recorded
+	_, gormdb, mock := newMock(t, nil)
+	expectVersion := func(version int) {
+		mock.ExpectBegin()
+		mock.ExpectExec(`INSERT INTO "sql_insights_schemas" .* ON CONFLICT DO NOTHING`).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT \* FROM "sql_insights_schemas" WHERE "sql_insights_schemas"."id" = \$1 .* FOR UPDATE`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "version"}).AddRow(1, version))
+	}
+	expectVersion(0)
+	mock.ExpectExec(`UPDATE "sql_insights_histories" SET "took_avg"=took_avg \* 1000,"took_max"=took_max \* 1000,"took_med"=took_med \* 1000,"took_min"=took_min \* 1000,"took_sum"=took_sum \* 1000 WHERE 1 = 1`).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`UPDATE "sql_insights_schemas" SET "version"=\$1 WHERE "id" = \$2`).WithArgs(_schemaVersion, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// migrating again leaves the statistics alone
+	expectVersion(_schemaVersion)
+	mock.ExpectCommit()
+
+	store := NewGormStore(gormdb)
+	for idx := 0; idx < 2; idx++ {
+		if err := store.migrateSchema(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockingPurgeStore is a memory store whose purges wait until released
+type blockingPurgeStore struct {
+	*MemoryStore
+	purges  atomic.Int32
+	release chan struct{}
+}
+
+func (b *blockingPurgeStore) Purge(instanceAppID uint, before time.Time) error {
+	b.purges.Add(1)
+	<-b.release
+	return b.MemoryStore.Purge(instanceAppID, before)
+}
+
+func TestSQLInsightsPurgeBackground(t *testing.T) {
+	store := &blockingPurgeStore{MemoryStore: NewMemoryStore(10), release: make(chan struct{})}
+	sInsights := New(Config{
+		InstanceID:   "test",
+		Store:        store,
+		AutoPurgeAge: time.Hour,
+	})
+
+	// the purge runs in the background without blocking the collector, and only one runs at a time
+	lastPurge := sInsights.purgeOldStatistics(time.Time{})
+	if lastPurge.IsZero() {
+		t.Fatal("expected the purge to be started")
+	}
+	if sInsights.purgeOldStatistics(time.Time{}) != (time.Time{}) {
+		t.Fatal("expected no purge to be started while the previous one is running")
+	}
+	for store.purges.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// stopping waits for the purge in progress
+	stopped := make(chan struct{})
+	go func() {
+		_ = sInsights.Stop(time.Second)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("expected Stop to wait for the purge in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(store.release)
+	<-stopped
+	if store.purges.Load() != 1 {
+		t.Fatalf("expected a single purge, got %d", store.purges.Load())
+	}
+}
+
+func TestSQLInsightsBackpressure(t *testing.T) {
+	// queryStats runs the queries while the collector is held off by statsLock, then returns the number of stats dropped and collected
+	queryStats := func(db *gorm.DB, sInsights *SQLInsights, queries int) (int64, int) {
+		sInsights.statsLock.Lock()
+		for i := 0; i < queries; i++ {
+			db.Where("id = ?", i).Find(&mockTestUser{})
+		}
+		dropped := sInsights.droppedStats.Load()
+		sInsights.unsafeCollectStats()
+		collected := 0
+		for _, agg := range sInsights.stats[_statTypeQuery] {
+			collected += agg.samples
+		}
+		sInsights.statsLock.Unlock()
+		return dropped, collected
+	}
+
+	for _, policy := range []BackpressurePolicy{BackpressureDropNewest, BackpressureDropOldest, BackpressureBlockTimeout} {
+		t.Run(policy.String(), func(t *testing.T) {
+			_, db, _ := newMock(t, nil)
+
+			sInsights := useTestInsights(t, db, Config{
+				InstanceID:              "test",
+				MaxStatisticsBufferSize: 4,
+				Backpressure:            policy,
+				BackpressureTimeout:     5 * time.Millisecond,
+			})
+
+			start := time.Now()
+			dropped, collected := queryStats(db, sInsights, 10)
+			if dropped != 6 || collected != 4 {
+				t.Fatalf("expected 6 dropped and 4 collected stats, got %d and %d", dropped, collected)
+			}
+			if policy == BackpressureBlockTimeout && time.Since(start) < 30*time.Millisecond {
+				t.Fatalf("expected each dropped statement to wait for the timeout, took %s", time.Since(start))
+			}
+
+			// dropped counts are stored with the next report and reset
+			unlock := lockTestStats(t, sInsights)
+			dropHistory := sInsights.buildDropHistory(newTestReportBucket(), sInsights.unsafeCollectDrops())
+			if dropHistory == nil || dropHistory.Stats != 6 || dropHistory.Policy != policy.String() {
+				t.Fatalf("expected 6 dropped stats, got %+v", dropHistory)
+			}
+			if dropHistory = sInsights.buildDropHistory(newTestReportBucket(), sInsights.unsafeCollectDrops()); dropHistory != nil {
+				t.Fatalf("expected dropped counts to be reset, got %+v", dropHistory)
+			}
+			unlock()
+		})
+	}
+
+	t.Run("block", func(t *testing.T) {
+		_, db, _ := newMock(t, nil)
+
+		sInsights := useTestInsights(t, db, Config{
+			InstanceID:              "test",
+			MaxStatisticsBufferSize: 2,
+			Backpressure:            BackpressureBlock,
+		})
+
+		// fill the queue while the collector is held off, the next statement waits for room
+		unlock := lockTestStats(t, sInsights)
+		db.Where("id = ?", 0).Find(&mockTestUser{})
+		db.Where("id = ?", 1).Find(&mockTestUser{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			db.Where("id = ?", 2).Find(&mockTestUser{})
+		}()
+		select {
+		case <-done:
+			t.Fatal("expected statement to wait for room in the stats queue")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		// once the collector catches up the statement completes and nothing is dropped
+		unlock()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected statement to complete once the collector made room")
+		}
+		if dropped := sInsights.droppedStats.Load(); dropped != 0 {
+			t.Fatalf("expected no dropped stats, got %d", dropped)
+		}
+
+		// statements still waiting when stopping give up, counting their statistic as dropped
+		unlock = lockTestStats(t, sInsights)
+		for !sInsights.statsQueue.push(&stat{Key: "filler"}) {
+			sInsights.unsafeCollectStats()
+		}
+		done = make(chan struct{})
+		go func() {
+			defer close(done)
+			db.Where("id = ?", 3).Find(&mockTestUser{})
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		// release waiting statements the way Stop does first, while the collector is still held off so nothing makes room
+		sInsights.stopOnce.Do(func() {
+			close(sInsights.stopping)
+		})
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected waiting statement to complete once stopped")
+		}
+		if dropped := sInsights.droppedStats.Load(); dropped != 1 {
+			t.Fatalf("expected the statistic given up on when stopping to be dropped, got %d", dropped)
+		}
+		unlock()
+		if err := sInsights.Stop(0); err != nil {
+			t.Fatalf("failed to stop sql insights plugin: %s", err)
+		}
+		if dropped := sendWithBackpressure(sInsights, make(chan int), 1); dropped != 1 {
+			t.Fatalf("expected the value sent once stopped to be dropped, got %d", dropped)
+		}
+	})
+}
+
+func TestSQLInsightsReportInterval(t *testing.T) {
+	_, db, _ := newMock(t, nil)
+
+	// capture the history records stored by our reports
+	reported := make(chan *SQLInsightsHistory, 10)
+	db.Callback().Create().Before("gorm:create").Register("test:capture_history", func(tx *gorm.DB) {
+		if histories, ok := tx.Statement.Dest.([]*SQLInsightsHistory); ok {
+			for _, history := range histories {
+				reported <- history
+			}
+		}
+	})
+
+	sInsights := useTestInsights(t, db, Config{
+		DB:                db,
+		InstanceID:        "test",
+		ReportInterval:    time.Second,
+		SkipAutomigration: true,
+	})
+	db.Where("id = ?", 1).Find(&mockTestUser{})
+
+	// the report of the interval is stamped with its wall clock aligned start and end
+	var history *SQLInsightsHistory
+	select {
+	case history = <-reported:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a report within the report interval")
+	}
+	if !history.CreatedAt.Equal(history.CreatedAt.Truncate(time.Second)) || history.EndedAt.Sub(history.CreatedAt) != time.Second {
+		t.Fatalf("expected a 1s interval aligned to the second, got %s - %s", history.CreatedAt, history.EndedAt)
+	}
+	if history.Count != 1 {
+		t.Fatalf("expected 1 execution, got %d", history.Count)
+	}
+
+	// stopping reports the partial current interval
+	db.Where("id = ?", 2).Find(&mockTestUser{})
+	if err := sInsights.Stop(time.Second); err != nil {
+		t.Fatalf("failed to stop sql insights plugin: %s", err)
+	}
+	select {
+	case history = <-reported:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a report when stopping")
+	}
+	if !history.CreatedAt.Equal(history.CreatedAt.Truncate(time.Second)) || history.EndedAt.Sub(history.CreatedAt) >= time.Second {
+		t.Fatalf("expected a partial interval aligned to the second, got %s - %s", history.CreatedAt, history.EndedAt)
+	}
+}
+
+func TestSQLInsightsDriver(t *testing.T) {
+	mockDB, mock, err := sqlmock.NewWithDSN("insights_driver_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+
+	// create our new insights monitor without a storage DB, wrapping the mock driver so statements bypassing GORM are recorded
+	sInsights := newTestInsights(t, Config{
+		InstanceID: "test",
+	})
+	connector, err := sInsights.WrapDriver(mockDB.Driver()).(driver.DriverContext).OpenConnector("insights_driver_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB := sql.OpenDB(connector)
+	defer sqlDB.Close()
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Use(sInsights)
+
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectQuery(`SELECT \* FROM "mock_test_users"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`SELECT user_name FROM mock_test_users`).WillReturnRows(sqlmock.NewRows([]string{"user_name"}).AddRow("test"))
+	mock.ExpectExec(`UPDATE mock_test_users SET full_name`).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectPrepare(`DELETE FROM mock_test_users`).ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// recorded once by our GORM callbacks
+	db.Where("id = ?", 1).Find(&mockTestUser{})
+
+	// recorded by the wrapped driver
+	var userName string
+	if err := sqlDB.QueryRowContext(context.Background(), "SELECT user_name FROM mock_test_users WHERE id = $1", 1).Scan(&userName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlDB.ExecContext(context.Background(), "UPDATE mock_test_users SET full_name = $1", "test"); err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := sqlDB.Prepare("DELETE FROM mock_test_users WHERE id = $1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stmt.Exec(1); err != nil {
+		t.Fatal(err)
+	}
+	stmt.Close()
+
+	// the context of a statement is marked by its first before callback only
+	marked := db.Model(&mockTestUser{})
+	sInsights.insightsBefore(_statTypeQuery)(marked)
+	ctx := marked.Statement.Context
+	sInsights.insightsBefore(_statTypeRow)(marked)
+	if ctx.Value(gormStatementContextKey{}) == nil || marked.Statement.Context != ctx {
+		t.Fatal("expected the statement context to be marked once")
+	}
+
+	// collect the queued statistics
+	drainTestStats(t, sInsights)
+
+	sInsights.statsLock.Lock()
+	defer sInsights.statsLock.Unlock()
+	counts := make(map[statType]int, 3)
+	rows := make(map[string]int64, 4)
+	for sType, statTypeMap := range sInsights.stats {
+		for _, agg := range statTypeMap {
+			counts[sType] += agg.samples
+			rows[agg.Key] += int64(agg.rowsSum)
+		}
+	}
+	if counts[_statTypeQuery] != 1 || counts[_statTypeSQLQuery] != 1 || counts[_statTypeSQLExec] != 2 || len(counts) != 3 {
+		t.Fatalf("expected 1 GORM query, 1 sql query, and 2 sql executions, got %v", counts)
+	}
+	if rows["UPDATE mock_test_users SET full_name = $1"] != 3 || rows["DELETE FROM mock_test_users WHERE id = $1"] != 1 {
+		t.Fatalf("expected the rows affected to be recorded, got %v", rows)
+	}
+}
+
+// newTestReportBucket returns the report bucket of the current minute
+func newTestReportBucket() reportBucket {
+	start := time.Now().UTC().Truncate(time.Minute)
+	return reportBucket{Start: start, End: start.Add(time.Minute)}
+}
+
+type mockTestUser struct {
+	ID       uint   `gorm:"primarykey"`
+	FullName string `json:"full_name"`
+	UserName string `json:"user_name"`
+	Password string `json:"password"`
+}
+
+// newMock creates a new mock database and gorm connection for testing/benchmarking purposes. Ignore expectations
+func newMock(t *testing.T, b *testing.B) (*sql.DB, *gorm.DB, sqlmock.Sqlmock) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		if t != nil {
+			t.Fatal(err)
+		} else if b != nil {
+			b.Fatal(err)
+		}
+	}
+	gormdb, err := gorm.Open(postgres.New(postgres.Config{
+		Conn: sqldb,
+	}), &gorm.Config{
+		// silence log output, we're not using expectations
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+
+	if err != nil {
+		if t != nil {
+			t.Fatal(err)
+		} else if b != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if t != nil {
+		t.Cleanup(func() { sqldb.Close() })
+	}
+
+	return sqldb, gormdb, mock
+}
+
+// newTestInsights creates our insights monitor with the specified config, stopped when the test ends
+func newTestInsights(t testing.TB, config Config) *SQLInsights {
+	t.Helper()
+	sInsights := New(config)
+	t.Cleanup(func() {
+		if err := sInsights.Stop(time.Second); err != nil {
+			t.Errorf("failed to stop sql insights plugin: %s", err)
+		}
+	})
+	return sInsights
+}
+
+// useTestInsights creates our insights monitor with the specified config and registers it with the DB, stopped when the test ends
+func useTestInsights(t testing.TB, db *gorm.DB, config Config) *SQLInsights {
+	t.Helper()
+	sInsights := newTestInsights(t, config)
+	if err := db.Use(sInsights); err != nil {
+		t.Fatalf("failed to register sql insights plugin: %s", err)
+	}
+	return sInsights
+}
+
+// lockTestStats locks the stats table until the returned function is called, or the test ends so a failing test does not leave it locked while the plugin is stopped
+func lockTestStats(t testing.TB, sInsights *SQLInsights) func() {
+	sInsights.statsLock.Lock()
+	unlock := sync.OnceFunc(sInsights.statsLock.Unlock)
+	t.Cleanup(unlock)
+	return unlock
+}
+
+// drainTestStats collects the statistics queued by the statements executed so far, statement stats are queued before the statements return so there is nothing to wait for
+func drainTestStats(t testing.TB, sInsights *SQLInsights) {
+	t.Helper()
+	if err := sInsights.DrainStatsChannel(10 * time.Second); err != nil {
+		t.Fatalf("failed to drain stats channel: %s", err)
+	}
+}
+
+// waitTestStats collects the queued statistics until the condition, checked with the stats table locked, holds. Transactions and repetitions are sent to the collector, which may hold one while waiting for the lock
+func waitTestStats(t testing.TB, sInsights *SQLInsights, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		drainTestStats(t, sInsights)
+		sInsights.statsLock.Lock()
+		done := condition()
+		sInsights.statsLock.Unlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the collected statistics")
+		}
+		time.Sleep(time.Millisecond)
+	}
 }
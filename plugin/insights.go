@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
@@ -19,8 +22,8 @@ var (
 
 // SQLInsights is a Gorm plugin that collects, aggregates, and stores SQL statistics
 type SQLInsights struct {
-	// _db is the gorm DB instance this plugin is registered to
-	_db *gorm.DB
+	// databases are the gorm DB instances this plugin is registered to
+	databases []*monitoredDB
 
 	// config is the configuration for this plugin
 	config Config
@@ -28,19 +31,71 @@ type SQLInsights struct {
 	// InstanceAppID is the SQLInsightsApp ID for the the defined InstanceID
 	instanceAppID uint
 
+	// store is where the statistics are stored, nil if they are not stored
+	store Store
+
 	// statistics table used in between storage intervals
-	stats        map[statType]map[string][]*stat
+	stats        map[statType]map[string]*statAggregate
 	statsBuf     []*SQLInsightsHistory
+	errorsBuf    []*SQLInsightsErrorHistory
 	keyHashes    map[string]struct{}            // keyHash
+	hashNames    map[string]string              // keyHash -> name set with the SettingName directive
 	callerHashes map[string]map[string]struct{} // keyHash -> callerHash
+	labelSets    map[string]struct{}            // distinct label sets seen during the current report interval
+	callerSets   map[string]map[string]struct{} // keyHash -> callerHash seen during the current report interval
+	txStats      map[string][]*txStat           // keyHash+callerHash -> transactions
+	txStatsBuf   []*SQLInsightsTxHistory
+	repetitions  map[string][]*repetitionStat // keyHash+callerHash -> repetition findings
 	statsLock    sync.Mutex
 
-	// stats channel to receive statistics from the Gorm callbacks
-	statsChan chan *stat
-	stopChan  chan chan struct{}
-	stopped   bool
+	// connection pools of the monitored DBs and their statistics as of the previous report, and their names by *sql.DB for the Gorm callbacks
+	connections []*monitoredConn
+	connNames   sync.Map
+
+	// collector owned cache of statement hashes, and the shared cache of resolved callers keyed by caller program counters
+	keyHashCache map[string]string
+	callerCache  *callerCache
+	callerFrames atomic.Int64 // number of program counters captured beyond the caller depth, grown when stacks go deeper
+
+	// stats queue to receive statistics from the Gorm callbacks without blocking or allocating, the collector is woken up once it fills up
+	statsQueue *statQueue
+	statsWake  chan struct{}
+
+	// channels to receive the less frequent transaction stats and repetition findings
+	txStatsChan     chan *txStat
+	repetitionsChan chan *repetitionStat
+	stopChan        chan chan struct{}
+	stopping        chan struct{} // closed once stopping so statements waiting for room in a full buffer give up
+	stopOnce        sync.Once
+	stopped         bool
+
+	// purge of old statistics running in the background so it does not stall the collector, Stop waits for it
+	purging   atomic.Bool
+	purgeWait sync.WaitGroup
+
+	// number of statistics dropped by the backpressure policy since the previous report
+	droppedStats       atomic.Int64
+	droppedTxStats     atomic.Int64
+	droppedRepetitions atomic.Int64
+
+	// metrics of all statements since the plugin started, exposed by the metrics handler
+	metrics *cumulativeMetrics
+
+	// last log time of slow or failed statements by SQL, to rate limit the slow query log
+	slowLog     map[string]*slowLogState
+	slowLogLock sync.Mutex
+
+	// statsd sends the statistics of every report interval to a StatsD/DogStatsD agent, nil when not enabled
+	statsd *statsdEmitter
 
-	statementMaps map[string]*sync.Map
+	// sampler decides which statements are recorded
+	sampler *sampler
+
+	// tracer creates the spans of statements, nil when tracing is not enabled
+	tracer trace.Tracer
+
+	// wrapsDriver is set once a database/sql driver or connector has been wrapped, GORM statements are then marked so they are not recorded twice
+	wrapsDriver atomic.Bool
 }
 
 type Config struct {
@@ -48,6 +103,10 @@ type Config struct {
 	// This Does not have to be the same DB instance as the one this plugin is being used as a plugin for it to monitor
 	DB *gorm.DB
 
+	// Store is where the SQL statistics are stored and the dashboard API reads them from, defaults to NewGormStore(DB) when DB is set.
+	// Set it to NewMemoryStore to keep recent statistics in memory without a DB, or to your own Store implementation
+	Store Store
+
 	// InstanceID is the ID/name of the application this plugin is being used in. Something unique to distinqguish this instance from other instances of the same or different applications
 	// Example, "myapp:us-west-2a" if you have multiple instances of the same app running in different regions/availability zones in AWS and you want to have the ability to segregate the statistics by region/availability zone
 	InstanceID string
@@ -56,15 +115,88 @@ type Config struct {
 	// A value <1 means do not collect callers
 	CollectCallerDepth int
 
-	// MaxStatisticsBufferSize is the maximum number of statistics to buffer before before blocking
+	// CallerSkipPackagePrefixes are package import path prefixes skipped when collecting callers, in addition to this plugin, GORM, and database/sql. Ex. your repository/DAO wrapper layer "github.com/myorg/myapp/repository"
+	CallerSkipPackagePrefixes []string
+
+	// HashCallersByFunction hashes callers by their function names only, so a caller keeps its caller hash when the lines of the calls change
+	HashCallersByFunction bool
+
+	// MaxCallersPerHash is the maximum number of distinct callers a statement is aggregated by per report interval, defaults to 20. Executions from additional callers are recorded without their callers
+	MaxCallersPerHash int
+
+	// LabelKeys restricts which context labels, set with WithLabels, are recorded. An empty list records all labels
+	LabelKeys []string
+
+	// MaxLabelSets is the maximum number of distinct label sets recorded per report interval. Statements with additional label sets are recorded under a single overflow label set
+	MaxLabelSets int
+
+	// RepetitionThreshold is the number of times the same statement must be executed within a single unit of work, marked with WithUnitOfWork, to be reported as an N+1 finding
+	RepetitionThreshold int
+
+	// SampleRate is the fraction (0-1] of statements to record. A value <=0 records all statements. Recorded totals are scaled by the inverse of the sample rate so they remain unbiased
+	SampleRate float64
+
+	// TypeSampleRates overrides SampleRate for specific statement types (query, raw, create, update, delete, row, sql_query, sql_exec)
+	TypeSampleRates map[string]float64
+
+	// SampleKeepErrors specifies if statements that return an error are always recorded regardless of the sample rate
+	SampleKeepErrors bool
+
+	// SampleKeepSlowerThan specifies a duration at or above which statements are always recorded regardless of the sample rate. A value <=0 disables this override
+	SampleKeepSlowerThan time.Duration
+
+	// AdaptiveSampling, when set, lowers the sample rate while QPS or the statistics buffer backlog are high
+	AdaptiveSampling *AdaptiveSamplingConfig
+
+	// Filters are include/exclude rules deciding which statements are recorded, such as excluding health checks, migrations, or the statistics tables themselves. An empty list records all statements
+	Filters []*FilterRule
+
+	// TracerProvider, when set, creates an OpenTelemetry client span for every statement executed through the Gorm callbacks, as a child of the span in the statement context.
+	// Spans carry the parameterized SQL, statement hash, table, rows affected, and caller. Regardless of tracing, the trace ID of the slowest slow execution is stored with each history record
+	TracerProvider trace.TracerProvider
+
+	// Logger, when set, logs every statement executed through the Gorm callbacks that took at least SlowQueryThreshold or failed as a structured record, as it completes
+	Logger *slog.Logger
+
+	// SlowQueryThreshold is the duration at or above which statements are logged to Logger. A value <=0 only logs failed statements
+	SlowQueryThreshold time.Duration
+
+	// SlowQueryLogInterval is the minimum interval between two records of the same statement logged to Logger, defaults to 10s. The number of suppressed records is logged with the next record
+	SlowQueryLogInterval time.Duration
+
+	// ReportInterval is how often statistics are aggregated and stored, defaults to 1 minute. Intervals are aligned to the wall clock, so use an interval dividing a day evenly (ex. 10s, 1m, 5m, 15m) for instances to report the same intervals
+	ReportInterval time.Duration
+
+	// MaxStatisticsBufferSize is the maximum number of statistics to buffer before applying the Backpressure policy. Rounded up to a power of two for statements, defaults to 4096 (previously 100)
 	MaxStatisticsBufferSize int
 
+	// Backpressure is the policy applied when the statistics buffer is full, defaults to BackpressureBlock which never drops statistics while the plugin runs,
+	// like previous versions. Choose BackpressureDropNewest, BackpressureDropOldest, or BackpressureBlockTimeout to never slow statements down instead. Dropped statistics are counted with each report
+	Backpressure BackpressurePolicy
+
+	// BackpressureTimeout is how long a statement waits for room in the statistics buffer with the BackpressureBlockTimeout policy, defaults to 10ms
+	BackpressureTimeout time.Duration
+
 	// AutoPurgeAge is the age at which old statistics are automatically purged from the DB. A value of <=0 means do not automatically purge old statistics
 	AutoPurgeAge time.Duration
 
+	// CollectTransactions specifies if transaction statistics (duration, statement count, idle time, and commit/rollback outcome) should be collected
+	// This wraps the connection pool of the monitored gorm DB instance so transactions started through it can be tracked
+	CollectTransactions bool
+
 	// CollectSystemResources specifies if system resource statistics (memory % used, CPU %) should be collected
 	CollectSystemResources bool
 
+	// MetricsMaxFingerprints is the maximum number of statement fingerprints tracked since the plugin started for the /metrics handler of the DashboardMux, defaults to 1000. Executions of additional fingerprints are counted under the "other" hash
+	MetricsMaxFingerprints int
+
+	// MetricsTopN is the maximum number of fingerprints exposed with their own series, defaults to 100. When first scraped, fingerprints with the most total execution time are exposed until
+	// MetricsTopN are, the others are summed under the "other" hash of their statement type and database. Fingerprints keep their series afterwards so counters never decrease
+	MetricsTopN int
+
+	// StatsD, when set, sends the statement counts, execution durations, and errors of every report interval to a StatsD/DogStatsD agent over UDP
+	StatsD *StatsDConfig
+
 	// DashboardConfig is the configuration for the dashboard user interface
 	DashboardConfig *DashboardConfig
 
@@ -80,12 +212,45 @@ func (c *Config) applyDefaults() {
 	if c.CollectCallerDepth < 0 {
 		c.CollectCallerDepth = 0
 	}
+	if c.ReportInterval <= 0 {
+		c.ReportInterval = time.Minute
+	} else if c.ReportInterval < time.Second {
+		c.ReportInterval = time.Second
+	}
 	if c.MaxStatisticsBufferSize <= 0 {
-		c.MaxStatisticsBufferSize = 100
+		c.MaxStatisticsBufferSize = 4096
+	}
+	if c.Backpressure == BackpressureBlockTimeout && c.BackpressureTimeout <= 0 {
+		c.BackpressureTimeout = 10 * time.Millisecond
 	}
 	if c.AutoPurgeAge < 0 {
 		c.AutoPurgeAge = 0
 	}
+	if c.MaxCallersPerHash <= 0 {
+		c.MaxCallersPerHash = 20
+	}
+	if c.MaxLabelSets <= 0 {
+		c.MaxLabelSets = 100
+	}
+	if c.RepetitionThreshold <= 0 {
+		c.RepetitionThreshold = 10
+	}
+	if c.SlowQueryLogInterval <= 0 {
+		c.SlowQueryLogInterval = 10 * time.Second
+	}
+	if c.MetricsMaxFingerprints <= 0 {
+		c.MetricsMaxFingerprints = 1000
+	}
+	if c.MetricsTopN <= 0 {
+		c.MetricsTopN = 100
+	}
+
+	if c.AdaptiveSampling != nil {
+		c.AdaptiveSampling.applyDefaults()
+	}
+	if c.StatsD != nil {
+		c.StatsD.applyDefaults()
+	}
 
 	// set up a default dashboard config if one is not provided
 	if c.DashboardConfig == nil {
@@ -111,20 +276,47 @@ func New(config Config) *SQLInsights {
 
 	// create our new SQLInsights plugin instance
 	ret := &SQLInsights{
-		instanceAppID: 0,
-		config:        config,
-		stats:         make(map[statType]map[string][]*stat, 1),
-		statsBuf:      make([]*SQLInsightsHistory, 0, 100),
-		keyHashes:     make(map[string]struct{}, 1),
-		callerHashes:  make(map[string]map[string]struct{}, 1),
-		statsLock:     sync.Mutex{},
-		statsChan:     make(chan *stat, config.MaxStatisticsBufferSize), // allow buffering of stats without blocking
-		stopChan:      make(chan chan struct{}),
-		statementMaps: map[string]*sync.Map{_statTypeQuery.String(): {}, _statTypeRaw.String(): {}},
-	}
-
-	if config.DB != nil {
-		// perform automigration of our statistics tables
+		instanceAppID:   0,
+		config:          config,
+		stats:           make(map[statType]map[string]*statAggregate, 1),
+		statsBuf:        make([]*SQLInsightsHistory, 0, 100),
+		errorsBuf:       make([]*SQLInsightsErrorHistory, 0, 10),
+		keyHashes:       make(map[string]struct{}, 1),
+		hashNames:       make(map[string]string, 1),
+		callerHashes:    make(map[string]map[string]struct{}, 1),
+		labelSets:       make(map[string]struct{}, 1),
+		callerSets:      make(map[string]map[string]struct{}, 1),
+		txStats:         make(map[string][]*txStat, 1),
+		txStatsBuf:      make([]*SQLInsightsTxHistory, 0, 10),
+		repetitions:     make(map[string][]*repetitionStat, 1),
+		statsLock:       sync.Mutex{},
+		keyHashCache:    make(map[string]string, 100),
+		callerCache:     newCallerCache(),
+		statsQueue:      newStatQueue(config.MaxStatisticsBufferSize), // allow buffering of stats without blocking
+		statsWake:       make(chan struct{}, 1),
+		txStatsChan:     make(chan *txStat, config.MaxStatisticsBufferSize),         // allow buffering of transaction stats without blocking
+		repetitionsChan: make(chan *repetitionStat, config.MaxStatisticsBufferSize), // allow buffering of repetition findings without blocking
+		stopChan:        make(chan chan struct{}),
+		stopping:        make(chan struct{}),
+		metrics:         newCumulativeMetrics(),
+		slowLog:         make(map[string]*slowLogState, 1),
+		sampler:         newSampler(&config),
+	}
+
+	if config.StatsD != nil {
+		ret.statsd = newStatsDEmitter(config.StatsD, config.InstanceID)
+	}
+
+	if config.TracerProvider != nil {
+		ret.tracer = config.TracerProvider.Tracer(_tracerName)
+	}
+
+	ret.store = config.Store
+	if ret.store == nil && config.DB != nil {
+		ret.store = NewGormStore(config.DB)
+	}
+	if ret.store != nil {
+		// perform automigration of our statistics store
 		ret.performAutoMigration()
 	}
 
@@ -135,35 +327,33 @@ func New(config Config) *SQLInsights {
 	return ret
 }
 
-// performAutoMigration performs the automigration of the statistics tables
+// performAutoMigration performs the automigration of the statistics store
 func (s *SQLInsights) performAutoMigration() {
 	if !s.config.SkipAutomigration {
-		_ = s.StatDB().AutoMigrate(autoMigration()...)
+		_ = s.store.Migrate()
 	}
 
 	// load/store our InstanceID/App name
 	if s.config.InstanceID != "" {
 		// store our InstanceID/App name if it currently does not exist
-		appInstance := SQLInsightsApp{
-			InstanceAppName: s.config.InstanceID,
-		}
-		if err := s.StatDB().Where("instance_app_name = ?", s.config.InstanceID).FirstOrCreate(&appInstance).Error; err == nil && appInstance.ID >= 0 {
-			s.instanceAppID = appInstance.ID
+		if instanceAppID, err := s.store.InstanceAppID(s.config.InstanceID); err == nil {
+			s.instanceAppID = instanceAppID
 		}
 	}
 
 	// load our known key hashes
-	var keyHashes []SQLInsightsHash
-	if err := s.StatDB().Find(&keyHashes).Error; err == nil {
+	if keyHashes, err := s.store.KnownHashes(); err == nil {
 		for _, keyHash := range keyHashes {
 			s.keyHashes[keyHash.ID] = struct{}{}
+			if keyHash.Name != "" {
+				s.hashNames[keyHash.ID] = keyHash.Name
+			}
 		}
 	}
 
 	// load our known caller hashes
 	if s.config.CollectCallerDepth > 0 {
-		var callerHashes []SQLInsightsCallerHistory
-		if err := s.StatDB().Find(&callerHashes).Error; err == nil {
+		if callerHashes, err := s.store.KnownCallers(); err == nil {
 			for _, callerHash := range callerHashes {
 				if _, ok := s.callerHashes[callerHash.HashID]; !ok {
 					s.callerHashes[callerHash.HashID] = make(map[string]struct{}, 1)
@@ -188,12 +378,18 @@ func (s *SQLInsights) Stop(allowedWaitTime time.Duration) error {
 		return nil
 	}
 
+	// release statements waiting for room in a full buffer, they can no longer be collected
+	s.stopOnce.Do(func() {
+		close(s.stopping)
+	})
+
 	// signal to stop the collector, waiting for it to be received
 	stoppedChan := make(chan struct{})
 	s.stopChan <- stoppedChan
 
-	// wait for the collector to stop
+	// wait for the collector and any purge in progress to stop
 	<-stoppedChan
+	s.purgeWait.Wait()
 
 	// lock our stats table
 	s.statsLock.Lock()
@@ -202,8 +398,12 @@ func (s *SQLInsights) Stop(allowedWaitTime time.Duration) error {
 	// collect remaining statistics
 	_ = s.unsafeDrainStatsChannel(allowedWaitTime)
 
-	// flush any existing statistics to the DB
-	s.unsafeReportStatistics(time.Now().UTC())
+	// flush any existing statistics to the DB, as a partial report of the current interval
+	now := time.Now().UTC()
+	s.unsafeReportStatistics(reportBucket{Start: now.Truncate(s.config.ReportInterval), End: now})
+	if s.statsd != nil {
+		s.statsd.close()
+	}
 
 	// mark as stopped
 	s.stopped = true
@@ -211,11 +411,11 @@ func (s *SQLInsights) Stop(allowedWaitTime time.Duration) error {
 	return nil
 }
 
-// collector collects statistics from the stats channel and stores them in the stats table
+// collector collects statistics from the stats queue and channels and stores them in the stats table
 func (s *SQLInsights) collector() {
-	// aggregate and report our statistics every minute
-	reportTicker := time.NewTicker(time.Minute)
-	defer reportTicker.Stop()
+	// aggregate and report our statistics every report interval, aligned to the wall clock so instances report the same intervals
+	reportTimer := time.NewTimer(time.Until(time.Now().Truncate(s.config.ReportInterval).Add(s.config.ReportInterval)))
+	defer reportTimer.Stop()
 	purgeInterval := time.Hour
 	if s.config.AutoPurgeAge > purgeInterval*24 {
 		// purge interval is not common, lets only attempt to purge once a day
@@ -223,25 +423,49 @@ func (s *SQLInsights) collector() {
 	}
 	purgeCheck := time.NewTicker(purgeInterval)
 	defer purgeCheck.Stop()
+	var adjustSampling <-chan time.Time
+	if s.config.AdaptiveSampling != nil {
+		// periodically adjust our adaptive sample rate
+		adjustTicker := time.NewTicker(s.config.AdaptiveSampling.AdjustInterval)
+		defer adjustTicker.Stop()
+		adjustSampling = adjustTicker.C
+	}
+	// poll the stats queue in case it never fills up enough to wake us
+	pollTicker := time.NewTicker(_statsPollInterval)
+	defer pollTicker.Stop()
 	lastPurge := time.Time{}
-	newStats := false
 	for {
 		select {
-		case statValue := <-s.statsChan:
-			// add this stat to our stats table
+		case <-s.statsWake:
+			// the stats queue is filling up, add its stats to our stats table
 			s.statsLock.Lock()
-			// store this statistic
-			s.unsafeAddStat(statValue)
-			newStats = true
+			s.unsafeCollectStats()
 			s.statsLock.Unlock()
-		case <-reportTicker.C:
-			// report the statistics if we have new values to report
+		case <-pollTicker.C:
+			// add any queued stats to our stats table
 			s.statsLock.Lock()
-			if newStats {
-				s.unsafeReportStatistics(time.Now().UTC())
-				newStats = false
-			}
+			s.unsafeCollectStats()
 			s.statsLock.Unlock()
+		case txValue := <-s.txStatsChan:
+			// add this transaction stat to our transaction stats table
+			s.statsLock.Lock()
+			s.unsafeAddTxStat(txValue)
+			s.statsLock.Unlock()
+		case repValue := <-s.repetitionsChan:
+			// add this repetition finding to our repetitions table
+			s.statsLock.Lock()
+			s.unsafeAddRepetition(repValue)
+			s.statsLock.Unlock()
+		case now := <-reportTimer.C:
+			// report the statistics of the interval that just ended, even without statements so the connection pools are sampled every interval
+			end := now.UTC().Truncate(s.config.ReportInterval)
+			s.statsLock.Lock()
+			s.unsafeReportStatistics(reportBucket{Start: end.Add(-s.config.ReportInterval), End: end})
+			s.statsLock.Unlock()
+			reportTimer.Reset(time.Until(end.Add(s.config.ReportInterval)))
+		case now := <-adjustSampling:
+			// adjust our sample rate based on the current load
+			s.sampler.adjust(now, s.statsQueue.len(), s.statsQueue.size())
 		case <-purgeCheck.C:
 			// purge old statistics
 			lastPurge = s.purgeOldStatistics(lastPurge)
@@ -253,159 +477,292 @@ func (s *SQLInsights) collector() {
 	}
 }
 
-// purgeOldStatistics purges old statistics from the DB for this application instance ID
+// purgeOldStatistics purges old statistics from the store for this application instance ID
 func (s *SQLInsights) purgeOldStatistics(lastPurge time.Time) time.Time {
 	if s.config.AutoPurgeAge <= 0 {
 		// not purging old statistics
 		return lastPurge
 	}
-	if s.config.DB == nil {
-		// no DB to purge old statistics from
+	if s.store == nil {
+		// no store to purge old statistics from
 		return lastPurge
 	}
 	if time.Since(lastPurge) < s.config.AutoPurgeAge {
 		// not time to purge old statistics yet
 		return lastPurge
 	}
-	go s.StatDB().Where("instance_id = ? AND created_at < ?", s.instanceAppID, time.Now().UTC().Add(-1*s.config.AutoPurgeAge)).Unscoped().Delete(SQLInsightsHistory{})
+	if !s.purging.CompareAndSwap(false, true) {
+		// the previous purge is still running
+		return lastPurge
+	}
+
+	// purge in the background, a long purge of large tables must not stall collecting statistics
+	before := time.Now().UTC().Add(-1 * s.config.AutoPurgeAge)
+	s.purgeWait.Add(1)
+	go func() {
+		defer s.purgeWait.Done()
+		defer s.purging.Store(false)
+		_ = s.store.Purge(s.instanceAppID, before)
+	}()
 	return time.Now().UTC()
 }
 
-// unsafeReportStatistics aggregates all statistics in the stats table and stores them in the DB then clears the stats table
-func (s *SQLInsights) unsafeReportStatistics(now time.Time) {
-	if s.config.DB != nil {
-		// collect system resources if enabled
-		var resources systemResources
-		if s.config.CollectSystemResources {
-			resources = collectSystemResources()
-		}
+// reportBucket defines the time range statistics are reported for, aligned to the wall clock
+type reportBucket struct {
+	Start time.Time
+	End   time.Time
+}
 
-		// loop through our stats table and report each one
-		keyHashIDs := make([]string, 0, 10)
-		keyHashes := make(map[string]*SQLInsightsHash, 10)
-		callerHistoryIDs := make([]string, 0, 10)
-		callerHistories := make(map[string]*SQLInsightsCallerHistory, 10)
-		for statType, statTypeMap := range s.stats {
-			for keyHash, stats := range statTypeMap {
-				if keyHash != "" && len(stats) > 0 {
-					// store the key hash in the DB if it currently does not exist
-					if _, ok := s.keyHashes[keyHash]; !ok {
-						s.keyHashes[keyHash] = struct{}{}
-						keyHashIDs = append(keyHashIDs, keyHash)
-						keyHashes[keyHash] = &SQLInsightsHash{
-							ID:        keyHash,
-							CreatedAt: now,
-							Statement: stats[0].Key,
-							NumVars:   stats[0].NumVars,
-						}
+// unsafeReportStatistics aggregates all statistics in the stats table and stores them in the store then clears the stats table
+func (s *SQLInsights) unsafeReportStatistics(bucket reportBucket) {
+	// count the statistics dropped because our buffers were full, whether or not they are stored
+	dropped := s.unsafeCollectDrops()
+
+	if s.statsd != nil {
+		// send the statistics of the interval to the StatsD agent
+		s.unsafeEmitStatistics(dropped)
+	}
+	if s.store == nil {
+		// nothing else reports this interval, start the next one afresh
+		s.unsafeResetStats()
+		return
+	}
+
+	// collect system resources if enabled
+	var resources systemResources
+	if s.config.CollectSystemResources {
+		resources = collectSystemResources()
+	}
+
+	// loop through our stats table and report each one
+	keyHashes := make(map[string]*SQLInsightsHash, 10)
+	hashNames := make(map[string]string, 1)
+	callerHistories := make(map[string]*SQLInsightsCallerHistory, 10)
+	for statType, statTypeMap := range s.stats {
+		for _, agg := range statTypeMap {
+			if agg.samples > 0 && agg.KeyHash != "" {
+				keyHash := agg.KeyHash
+
+				// store the key hash if it currently does not exist
+				if _, ok := s.keyHashes[keyHash]; !ok {
+					s.keyHashes[keyHash] = struct{}{}
+					keyHashes[keyHash] = &SQLInsightsHash{
+						ID:        keyHash,
+						CreatedAt: bucket.Start,
+						Statement: agg.Key,
+						NumVars:   agg.NumVars,
 					}
+				}
 
-					// build the stat and caller history (if enabled)
-					if statHistory, callerHistory := s.buildStatHistory(now, keyHash, statType, stats); statHistory != nil {
-						// add system resources if enabled
-						if s.config.CollectSystemResources {
-							statHistory.CPU = resources.CPUPercentage
-							statHistory.Mem = resources.MemoryPercentage
-						}
+				// store the latest name given to the statement at the call site if it changed
+				if agg.Name != "" && agg.Name != s.hashNames[keyHash] {
+					s.hashNames[keyHash] = agg.Name
+					hashNames[keyHash] = agg.Name
+				}
+
+				// build the stat and caller history (if enabled)
+				if statHistory, callerHistory := s.buildStatHistory(bucket, statType, agg); statHistory != nil {
+					// add system resources if enabled
+					if s.config.CollectSystemResources {
+						statHistory.CPU = resources.CPUPercentage
+						statHistory.Mem = resources.MemoryPercentage
+					}
 
-						// add to statsBuf for bulk insert
-						s.statsBuf = append(s.statsBuf, statHistory)
-
-						if len(callerHistory) > 0 {
-							// store the caller history in the DB if they currently do not exist
-							for _, callerHistoryValue := range callerHistory {
-								if _, ok := s.callerHashes[keyHash]; !ok {
-									s.callerHashes[keyHash] = make(map[string]struct{}, 1)
-								}
-								if _, ok := s.callerHashes[keyHash][callerHistoryValue.ID]; !ok {
-									// we have not seen this caller hash before, so store it and log it in our local hash table
-									s.callerHashes[keyHash][callerHistoryValue.ID] = struct{}{}
-									callerHistoryIDs = append(callerHistoryIDs, keyHash+callerHistoryValue.ID)
-									callerHistories[keyHash+callerHistoryValue.ID] = callerHistoryValue
-								}
+					// add to statsBuf for bulk insert
+					s.statsBuf = append(s.statsBuf, statHistory)
+					if statHistory.Errors > 0 {
+						// add the errors by class to errorsBuf for bulk insert
+						s.errorsBuf = append(s.errorsBuf, s.buildErrorHistory(bucket, statType, agg)...)
+					}
+
+					if len(callerHistory) > 0 {
+						// store the caller history if they currently do not exist
+						for _, callerHistoryValue := range callerHistory {
+							if _, ok := s.callerHashes[keyHash]; !ok {
+								s.callerHashes[keyHash] = make(map[string]struct{}, 1)
+							}
+							if _, ok := s.callerHashes[keyHash][callerHistoryValue.ID]; !ok {
+								// we have not seen this caller hash before, so store it and log it in our local hash table
+								s.callerHashes[keyHash][callerHistoryValue.ID] = struct{}{}
+								callerHistories[keyHash+callerHistoryValue.ID] = callerHistoryValue
 							}
 						}
 					}
 				}
 			}
 		}
+	}
 
-		if len(keyHashes) > 0 {
-			// check if we have these SQLInsightsHash values in the DB and insert if we don't
-			// query for existing key hashes using our keyHashIDs list
-			var existingKeyHashes []string
-			_ = s.StatDB().Model(&SQLInsightsHash{}).Select("id").Where("id IN ?", keyHashIDs).Scan(&existingKeyHashes)
-			// removing existing values from keyHashes where we already have them in the DB
-			for _, existingKeyHash := range existingKeyHashes {
-				delete(keyHashes, existingKeyHash)
-			}
-			if len(keyHashes) > 0 {
-				// insert our new key hashes
-				toInsert := make([]*SQLInsightsHash, 0, len(keyHashes))
-				for _, keyHash := range keyHashes {
-					toInsert = append(toInsert, keyHash)
-				}
-				_ = s.StatDB().Create(toInsert)
-			}
+	// build our repetition history, storing the callers of each repeated statement if we have not seen them before
+	repetitionHistories := make([]*SQLInsightsRepetitionHistory, 0, len(s.repetitions))
+	for _, repValues := range s.repetitions {
+		repHistory := s.buildRepetitionHistory(bucket, repValues)
+		if repHistory == nil {
+			continue
 		}
-
-		if len(callerHistories) > 0 {
-			// check if we have these SQLInsightsCallerHistory values in the DB and insert if we don't
-			// query for existing caller hashes using our callerHistoryIDs list
-			var existingCallerHashes []string
-			_ = s.StatDB().Model(&SQLInsightsCallerHistory{}).Select("CONCAT(id, hash_id) AS id").Where("id IN ?", callerHistoryIDs).Scan(&existingCallerHashes)
-			// removing existing values from callerHistories where we already have them in the DB
-			for _, existingCallerHash := range existingCallerHashes {
-				delete(callerHistories, existingCallerHash)
+		repetitionHistories = append(repetitionHistories, repHistory)
+		keyHash := repHistory.HashID
+		if _, ok := s.keyHashes[keyHash]; !ok {
+			s.keyHashes[keyHash] = struct{}{}
+			keyHashes[keyHash] = &SQLInsightsHash{
+				ID:        keyHash,
+				CreatedAt: bucket.Start,
+				Statement: repValues[0].Key,
+				NumVars:   repValues[0].NumVars,
 			}
-			if len(callerHistories) > 0 {
-				// insert our new caller hashes
-				toInsert := make([]*SQLInsightsCallerHistory, 0, len(callerHistories))
-				for _, callerHistory := range callerHistories {
-					toInsert = append(toInsert, callerHistory)
-				}
-				_ = s.StatDB().Create(toInsert)
+		}
+		if repHistory.CallerHash == "" {
+			continue
+		}
+		if _, ok := s.callerHashes[keyHash]; !ok {
+			s.callerHashes[keyHash] = make(map[string]struct{}, 1)
+		}
+		if _, ok := s.callerHashes[keyHash][repHistory.CallerHash]; !ok {
+			s.callerHashes[keyHash][repHistory.CallerHash] = struct{}{}
+			callerHistoryValue := &SQLInsightsCallerHistory{
+				ID:        repHistory.CallerHash,
+				CreatedAt: bucket.Start,
+				HashID:    keyHash,
 			}
+			callerHistoryValue.SetJSON(repValues[0].CallerJSON)
+			callerHistories[keyHash+callerHistoryValue.ID] = callerHistoryValue
 		}
-
-		if len(s.statsBuf) == 0 {
-			// no stats to report
-			return
+	}
+	clear(s.repetitions)
+
+	// build the report of the interval, giving new key hashes their names
+	report := &Report{
+		Hashes:      make([]*SQLInsightsHash, 0, len(keyHashes)),
+		HashNames:   hashNames,
+		Callers:     make([]*SQLInsightsCallerHistory, 0, len(callerHistories)),
+		Statements:  s.statsBuf,
+		Errors:      s.errorsBuf,
+		Repetitions: repetitionHistories,
+	}
+	for _, keyHash := range keyHashes {
+		if name, ok := hashNames[keyHash.ID]; ok {
+			keyHash.Name = name
+			delete(hashNames, keyHash.ID)
 		}
+		report.Hashes = append(report.Hashes, keyHash)
+	}
+	for _, callerHistory := range callerHistories {
+		report.Callers = append(report.Callers, callerHistory)
+	}
 
-		// store our stats in the DB
-		_ = s.StatDB().Create(s.statsBuf)
+	// build our transaction history
+	for _, txValues := range s.txStats {
+		if txHistory := s.buildTxHistory(bucket, txValues); txHistory != nil {
+			s.txStatsBuf = append(s.txStatsBuf, txHistory)
+		}
+	}
+	report.Transactions = s.txStatsBuf
+	clear(s.txStats)
+
+	// sample our connection pool statistics and the number of statistics dropped because our buffers were full
+	report.Pools = s.unsafeBuildPoolHistory(bucket)
+	report.Drops = s.buildDropHistory(bucket, dropped)
+
+	// store the report, statistics that fail to be stored are dropped
+	_ = s.store.SaveReport(report)
+	reported := len(s.statsBuf) > 0
+
+	// clear our buffers but keep the capacity
+	clear(s.txStatsBuf)
+	s.txStatsBuf = s.txStatsBuf[:0]
+	clear(s.errorsBuf)
+	s.errorsBuf = s.errorsBuf[:0]
+	clear(s.statsBuf)
+	s.statsBuf = s.statsBuf[:0]
+
+	if !reported {
+		// no stats reported
+		return
+	}
 
-		// clear our statsBuf but keep the capacity
-		clear(s.statsBuf)
-		s.statsBuf = s.statsBuf[:0]
+	// clear our stats table for the next interval
+	s.unsafeResetStats()
+}
 
-		// clear our stats table, leaving our map types and their hashes allocated
-		for _, statTypeMap := range s.stats {
-			for hashKey := range statTypeMap {
-				clear(statTypeMap[hashKey])
-				statTypeMap[hashKey] = statTypeMap[hashKey][:0]
+// unsafeResetStats clears our stats table, leaving our map types and their aggregates allocated. Groups unused during this interval are removed so label sets do not accumulate, and the transactions and repetition findings of the interval are dropped whether or not they were reported. It is not thread safe and assumes statsLock is already locked
+func (s *SQLInsights) unsafeResetStats() {
+	for _, statTypeMap := range s.stats {
+		for groupKey, agg := range statTypeMap {
+			if agg.samples == 0 {
+				delete(statTypeMap, groupKey)
+				continue
 			}
+			agg.reset()
 		}
 	}
+	clear(s.labelSets)
+	clear(s.callerSets)
+	clear(s.txStats)
+	clear(s.repetitions)
 }
 
-// unsafeAddStat stores the statistic in the stats table. It is not thread safe and assumes statsLock is already locked
+// unsafeCollectStats moves all queued stats into the stats table, returning the number of stats collected. It is not thread safe and assumes statsLock is already locked
+func (s *SQLInsights) unsafeCollectStats() int {
+	collected := 0
+	for {
+		statValue, ok := s.statsQueue.pop()
+		if !ok {
+			return collected
+		}
+		s.unsafeAddStat(statValue)
+		collected++
+	}
+}
+
+// unsafeAddStat hashes the statistic and stores it in the stats table. It is not thread safe and assumes statsLock is already locked
 func (s *SQLInsights) unsafeAddStat(statValue *stat) {
-	if statValue.KeyHash == "" {
+	if statValue.Key == "" {
+		releaseStat(statValue)
 		return
 	}
-	// store the statistic in the stats table
+
+	// create hash of the key (parameterized SQL statement), statements repeat so remember their hashes
+	keyHash, ok := s.keyHashCache[statValue.Key]
+	if !ok {
+		if len(s.keyHashCache) >= _maxCachedKeyHashes {
+			// too many distinct statements, start over rather than growing without bounds
+			clear(s.keyHashCache)
+		}
+		keyHash = hash(statValue.Key)
+		s.keyHashCache[statValue.Key] = keyHash
+	}
+	statValue.KeyHash = keyHash
+
+	// encode the labels we aggregate by
+	statValue.Labels = s.encodeLabels(statValue.LabelSet)
+
+	// resolve our callers if we have any and are tracking this
+	if s.config.CollectCallerDepth > 0 {
+		s.unsafeResolveStatCallers(statValue)
+		// limit the number of distinct callers we aggregate by
+		s.unsafeBoundCallers(statValue)
+	}
+
+	// aggregate the statistic in the stats table
 	if _, ok := s.stats[statValue.Type]; !ok {
-		s.stats[statValue.Type] = make(map[string][]*stat, 10)
+		s.stats[statValue.Type] = make(map[string]*statAggregate, 10)
 	}
-	if _, ok := s.stats[statValue.Type][statValue.KeyHash]; !ok {
-		s.stats[statValue.Type][statValue.KeyHash] = make([]*stat, 0, 100)
+	// limit the number of distinct label sets we aggregate by
+	statValue.Labels = s.unsafeBoundLabels(statValue.Labels)
+	groupKey := statValue.groupKey()
+	agg, ok := s.stats[statValue.Type][groupKey]
+	if !ok {
+		agg = &statAggregate{}
+		s.stats[statValue.Type][groupKey] = agg
 	}
-	s.stats[statValue.Type][statValue.KeyHash] = append(s.stats[statValue.Type][statValue.KeyHash], statValue)
+	agg.add(statValue)
+	s.metrics.add(statValue, s.config.MetricsMaxFingerprints)
+
+	// the stat is aggregated, return it to the pool
+	releaseStat(statValue)
 }
 
-// DrainStatsChannel drains the stats channel and stores the statistics in the stats table. It will wait for the specified timeOut duration before returning an error if the channel is not empty
+// DrainStatsChannel drains the stats queue and channels and stores the statistics in the stats table. It will wait for the specified timeOut duration before returning an error if the channels are not empty
 func (s *SQLInsights) DrainStatsChannel(timeOut time.Duration) error {
 	// lock our stats table
 	s.statsLock.Lock()
@@ -415,20 +772,26 @@ func (s *SQLInsights) DrainStatsChannel(timeOut time.Duration) error {
 	return s.unsafeDrainStatsChannel(timeOut)
 }
 
-// unsafeDrainStatsChannel drains the stats channel and stores the statistics in the stats table. It is not thread safe and assumes the statsLock is already locked
+// unsafeDrainStatsChannel drains the stats queue and channels and stores the statistics in the stats table. It is not thread safe and assumes the statsLock is already locked
 func (s *SQLInsights) unsafeDrainStatsChannel(timeOut time.Duration) error {
 	t := time.NewTimer(timeOut)
 	defer t.Stop()
 	for {
+		// add our queued stats
+		s.unsafeCollectStats()
 		select {
-		case statValue := <-s.statsChan:
-			// add this stat
-			s.unsafeAddStat(statValue)
+		case txValue := <-s.txStatsChan:
+			// add this transaction stat
+			s.unsafeAddTxStat(txValue)
+		case repValue := <-s.repetitionsChan:
+			// add this repetition finding
+			s.unsafeAddRepetition(repValue)
 		case <-t.C:
 			// timeout, exit
 			return ErrTimedOut
 		default:
-			// no more stats in the buffered channel, exit
+			// no more stats in the buffered channels, collect any stats queued meanwhile and exit
+			s.unsafeCollectStats()
 			return nil
 		}
 	}
@@ -436,24 +799,54 @@ func (s *SQLInsights) unsafeDrainStatsChannel(timeOut time.Duration) error {
 
 // insightsAddStat adds a statistic to be collected by the background collector
 func (s *SQLInsights) insightsAddStat(statValue *stat) {
-	if statValue == nil || statValue.Key == "" {
+	if statValue == nil {
+		return
+	}
+	if statValue.Key == "" {
+		releaseStat(statValue)
 		return
 	}
 
-	// create hash of the key (parameterized SQL statement)
-	statValue.KeyHash = hash(statValue.Key)
-
-	// get hash of our callers if we have any and are tracking this
-	if len(statValue.Callers) > 0 && s.config.CollectCallerDepth > 0 {
-		// we have one ore more callers, serialize and hash
-		statValue.CallerJSON, _ = json.Marshal(statValue.Callers)
-		if len(statValue.CallerJSON) > 0 {
-			statValue.CallerHash = hashBytes(statValue.CallerJSON)
+	// queue for the collector, hashing and caller resolution happen there so the statement is not slowed down
+	if s.statsQueue.push(statValue) {
+		if s.statsQueue.len() >= s.statsQueue.size()/2 {
+			// getting full, wake the collector if it is not already awake
+			s.wakeCollector()
 		}
+		return
+	}
+
+	// the queue is full, apply our backpressure policy
+	s.insightsAddStatFull(statValue)
+}
+
+// wakeCollector signals the collector to collect the queued stats without blocking
+func (s *SQLInsights) wakeCollector() {
+	select {
+	case s.statsWake <- struct{}{}:
+	default:
+		// already signaled
 	}
+}
 
-	// send to the stats channel, wait if buffer is full
-	s.statsChan <- statValue
+// hashCallers serializes the callers as JSON and returns the JSON along with its hash, or the hash of the caller functions only with Config.HashCallersByFunction. Returns empty values when there are no callers
+func (s *SQLInsights) hashCallers(callers []*callerInfo) ([]byte, string) {
+	if len(callers) == 0 {
+		return nil, ""
+	}
+	// we have one ore more callers, serialize and hash
+	callerJSON, _ := json.Marshal(callers)
+	if len(callerJSON) == 0 {
+		return nil, ""
+	}
+	if s.config.HashCallersByFunction {
+		functions := make([]string, 0, len(callers))
+		for _, caller := range callers {
+			functions = append(functions, caller.Function)
+		}
+		return callerJSON, hash(strings.Join(functions, "\n"))
+	}
+	return callerJSON, hashBytes(callerJSON)
 }
 
 // hash returns the MD5 hash of the input string
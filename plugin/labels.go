@@ -0,0 +1,164 @@
+package insights
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	// LabelRoute is the label key used for the HTTP route or gRPC method a statement was executed for
+	LabelRoute = "route"
+	// LabelMethod is the label key used for the HTTP method a statement was executed for
+	LabelMethod = "method"
+
+	// _labelsOverflow is the label set statements are recorded under once the maximum number of distinct label sets has been reached for a report interval
+	_labelsOverflow = "_overflow=true"
+
+	// _maxLabelsLength is the maximum length of an encoded label set, matching the size of the SQLInsightsHistory.Labels column
+	_maxLabelsLength = 255
+)
+
+// labelsContextKey is the context key used to store labels
+type labelsContextKey struct{}
+
+// WithLabels returns a copy of ctx carrying the specified labels merged over any labels already set on ctx.
+// Statements executed with the returned context, through db.WithContext(ctx), are aggregated by these labels
+func WithLabels(ctx context.Context, labels map[string]string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if len(labels) == 0 {
+		return ctx
+	}
+	existing := LabelsFromContext(ctx)
+	merged := make(map[string]string, len(existing)+len(labels))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, labelsContextKey{}, merged)
+}
+
+// LabelsFromContext returns the labels set on ctx by WithLabels, or nil if there are none. The returned map must not be modified
+func LabelsFromContext(ctx context.Context) map[string]string {
+	if ctx == nil {
+		return nil
+	}
+	labels, _ := ctx.Value(labelsContextKey{}).(map[string]string)
+	return labels
+}
+
+// encodeLabels encodes the labels, restricted to the configured label keys, into their stored form. Returns an empty string if there are no labels to record
+func (s *SQLInsights) encodeLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	values := make(url.Values, len(labels))
+	for k, v := range labels {
+		if len(s.config.LabelKeys) > 0 && !slices.Contains(s.config.LabelKeys, k) {
+			// not a label we record
+			continue
+		}
+		values.Set(k, v)
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	// Encode sorts by key so the same labels always produce the same value
+	encoded := values.Encode()
+	if len(encoded) > _maxLabelsLength {
+		return _labelsOverflow
+	}
+	return encoded
+}
+
+// decodeLabels decodes stored labels back into a map
+func decodeLabels(encoded string) map[string]string {
+	if encoded == "" {
+		return nil
+	}
+	values, err := url.ParseQuery(encoded)
+	if err != nil {
+		return nil
+	}
+	labels := make(map[string]string, len(values))
+	for k := range values {
+		labels[k] = values.Get(k)
+	}
+	return labels
+}
+
+// unsafeBoundLabels limits the number of distinct label sets recorded per report interval, replacing new label sets with the overflow label set once the limit has been reached. It is not thread safe and assumes statsLock is already locked
+func (s *SQLInsights) unsafeBoundLabels(labels string) string {
+	if labels == "" {
+		return labels
+	}
+	if _, ok := s.labelSets[labels]; ok {
+		return labels
+	}
+	if len(s.labelSets) >= s.config.MaxLabelSets {
+		return _labelsOverflow
+	}
+	s.labelSets[labels] = struct{}{}
+	return labels
+}
+
+// LabelsMiddleware returns net/http middleware that labels all statements executed with the request context with the request method and route, tracking each request as a unit of work for N+1 detection.
+// The route is the ServeMux pattern that matched the request when available, otherwise the request path
+func LabelsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Pattern
+		if route == "" {
+			if mux, ok := next.(*http.ServeMux); ok {
+				_, route = mux.Handler(r)
+			}
+		}
+		if route == "" {
+			route = r.URL.Path
+		}
+		ctx, done := WithUnitOfWork(WithLabels(r.Context(), map[string]string{
+			LabelMethod: r.Method,
+			LabelRoute:  route,
+		}))
+		defer done()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// UnaryServerInterceptor returns a gRPC unary server interceptor that labels all statements executed with the request context with the full gRPC method name as the route, tracking each request as a unit of work for N+1 detection
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, done := WithUnitOfWork(WithLabels(ctx, map[string]string{LabelRoute: info.FullMethod}))
+		defer done()
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a gRPC stream server interceptor that labels all statements executed with the stream context with the full gRPC method name as the route, tracking each stream as a unit of work for N+1 detection
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, done := WithUnitOfWork(WithLabels(ss.Context(), map[string]string{LabelRoute: info.FullMethod}))
+		defer done()
+		return handler(srv, &labeledServerStream{
+			ServerStream: ss,
+			ctx:          ctx,
+		})
+	}
+}
+
+// labeledServerStream wraps a grpc.ServerStream to return a labeled context
+type labeledServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the labeled context of the stream
+func (l *labeledServerStream) Context() context.Context {
+	return l.ctx
+}
@@ -0,0 +1,565 @@
+package insights
+
+import (
+	"bytes"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStore stores the statistics in memory, for services without a writable SQL database and for tests. Each kind of history is kept in a ring buffer holding
+// the most recent records up to the configured maximum. Once there are more statement hashes or callers than that maximum, those no longer referenced by a kept record
+// are evicted, a statement that executes again after its hash was evicted is reported without its text. Statistics are lost when the process exits
+type MemoryStore struct {
+	lock       sync.RWMutex
+	maxRecords int // records kept of each kind of history, and hashes and callers kept before unreferenced ones are evicted
+
+	apps    map[string]uint // instance name -> ID
+	appIDs  map[uint]string // ID -> instance name
+	hashes  map[string]*SQLInsightsHash
+	callers map[string]*SQLInsightsCallerHistory // hash ID + caller hash -> caller
+
+	statements   *ringBuffer[*SQLInsightsHistory]
+	errors       *ringBuffer[*SQLInsightsErrorHistory]
+	transactions *ringBuffer[*SQLInsightsTxHistory]
+	repetitions  *ringBuffer[*SQLInsightsRepetitionHistory]
+	pools        *ringBuffer[*SQLInsightsPoolHistory]
+	drops        *ringBuffer[*SQLInsightsDropHistory]
+}
+
+// NewMemoryStore creates a new in-memory store keeping up to maxRecords of each kind of history, defaults to 10000 when <=0
+func NewMemoryStore(maxRecords int) *MemoryStore {
+	if maxRecords <= 0 {
+		maxRecords = 10000
+	}
+	return &MemoryStore{
+		maxRecords:   maxRecords,
+		apps:         make(map[string]uint, 1),
+		appIDs:       make(map[uint]string, 1),
+		hashes:       make(map[string]*SQLInsightsHash, 10),
+		callers:      make(map[string]*SQLInsightsCallerHistory, 10),
+		statements:   newRingBuffer[*SQLInsightsHistory](maxRecords),
+		errors:       newRingBuffer[*SQLInsightsErrorHistory](maxRecords),
+		transactions: newRingBuffer[*SQLInsightsTxHistory](maxRecords),
+		repetitions:  newRingBuffer[*SQLInsightsRepetitionHistory](maxRecords),
+		pools:        newRingBuffer[*SQLInsightsPoolHistory](maxRecords),
+		drops:        newRingBuffer[*SQLInsightsDropHistory](maxRecords),
+	}
+}
+
+// Migrate does nothing, there is nothing to migrate in memory
+func (m *MemoryStore) Migrate() error {
+	return nil
+}
+
+// InstanceAppID returns the ID of the instance name, creating it if it does not exist yet
+func (m *MemoryStore) InstanceAppID(instanceID string) (uint, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if id, ok := m.apps[instanceID]; ok {
+		return id, nil
+	}
+	id := uint(len(m.apps) + 1)
+	m.apps[instanceID] = id
+	m.appIDs[id] = instanceID
+	return id, nil
+}
+
+// KnownHashes returns all stored statement hashes
+func (m *MemoryStore) KnownHashes() ([]*SQLInsightsHash, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	keyHashes := make([]*SQLInsightsHash, 0, len(m.hashes))
+	for _, keyHash := range m.hashes {
+		keyHashCopy := *keyHash
+		keyHashes = append(keyHashes, &keyHashCopy)
+	}
+	return keyHashes, nil
+}
+
+// KnownCallers returns all stored callers
+func (m *MemoryStore) KnownCallers() ([]*SQLInsightsCallerHistory, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.unsafeCallers(func(*SQLInsightsCallerHistory) bool { return true }), nil
+}
+
+// SaveReport stores the statistics of a report interval
+func (m *MemoryStore) SaveReport(report *Report) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, keyHash := range report.Hashes {
+		if _, ok := m.hashes[keyHash.ID]; !ok {
+			keyHashCopy := *keyHash
+			m.hashes[keyHash.ID] = &keyHashCopy
+		}
+	}
+	for keyHash, name := range report.HashNames {
+		if existing, ok := m.hashes[keyHash]; ok {
+			existing.Name = name
+		}
+	}
+	for _, callerHistory := range report.Callers {
+		if _, ok := m.callers[callerHistory.HashID+callerHistory.ID]; !ok {
+			m.callers[callerHistory.HashID+callerHistory.ID] = callerHistory
+		}
+	}
+	m.statements.add(report.Statements...)
+	m.errors.add(report.Errors...)
+	m.transactions.add(report.Transactions...)
+	m.repetitions.add(report.Repetitions...)
+	m.pools.add(report.Pools...)
+	if report.Drops != nil {
+		m.drops.add(report.Drops)
+	}
+	m.unsafeEvict()
+	return nil
+}
+
+// Purge removes the history of the instance created before the specified time from every kind of history
+func (m *MemoryStore) Purge(instanceAppID uint, before time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.statements.remove(func(history *SQLInsightsHistory) bool {
+		return history.InstanceID == instanceAppID && history.CreatedAt.Before(before)
+	})
+	m.errors.remove(func(history *SQLInsightsErrorHistory) bool {
+		return history.InstanceID == instanceAppID && history.CreatedAt.Before(before)
+	})
+	m.transactions.remove(func(history *SQLInsightsTxHistory) bool {
+		return history.InstanceID == instanceAppID && history.CreatedAt.Before(before)
+	})
+	m.repetitions.remove(func(history *SQLInsightsRepetitionHistory) bool {
+		return history.InstanceID == instanceAppID && history.CreatedAt.Before(before)
+	})
+	m.pools.remove(func(history *SQLInsightsPoolHistory) bool {
+		return history.InstanceID == instanceAppID && history.CreatedAt.Before(before)
+	})
+	m.drops.remove(func(history *SQLInsightsDropHistory) bool {
+		return history.InstanceID == instanceAppID && history.CreatedAt.Before(before)
+	})
+	m.unsafeEvict()
+	return nil
+}
+
+// unsafeEvict removes the statement hashes and callers no longer referenced by a kept record once there are more than maxRecords of either, so they do not grow
+// without bounds. It is not thread safe and assumes lock is already locked
+func (m *MemoryStore) unsafeEvict() {
+	if len(m.hashes) <= m.maxRecords && len(m.callers) <= m.maxRecords {
+		return
+	}
+
+	// collect the hashes and callers referenced by our records
+	hashIDs := make(map[string]struct{}, len(m.hashes))
+	callerIDs := make(map[string]struct{}, len(m.callers))
+	reference := func(hashID, callerHash string) {
+		hashIDs[hashID] = struct{}{}
+		if callerHash != "" {
+			callerIDs[hashID+callerHash] = struct{}{}
+		}
+	}
+	m.statements.each(func(history *SQLInsightsHistory) {
+		reference(history.HashID, history.CallerHash)
+	})
+	m.errors.each(func(history *SQLInsightsErrorHistory) {
+		reference(history.HashID, "")
+	})
+	m.transactions.each(func(history *SQLInsightsTxHistory) {
+		reference(history.HashID, history.CallerHash)
+		for _, hashID := range history.GetHashIDs() {
+			reference(hashID, "")
+		}
+	})
+	m.repetitions.each(func(history *SQLInsightsRepetitionHistory) {
+		reference(history.HashID, history.CallerHash)
+	})
+
+	// evict the others
+	if len(m.hashes) > m.maxRecords {
+		for hashID := range m.hashes {
+			if _, ok := hashIDs[hashID]; !ok {
+				delete(m.hashes, hashID)
+			}
+		}
+	}
+	if len(m.callers) > m.maxRecords {
+		for callerID := range m.callers {
+			if _, ok := callerIDs[callerID]; !ok {
+				delete(m.callers, callerID)
+			}
+		}
+	}
+}
+
+// StatementHistory returns the statement history matching the filter, along with the instance name and statement name
+func (m *MemoryStore) StatementHistory(filter *HistoryFilter) ([]*SQLInsightsQueryQueryHistoryDBResult, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var results []*SQLInsightsQueryQueryHistoryDBResult
+	m.statements.each(func(history *SQLInsightsHistory) {
+		if !filter.matchStatement(history) {
+			return
+		}
+		instanceAppName, ok := m.appIDs[history.InstanceID]
+		if !ok {
+			// the history of unknown instances is excluded like the inner join of GormStore does
+			return
+		}
+		result := &SQLInsightsQueryQueryHistoryDBResult{
+			SQLInsightsHistory: *history,
+			InstanceAppName:    instanceAppName,
+		}
+		if keyHash, ok := m.hashes[history.HashID]; ok {
+			result.Name = keyHash.Name
+		}
+		results = append(results, result)
+	})
+	return results, nil
+}
+
+// ConnectionCounts returns the number of statements per instance, report, database, and connection matching the filter
+func (m *MemoryStore) ConnectionCounts(filter *HistoryFilter) ([]*SQLInsightsHistory, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var counts []*SQLInsightsHistory
+	grouped := make(map[string]*SQLInsightsHistory, 10)
+	m.statements.each(func(history *SQLInsightsHistory) {
+		if !filter.matchTime(history.CreatedAt) || !filter.matchInstance(history.InstanceID) || !matchValue(filter.Databases, history.Database) {
+			return
+		}
+		groupKey := strconv.FormatUint(uint64(history.InstanceID), 10) + "|" + strconv.FormatInt(history.CreatedAt.UnixMicro(), 10) + "|" + history.Database + "|" + history.Connection
+		count, ok := grouped[groupKey]
+		if !ok {
+			count = &SQLInsightsHistory{InstanceID: history.InstanceID, CreatedAt: history.CreatedAt, Database: history.Database, Connection: history.Connection}
+			grouped[groupKey] = count
+			counts = append(counts, count)
+		}
+		count.Count += history.Count
+	})
+	return counts, nil
+}
+
+// LatencyHistory returns the statement history with latency buckets matching the filter, oldest first
+func (m *MemoryStore) LatencyHistory(filter *HistoryFilter) ([]*SQLInsightsHistory, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var rows []*SQLInsightsHistory
+	m.statements.each(func(history *SQLInsightsHistory) {
+		if history.Latency != "" && filter.matchStatement(history) {
+			row := *history
+			rows = append(rows, &row)
+		}
+	})
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].CreatedAt.Before(rows[j].CreatedAt)
+	})
+	return rows, nil
+}
+
+// StatementSummary returns the statement history matching the filter summed per group of the groupBy columns, sorted by the total execution duration descending
+func (m *MemoryStore) StatementSummary(filter *HistoryFilter, groupBy []string, limit int) ([]*SQLInsightsHistory, error) {
+	if err := checkSummaryGroup(groupBy, _summaryHashID, _summaryType, _summaryCallerHash, _summaryLabels); err != nil {
+		return nil, err
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var rows []*SQLInsightsHistory
+	grouped := make(map[string]*SQLInsightsHistory, 10)
+	m.statements.each(func(history *SQLInsightsHistory) {
+		if !filter.matchStatement(history) {
+			return
+		}
+		var group SQLInsightsHistory
+		for _, column := range groupBy {
+			switch column {
+			case _summaryHashID:
+				group.HashID = history.HashID
+			case _summaryType:
+				group.Type = history.Type
+			case _summaryCallerHash:
+				group.CallerHash = history.CallerHash
+			case _summaryLabels:
+				group.Labels = history.Labels
+			}
+		}
+		groupKey := group.HashID + "|" + group.Type.String() + "|" + group.CallerHash + "|" + group.Labels
+		row, ok := grouped[groupKey]
+		if !ok {
+			row = &group
+			grouped[groupKey] = row
+			rows = append(rows, row)
+		}
+		row.Count += history.Count
+		row.Errors += history.Errors
+		row.Slow += history.Slow
+		row.RowsSum += history.RowsSum
+		row.TookSum += history.TookSum
+		row.TookMax = max(row.TookMax, history.TookMax)
+	})
+	return topSummaries(rows, limit, func(a, b *SQLInsightsHistory) bool { return a.TookSum > b.TookSum }), nil
+}
+
+// ErrorSummary returns the error history matching the filter summed per group of the groupBy columns, sorted by count descending
+func (m *MemoryStore) ErrorSummary(filter *HistoryFilter, groupBy []string, limit int) ([]*SQLInsightsErrorHistory, error) {
+	if err := checkSummaryGroup(groupBy, _summaryClass, _summaryCode, _summaryHashID, _summaryType); err != nil {
+		return nil, err
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var rows []*SQLInsightsErrorHistory
+	grouped := make(map[string]*SQLInsightsErrorHistory, 10)
+	messageTimes := make(map[*SQLInsightsErrorHistory]time.Time, 10)
+	withMessage := slices.Contains(groupBy, _summaryHashID)
+	m.errors.each(func(history *SQLInsightsErrorHistory) {
+		if !filter.matchTime(history.CreatedAt) || !filter.matchInstance(history.InstanceID) || !matchValue(filter.Databases, history.Database) || !matchValue(filter.Classes, history.Class) {
+			return
+		}
+		var group SQLInsightsErrorHistory
+		for _, column := range groupBy {
+			switch column {
+			case _summaryClass:
+				group.Class = history.Class
+			case _summaryCode:
+				group.Code = history.Code
+			case _summaryHashID:
+				group.HashID = history.HashID
+			case _summaryType:
+				group.Type = history.Type
+			}
+		}
+		groupKey := group.Class + "|" + group.Code + "|" + group.HashID + "|" + group.Type.String()
+		row, ok := grouped[groupKey]
+		if !ok {
+			row = &group
+			grouped[groupKey] = row
+			rows = append(rows, row)
+		}
+		row.Count += history.Count
+		row.TookSum += history.TookSum
+		row.TookMax = max(row.TookMax, history.TookMax)
+		if withMessage && history.Message != "" && !history.CreatedAt.Before(messageTimes[row]) {
+			// keep the most recent sample message
+			row.Message = history.Message
+			messageTimes[row] = history.CreatedAt
+		}
+	})
+	return topSummaries(rows, limit, func(a, b *SQLInsightsErrorHistory) bool { return a.Count > b.Count }), nil
+}
+
+// TxSummary returns the transaction history matching the filter summed per first statement and caller, sorted descending by orderBy
+func (m *MemoryStore) TxSummary(filter *HistoryFilter, orderBy string, limit int) ([]*SQLInsightsTxHistory, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var rows []*SQLInsightsTxHistory
+	grouped := make(map[string]*SQLInsightsTxHistory, 10)
+	groupedHashIDs := make(map[*SQLInsightsTxHistory][]string, 10)
+	m.transactions.each(func(history *SQLInsightsTxHistory) {
+		if history.Count <= 0 || !filter.matchTime(history.CreatedAt) || !filter.matchInstance(history.InstanceID) {
+			return
+		}
+		groupKey := history.HashID + "|" + history.CallerHash
+		row, ok := grouped[groupKey]
+		if !ok {
+			row = &SQLInsightsTxHistory{HashID: history.HashID, CallerHash: history.CallerHash, TookMin: history.TookMin}
+			grouped[groupKey] = row
+			rows = append(rows, row)
+		}
+		row.Count += history.Count
+		row.Commits += history.Commits
+		row.Rollbacks += history.Rollbacks
+		row.StatementsSum += history.StatementsSum
+		row.StatementsMax = max(row.StatementsMax, history.StatementsMax)
+		row.TookMin = min(row.TookMin, history.TookMin)
+		row.TookMax = max(row.TookMax, history.TookMax)
+		row.TookSum += history.TookSum
+		row.IdleMax = max(row.IdleMax, history.IdleMax)
+		row.IdleSum += history.IdleSum
+		groupedHashIDs[row] = append(groupedHashIDs[row], history.GetHashIDs()...)
+	})
+	for _, row := range rows {
+		hashIDs := groupedHashIDs[row]
+		slices.Sort(hashIDs)
+		row.SetHashIDs(slices.Compact(hashIDs))
+	}
+
+	var value func(row *SQLInsightsTxHistory) float64
+	switch orderBy {
+	case _txOrderTookSum:
+		value = func(row *SQLInsightsTxHistory) float64 { return row.TookSum }
+	case _txOrderTookAvg:
+		value = func(row *SQLInsightsTxHistory) float64 { return row.TookSum / float64(row.Count) }
+	case _txOrderIdleMax:
+		value = func(row *SQLInsightsTxHistory) float64 { return row.IdleMax }
+	case _txOrderIdleSum:
+		value = func(row *SQLInsightsTxHistory) float64 { return row.IdleSum }
+	case _txOrderCount:
+		value = func(row *SQLInsightsTxHistory) float64 { return float64(row.Count) }
+	case _txOrderRollbacks:
+		value = func(row *SQLInsightsTxHistory) float64 { return float64(row.Rollbacks) }
+	default:
+		value = func(row *SQLInsightsTxHistory) float64 { return row.TookMax }
+	}
+	return topSummaries(rows, limit, func(a, b *SQLInsightsTxHistory) bool { return value(a) > value(b) }), nil
+}
+
+// RepetitionSummary returns the repetition history matching the filter summed per statement and caller, sorted by the total number of repeated executions descending
+func (m *MemoryStore) RepetitionSummary(filter *HistoryFilter, limit int) ([]*SQLInsightsRepetitionHistory, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var rows []*SQLInsightsRepetitionHistory
+	grouped := make(map[string]*SQLInsightsRepetitionHistory, 10)
+	m.repetitions.each(func(history *SQLInsightsRepetitionHistory) {
+		if history.Occurrences <= 0 || !filter.matchTime(history.CreatedAt) || !filter.matchInstance(history.InstanceID) {
+			return
+		}
+		groupKey := history.HashID + "|" + history.CallerHash + "|" + history.Type.String()
+		row, ok := grouped[groupKey]
+		if !ok {
+			row = &SQLInsightsRepetitionHistory{HashID: history.HashID, CallerHash: history.CallerHash, Type: history.Type}
+			grouped[groupKey] = row
+			rows = append(rows, row)
+		}
+		row.Occurrences += history.Occurrences
+		row.RepetitionsSum += history.RepetitionsSum
+		row.RepetitionsMax = max(row.RepetitionsMax, history.RepetitionsMax)
+	})
+	return topSummaries(rows, limit, func(a, b *SQLInsightsRepetitionHistory) bool { return a.RepetitionsSum > b.RepetitionsSum }), nil
+}
+
+// PoolHistory returns the connection pool history matching the filter, along with the instance name, oldest first
+func (m *MemoryStore) PoolHistory(filter *HistoryFilter) ([]*SQLPoolHistoryResult, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var results []*SQLPoolHistoryResult
+	m.pools.each(func(history *SQLInsightsPoolHistory) {
+		if !filter.matchTime(history.CreatedAt) || !filter.matchInstance(history.InstanceID) || !matchValue(filter.Databases, history.Database) {
+			return
+		}
+		if instanceAppName, ok := m.appIDs[history.InstanceID]; ok {
+			results = append(results, &SQLPoolHistoryResult{SQLInsightsPoolHistory: *history, InstanceAppName: instanceAppName})
+		}
+	})
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].CreatedAt.Before(results[j].CreatedAt)
+	})
+	return results, nil
+}
+
+// Hashes returns the statement hashes with the specified IDs
+func (m *MemoryStore) Hashes(ids []string) ([]*SQLInsightsHash, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	keyHashes := make([]*SQLInsightsHash, 0, len(ids))
+	for _, id := range ids {
+		if keyHash, ok := m.hashes[id]; ok {
+			keyHashCopy := *keyHash
+			keyHashes = append(keyHashes, &keyHashCopy)
+		}
+	}
+	return keyHashes, nil
+}
+
+// Callers returns the callers of the statements with the specified hash IDs
+func (m *MemoryStore) Callers(hashIDs []string) ([]*SQLInsightsCallerHistory, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.unsafeCallers(func(callerHistory *SQLInsightsCallerHistory) bool {
+		return slices.Contains(hashIDs, callerHistory.HashID)
+	}), nil
+}
+
+// CallersContaining returns the callers whose serialized value contains the text
+func (m *MemoryStore) CallersContaining(text string) ([]*SQLInsightsCallerHistory, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.unsafeCallers(func(callerHistory *SQLInsightsCallerHistory) bool {
+		return bytes.Contains(callerHistory.Value, []byte(text))
+	}), nil
+}
+
+// unsafeCallers returns copies of the callers matching the function. It is not thread safe and assumes lock is already locked
+func (m *MemoryStore) unsafeCallers(match func(*SQLInsightsCallerHistory) bool) []*SQLInsightsCallerHistory {
+	var callerHistories []*SQLInsightsCallerHistory
+	for _, callerHistory := range m.callers {
+		if match(callerHistory) {
+			callerHistoryCopy := *callerHistory
+			callerHistories = append(callerHistories, &callerHistoryCopy)
+		}
+	}
+	return callerHistories
+}
+
+// matchStatement returns true if the statement history matches the filter
+func (f *HistoryFilter) matchStatement(history *SQLInsightsHistory) bool {
+	return f.matchTime(history.CreatedAt) && f.matchInstance(history.InstanceID) && matchValue(f.Databases, history.Database) &&
+		matchValue(f.Types, history.Type.String()) && matchValue(f.HashIDs, history.HashID) && matchValue(f.CallerHashes, history.CallerHash)
+}
+
+// matchTime returns true if the creation time is within the time range of the filter, inclusive
+func (f *HistoryFilter) matchTime(createdAt time.Time) bool {
+	return !createdAt.Before(f.From) && !createdAt.After(f.To)
+}
+
+// matchInstance returns true if the filter includes the instance ID
+func (f *HistoryFilter) matchInstance(instanceID uint) bool {
+	return matchValue(f.InstanceAppIDs, strconv.FormatUint(uint64(instanceID), 10))
+}
+
+// matchValue returns true if the list of values is empty or contains the value
+func matchValue(values []string, value string) bool {
+	return len(values) == 0 || slices.Contains(values, value)
+}
+
+// topSummaries sorts the summed groups by less, keeping their order of first appearance on ties, and returns up to limit groups, all groups when limit is 0
+func topSummaries[T any](rows []T, limit int, less func(a, b T) bool) []T {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return less(rows[i], rows[j])
+	})
+	if limit > 0 && len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return rows
+}
+
+// ringBuffer keeps the most recent values up to its capacity, overwriting the oldest
+type ringBuffer[T any] struct {
+	values []T
+	next   int // index the next value is written to once full
+}
+
+// newRingBuffer creates a new ring buffer holding up to capacity values
+func newRingBuffer[T any](capacity int) *ringBuffer[T] {
+	return &ringBuffer[T]{values: make([]T, 0, capacity)}
+}
+
+// add adds the values, overwriting the oldest values once full
+func (r *ringBuffer[T]) add(values ...T) {
+	for _, value := range values {
+		if len(r.values) < cap(r.values) {
+			r.values = append(r.values, value)
+			continue
+		}
+		r.values[r.next] = value
+		r.next = (r.next + 1) % len(r.values)
+	}
+}
+
+// each calls fn with every value, oldest first
+func (r *ringBuffer[T]) each(fn func(T)) {
+	for idx := range r.values {
+		fn(r.values[(r.next+idx)%len(r.values)])
+	}
+}
+
+// remove removes the values matching the function, keeping the order of the others
+func (r *ringBuffer[T]) remove(match func(T) bool) {
+	kept := make([]T, 0, cap(r.values))
+	r.each(func(value T) {
+		if !match(value) {
+			kept = append(kept, value)
+		}
+	})
+	r.values, r.next = kept, 0
+}
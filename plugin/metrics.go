@@ -0,0 +1,372 @@
+package insights
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// _metricsPrefix is the prefix of the names of the metrics exposed by the metrics handler
+	_metricsPrefix = "gorm_sql_insights_"
+
+	// _metricsOtherHash is the hash label of the series summing the fingerprints that are not exposed individually
+	_metricsOtherHash = "other"
+
+	// content types of the Prometheus text and OpenMetrics exposition formats
+	_metricsContentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	_metricsContentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// cumulativeMetrics are the metrics of all statements since the plugin started, exposed by the metrics handler. They are updated by the collector while holding statsLock
+type cumulativeMetrics struct {
+	fingerprints map[string]*fingerprintMetrics // type/database/keyHash -> metrics, bounded by Config.MetricsMaxFingerprints
+	errors       map[string]*errorMetrics       // type/database/class -> errors
+	exposed      int                            // number of fingerprints exposed with their own series
+
+	// statistics dropped by the backpressure policy and already stored with a drop history record
+	droppedStats       int64
+	droppedTxStats     int64
+	droppedRepetitions int64
+}
+
+// fingerprintMetrics are the cumulative metrics of a statement fingerprint
+type fingerprintMetrics struct {
+	Type     statType
+	Database string
+	KeyHash  string // hash ID, or _metricsOtherHash for the fingerprints beyond the limits
+	Table    string
+
+	count   float64 // executions, weighted by the number of executions each sampled stat represents
+	errors  float64
+	slow    float64
+	rows    float64
+	tookSum float64 // fractional milliseconds
+	latency latencyHistogram
+
+	// the series of the fingerprint once scraped, kept for as long as the plugin runs so its counters and those of the other series never decrease
+	exposed bool // exposed with its own series
+	folded  bool // summed under the other series of its statement type and database
+}
+
+// errorMetrics are the cumulative errors of a statement type and database by error class
+type errorMetrics struct {
+	Type     statType
+	Database string
+	Class    string
+	count    float64
+}
+
+// newCumulativeMetrics creates empty cumulative metrics
+func newCumulativeMetrics() *cumulativeMetrics {
+	return &cumulativeMetrics{
+		fingerprints: make(map[string]*fingerprintMetrics, 10),
+		errors:       make(map[string]*errorMetrics, 1),
+	}
+}
+
+// add adds the stat to the metrics of its fingerprint, or to the other fingerprints of its type and database once maxFingerprints are tracked
+func (m *cumulativeMetrics) add(statValue *stat, maxFingerprints int) {
+	key := statValue.Type.String() + "/" + statValue.Database + "/" + statValue.KeyHash
+	metrics, ok := m.fingerprints[key]
+	if !ok {
+		keyHash, table := statValue.KeyHash, statValue.Table
+		if len(m.fingerprints) >= maxFingerprints {
+			// too many fingerprints, count it with the others
+			keyHash, table = _metricsOtherHash, ""
+			key = statValue.Type.String() + "/" + statValue.Database + "/" + keyHash
+			metrics, ok = m.fingerprints[key]
+		}
+		if !ok {
+			metrics = &fingerprintMetrics{Type: statValue.Type, Database: statValue.Database, KeyHash: keyHash, Table: table}
+			m.fingerprints[key] = metrics
+		}
+	}
+
+	weight := statValue.weight()
+	metrics.count += weight
+	metrics.tookSum += statValue.Took * weight
+	metrics.latency.add(statValue.Took, weight)
+	if statValue.Slow {
+		metrics.slow += weight
+	}
+	if !statValue.Error {
+		metrics.rows += float64(statValue.Rows) * weight
+		return
+	}
+	metrics.errors += weight
+
+	errorKey := statValue.Type.String() + "/" + statValue.Database + "/" + statValue.ErrorClass
+	errorValue, ok := m.errors[errorKey]
+	if !ok {
+		errorValue = &errorMetrics{Type: statValue.Type, Database: statValue.Database, Class: statValue.ErrorClass}
+		m.errors[errorKey] = errorValue
+	}
+	errorValue.count += weight
+}
+
+// key returns the type/database/keyHash key of the fingerprint
+func (f *fingerprintMetrics) key() string {
+	return f.Type.String() + "/" + f.Database + "/" + f.KeyHash
+}
+
+// key returns the type/database/class key of the errors
+func (e *errorMetrics) key() string {
+	return e.Type.String() + "/" + e.Database + "/" + e.Class
+}
+
+// merge adds the metrics of the other fingerprint
+func (f *fingerprintMetrics) merge(other *fingerprintMetrics) {
+	f.count += other.count
+	f.errors += other.errors
+	f.slow += other.slow
+	f.rows += other.rows
+	f.tookSum += other.tookSum
+	for idx, count := range other.latency {
+		f.latency[idx] += count
+	}
+}
+
+// metricsSnapshot is a copy of the metrics taken while holding statsLock, to be written without it
+type metricsSnapshot struct {
+	fingerprints []*fingerprintMetrics
+	errors       []*errorMetrics
+	dropped      [3]int64 // stats, transaction stats, repetitions
+	depth        [3]int
+	capacity     [3]int
+}
+
+// assignSeries decides the series of the fingerprints not scraped before: those with the most total execution time are exposed with their own series until topN are, the others
+// are summed under the other series of their statement type and database. Fingerprints keep their series once decided, moving one between its own series and the other
+// series would make both counters decrease, which Prometheus reads as counter resets
+func (m *cumulativeMetrics) assignSeries(topN int) {
+	unassigned := make([]*fingerprintMetrics, 0, 10)
+	for _, metrics := range m.fingerprints {
+		if metrics.exposed || metrics.folded {
+			continue
+		}
+		if metrics.KeyHash == _metricsOtherHash {
+			// the fingerprints beyond the tracked fingerprints are always summed
+			metrics.folded = true
+			continue
+		}
+		unassigned = append(unassigned, metrics)
+	}
+	sort.Slice(unassigned, func(i, j int) bool {
+		a, b := unassigned[i], unassigned[j]
+		if a.tookSum != b.tookSum {
+			return a.tookSum > b.tookSum
+		}
+		return a.key() < b.key()
+	})
+	for _, metrics := range unassigned {
+		if m.exposed < topN {
+			metrics.exposed = true
+			m.exposed++
+			continue
+		}
+		metrics.folded = true
+	}
+}
+
+// metricsSnapshot returns a copy of the current metrics, exposing the fingerprints with their own series and summing the others per statement type and database, see assignSeries
+func (s *SQLInsights) metricsSnapshot(topN int) *metricsSnapshot {
+	s.statsLock.Lock()
+	s.metrics.assignSeries(topN)
+	snapshot := &metricsSnapshot{
+		fingerprints: make([]*fingerprintMetrics, 0, len(s.metrics.fingerprints)),
+		errors:       make([]*errorMetrics, 0, len(s.metrics.errors)),
+		dropped: [3]int64{
+			s.metrics.droppedStats + s.droppedStats.Load(),
+			s.metrics.droppedTxStats + s.droppedTxStats.Load(),
+			s.metrics.droppedRepetitions + s.droppedRepetitions.Load(),
+		},
+	}
+	for _, metrics := range s.metrics.fingerprints {
+		metricsCopy := *metrics
+		snapshot.fingerprints = append(snapshot.fingerprints, &metricsCopy)
+	}
+	for _, errorValue := range s.metrics.errors {
+		errorCopy := *errorValue
+		snapshot.errors = append(snapshot.errors, &errorCopy)
+	}
+	s.statsLock.Unlock()
+
+	snapshot.depth = [3]int{s.statsQueue.len(), len(s.txStatsChan), len(s.repetitionsChan)}
+	snapshot.capacity = [3]int{s.statsQueue.size(), cap(s.txStatsChan), cap(s.repetitionsChan)}
+
+	// sum the folded fingerprints per statement type and database, listing the fingerprints with the most execution time first, ties in a stable order
+	exposed := make([]*fingerprintMetrics, 0, min(len(snapshot.fingerprints), topN+1))
+	others := make(map[string]*fingerprintMetrics, 1)
+	for _, metrics := range snapshot.fingerprints {
+		if metrics.exposed {
+			exposed = append(exposed, metrics)
+			continue
+		}
+		otherKey := metrics.Type.String() + "/" + metrics.Database
+		other, ok := others[otherKey]
+		if !ok {
+			other = &fingerprintMetrics{Type: metrics.Type, Database: metrics.Database, KeyHash: _metricsOtherHash}
+			others[otherKey] = other
+		}
+		other.merge(metrics)
+	}
+	sort.Slice(exposed, func(i, j int) bool {
+		a, b := exposed[i], exposed[j]
+		if a.tookSum != b.tookSum {
+			return a.tookSum > b.tookSum
+		}
+		return a.key() < b.key()
+	})
+	otherValues := make([]*fingerprintMetrics, 0, len(others))
+	for _, other := range others {
+		otherValues = append(otherValues, other)
+	}
+	sort.Slice(otherValues, func(i, j int) bool {
+		return otherValues[i].key() < otherValues[j].key()
+	})
+	snapshot.fingerprints = append(exposed, otherValues...)
+
+	sort.Slice(snapshot.errors, func(i, j int) bool {
+		a, b := snapshot.errors[i], snapshot.errors[j]
+		return a.key() < b.key()
+	})
+	return snapshot
+}
+
+// metricsHandler handles Prometheus scrapes of the metrics, in the OpenMetrics format when accepted by the scraper, otherwise in the Prometheus text format
+func (s *SQLInsights) metricsHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+		mw := &metricsWriter{openMetrics: openMetrics}
+		s.writeMetrics(mw, s.metricsSnapshot(s.config.MetricsTopN))
+
+		if openMetrics {
+			w.Header().Set("Content-Type", _metricsContentTypeOpenMetrics)
+		} else {
+			w.Header().Set("Content-Type", _metricsContentTypeText)
+		}
+		_, _ = w.Write(mw.buf.Bytes())
+	}
+}
+
+// writeMetrics writes all metric families of the snapshot
+func (s *SQLInsights) writeMetrics(mw *metricsWriter, snapshot *metricsSnapshot) {
+	instanceID := s.config.InstanceID
+	fingerprintLabels := func(metrics *fingerprintMetrics) []string {
+		return []string{"instance_id", instanceID, "database", metrics.Database, "type", metrics.Type.String(), "hash", metrics.KeyHash, "table", metrics.Table}
+	}
+
+	mw.family("statements", "counter", "Statements executed, estimated from the sampled statements when sampling")
+	for _, metrics := range snapshot.fingerprints {
+		mw.sample("statements_total", fingerprintLabels(metrics), math.Round(metrics.count))
+	}
+	mw.family("slow_statements", "counter", "Statements at or above their slow threshold")
+	for _, metrics := range snapshot.fingerprints {
+		mw.sample("slow_statements_total", fingerprintLabels(metrics), math.Round(metrics.slow))
+	}
+	mw.family("statement_errors", "counter", "Statements that returned an error")
+	for _, metrics := range snapshot.fingerprints {
+		mw.sample("statement_errors_total", fingerprintLabels(metrics), math.Round(metrics.errors))
+	}
+	mw.family("statement_rows", "counter", "Rows affected or returned by successful statements")
+	for _, metrics := range snapshot.fingerprints {
+		mw.sample("statement_rows_total", fingerprintLabels(metrics), math.Round(metrics.rows))
+	}
+
+	mw.family("statement_duration_seconds", "histogram", "Statement execution duration in seconds")
+	for _, metrics := range snapshot.fingerprints {
+		labels := fingerprintLabels(metrics)
+		cumulative := 0.0
+		for idx, bound := range _latencyBucketBounds {
+			cumulative += metrics.latency[idx]
+			mw.sample("statement_duration_seconds_bucket", append(labels, "le", formatMetricValue(bound/1000)), math.Round(cumulative))
+		}
+		mw.sample("statement_duration_seconds_bucket", append(labels, "le", "+Inf"), math.Round(metrics.count))
+		mw.sample("statement_duration_seconds_sum", labels, metrics.tookSum/1000)
+		mw.sample("statement_duration_seconds_count", labels, math.Round(metrics.count))
+	}
+
+	mw.family("errors", "counter", "Statement errors by error class")
+	for _, errorValue := range snapshot.errors {
+		mw.sample("errors_total", []string{"instance_id", instanceID, "database", errorValue.Database, "type", errorValue.Type.String(), "class", errorValue.Class}, math.Round(errorValue.count))
+	}
+
+	buffers := [3]string{"stats", "tx_stats", "repetitions"}
+	mw.family("buffer_depth", "gauge", "Statistics waiting in the buffer for the collector")
+	for idx, buffer := range buffers {
+		mw.sample("buffer_depth", []string{"instance_id", instanceID, "buffer", buffer}, float64(snapshot.depth[idx]))
+	}
+	mw.family("buffer_capacity", "gauge", "Capacity of the statistics buffer")
+	for idx, buffer := range buffers {
+		mw.sample("buffer_capacity", []string{"instance_id", instanceID, "buffer", buffer}, float64(snapshot.capacity[idx]))
+	}
+	mw.family("dropped", "counter", "Statistics dropped by the backpressure policy")
+	for idx, buffer := range buffers {
+		mw.sample("dropped_total", []string{"instance_id", instanceID, "buffer", buffer}, float64(snapshot.dropped[idx]))
+	}
+	mw.end()
+}
+
+// metricsWriter writes metric families in the Prometheus text or OpenMetrics exposition format
+type metricsWriter struct {
+	buf         bytes.Buffer
+	openMetrics bool
+}
+
+// family writes the metadata of a metric family. Counter families are named without their _total suffix, which the Prometheus text format expects on the metadata as well
+func (mw *metricsWriter) family(name, metricType, help string) {
+	if metricType == "counter" && !mw.openMetrics {
+		name += "_total"
+	}
+	mw.buf.WriteString("# HELP " + _metricsPrefix + name + " " + help + "\n")
+	mw.buf.WriteString("# TYPE " + _metricsPrefix + name + " " + metricType + "\n")
+}
+
+// sample writes a sample with the specified label name and value pairs
+func (mw *metricsWriter) sample(name string, labels []string, value float64) {
+	mw.buf.WriteString(_metricsPrefix + name)
+	for idx := 0; idx+1 < len(labels); idx += 2 {
+		if idx == 0 {
+			mw.buf.WriteByte('{')
+		} else {
+			mw.buf.WriteByte(',')
+		}
+		mw.buf.WriteString(labels[idx] + `="` + escapeLabelValue(labels[idx+1]) + `"`)
+	}
+	if len(labels) > 1 {
+		mw.buf.WriteByte('}')
+	}
+	mw.buf.WriteString(" " + formatMetricValue(value) + "\n")
+}
+
+// end terminates the exposition, required by the OpenMetrics format
+func (mw *metricsWriter) end() {
+	if mw.openMetrics {
+		mw.buf.WriteString("# EOF\n")
+	}
+}
+
+// _labelValueEscaper escapes label values as required by both exposition formats
+var _labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue escapes backslashes, double quotes, and line feeds in the label value
+func escapeLabelValue(value string) string {
+	return _labelValueEscaper.Replace(value)
+}
+
+// formatMetricValue formats the value as expected by both exposition formats
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
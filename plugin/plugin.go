@@ -7,10 +7,18 @@ import (
 )
 
 const (
-	_eventBeforeQuery = "gorm-SQLInsights:before_query"
-	_eventAfterQuery  = "gorm-SQLInsights:after_query"
-	_eventBeforeRaw   = "gorm-SQLInsights:before_raw"
-	_eventAfterRaw    = "gorm-SQLInsights:after_raw"
+	_eventBeforeQuery  = "gorm-SQLInsights:before_query"
+	_eventAfterQuery   = "gorm-SQLInsights:after_query"
+	_eventBeforeRaw    = "gorm-SQLInsights:before_raw"
+	_eventAfterRaw     = "gorm-SQLInsights:after_raw"
+	_eventBeforeCreate = "gorm-SQLInsights:before_create"
+	_eventAfterCreate  = "gorm-SQLInsights:after_create"
+	_eventBeforeUpdate = "gorm-SQLInsights:before_update"
+	_eventAfterUpdate  = "gorm-SQLInsights:after_update"
+	_eventBeforeDelete = "gorm-SQLInsights:before_delete"
+	_eventAfterDelete  = "gorm-SQLInsights:after_delete"
+	_eventBeforeRow    = "gorm-SQLInsights:before_row"
+	_eventAfterRow     = "gorm-SQLInsights:after_row"
 )
 
 var (
@@ -23,21 +31,46 @@ func (s *SQLInsights) Name() string {
 	return "SQLInsights"
 }
 
-// Initialize initializes the plugin with the specified Gorm DB instance
+// Initialize initializes the plugin with the specified Gorm DB instance, recording its statements with an empty database name. Use Database to name the database
 func (s *SQLInsights) Initialize(db *gorm.DB) (err error) {
+	return s.initialize("", db)
+}
+
+// initialize initializes the plugin with the specified Gorm DB instance, recording its statements under the specified database name
+func (s *SQLInsights) initialize(database string, db *gorm.DB) (err error) {
 	if db == nil {
 		return gorm.ErrInvalidDB
 	}
 
 	// store the DB instance we've initialized with
-	s._db = db
+	s.statsLock.Lock()
+	s.databases = append(s.databases, &monitoredDB{name: database, db: db})
+	s.statsLock.Unlock()
+
+	// name the connection pool of the DB instance as our source and sample its statistics with every report
+	if sqlDB, err := db.DB(); err == nil {
+		s.registerConnection(database, ConnectionSource, sqlDB)
+	}
+
+	if s.config.CollectTransactions {
+		// wrap the connection pool so we can track transactions started through it
+		s.wrapConnPool(db)
+	}
 
 	// Register our callbacks in the provided gorm DB instance
 	for _, e := range []error{
 		db.Callback().Query().Before("gorm:query").Register(_eventBeforeQuery, s.insightsBefore(_statTypeQuery)),
-		db.Callback().Query().After("gorm:query").Register(_eventAfterQuery, s.insightsAfter(_statTypeQuery)),
+		db.Callback().Query().After("gorm:query").Register(_eventAfterQuery, s.insightsAfter(database, _statTypeQuery)),
 		db.Callback().Raw().Before("gorm:raw").Register(_eventBeforeRaw, s.insightsBefore(_statTypeRaw)),
-		db.Callback().Raw().After("gorm:raw").Register(_eventAfterRaw, s.insightsAfter(_statTypeRaw)),
+		db.Callback().Raw().After("gorm:raw").Register(_eventAfterRaw, s.insightsAfter(database, _statTypeRaw)),
+		db.Callback().Create().Before("gorm:create").Register(_eventBeforeCreate, s.insightsBefore(_statTypeCreate)),
+		db.Callback().Create().After("gorm:create").Register(_eventAfterCreate, s.insightsAfter(database, _statTypeCreate)),
+		db.Callback().Update().Before("gorm:update").Register(_eventBeforeUpdate, s.insightsBefore(_statTypeUpdate)),
+		db.Callback().Update().After("gorm:update").Register(_eventAfterUpdate, s.insightsAfter(database, _statTypeUpdate)),
+		db.Callback().Delete().Before("gorm:delete").Register(_eventBeforeDelete, s.insightsBefore(_statTypeDelete)),
+		db.Callback().Delete().After("gorm:delete").Register(_eventAfterDelete, s.insightsAfter(database, _statTypeDelete)),
+		db.Callback().Row().Before("gorm:row").Register(_eventBeforeRow, s.insightsBefore(_statTypeRow)),
+		db.Callback().Row().After("gorm:row").Register(_eventAfterRow, s.insightsAfter(database, _statTypeRow)),
 	} {
 		if e != nil {
 			return e
@@ -46,25 +79,50 @@ func (s *SQLInsights) Initialize(db *gorm.DB) (err error) {
 	return nil
 }
 
-// unregister this plugin from the specified Gorm DB instance
+// unregister this plugin from all Gorm DB instances it was initialized with
 func (s *SQLInsights) unregister() (err error) {
-	if s._db == nil {
+	s.statsLock.Lock()
+	databases := s.databases
+	s.databases = nil
+	s.statsLock.Unlock()
+	if len(databases) == 0 {
 		return gorm.ErrInvalidDB
 	}
 
 	// stop the plugin and flush all data to the DB
 	s.Stop(s.config.StopTimeLimit)
 
+	for _, database := range databases {
+		if e := s.unregisterDB(database.db); e != nil {
+			return e
+		}
+	}
+	return
+}
+
+// unregisterDB removes our callbacks from the specified Gorm DB instance
+func (s *SQLInsights) unregisterDB(db *gorm.DB) error {
 	// Unregister our callbacks from the stored gorm DB instance we received during initialization
 	for _, e := range []error{
-		s._db.Callback().Query().Remove(_eventBeforeQuery),
-		s._db.Callback().Query().Remove(_eventAfterQuery),
-		s._db.Callback().Raw().Remove(_eventBeforeRaw),
-		s._db.Callback().Raw().Remove(_eventAfterRaw),
+		db.Callback().Query().Remove(_eventBeforeQuery),
+		db.Callback().Query().Remove(_eventAfterQuery),
+		db.Callback().Raw().Remove(_eventBeforeRaw),
+		db.Callback().Raw().Remove(_eventAfterRaw),
+		db.Callback().Create().Remove(_eventBeforeCreate),
+		db.Callback().Create().Remove(_eventAfterCreate),
+		db.Callback().Update().Remove(_eventBeforeUpdate),
+		db.Callback().Update().Remove(_eventAfterUpdate),
+		db.Callback().Delete().Remove(_eventBeforeDelete),
+		db.Callback().Delete().Remove(_eventAfterDelete),
+		db.Callback().Row().Remove(_eventBeforeRow),
+		db.Callback().Row().Remove(_eventAfterRow),
 	} {
 		if e != nil {
 			return e
 		}
 	}
-	return
+
+	// restore the original connection pool if we wrapped it
+	s.unwrapConnPool(db)
+	return nil
 }
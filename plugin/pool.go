@@ -0,0 +1,41 @@
+package insights
+
+import (
+	"database/sql"
+)
+
+// unsafeBuildPoolHistory samples the statistics of the connection pools of the monitored DBs, returning the gauges as of now and the counters as deltas since the previous sample.
+// Returns nil if there are no monitored connection pools. It is not thread safe and assumes statsLock is already locked
+func (s *SQLInsights) unsafeBuildPoolHistory(bucket reportBucket) []*SQLInsightsPoolHistory {
+	if len(s.connections) == 0 {
+		return nil
+	}
+	poolHistory := make([]*SQLInsightsPoolHistory, 0, len(s.connections))
+	for _, conn := range s.connections {
+		current := conn.sqlDB.Stats()
+		last := conn.lastStats
+		if last == nil {
+			// first sample, the counters so far are our delta
+			last = &sql.DBStats{}
+		}
+		conn.lastStats = &current
+
+		poolHistory = append(poolHistory, &SQLInsightsPoolHistory{
+			InstanceID:         s.instanceAppID,
+			CreatedAt:          bucket.Start,
+			EndedAt:            bucket.End,
+			Database:           conn.database,
+			Connection:         conn.name,
+			MaxOpenConnections: current.MaxOpenConnections,
+			OpenConnections:    current.OpenConnections,
+			InUse:              current.InUse,
+			Idle:               current.Idle,
+			WaitCount:          current.WaitCount - last.WaitCount,
+			WaitDuration:       durationMilliseconds(current.WaitDuration - last.WaitDuration),
+			MaxIdleClosed:      current.MaxIdleClosed - last.MaxIdleClosed,
+			MaxIdleTimeClosed:  current.MaxIdleTimeClosed - last.MaxIdleTimeClosed,
+			MaxLifetimeClosed:  current.MaxLifetimeClosed - last.MaxLifetimeClosed,
+		})
+	}
+	return poolHistory
+}
@@ -0,0 +1,128 @@
+package insights
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// _statsPollInterval is how often the collector checks the stats queue when it has not been woken up by a filling queue
+	_statsPollInterval = 10 * time.Millisecond
+
+	// _maxCachedKeyHashes is the maximum number of statement hashes cached by the collector before the cache is reset
+	_maxCachedKeyHashes = 10000
+)
+
+var (
+	// _statPool pools stat values so recording a statement does not allocate once warmed up
+	_statPool = sync.Pool{
+		New: func() any {
+			return &stat{}
+		},
+	}
+)
+
+// newStat returns a reset stat value from the pool
+func newStat() *stat {
+	return _statPool.Get().(*stat)
+}
+
+// releaseStat resets the stat value and returns it to the pool, keeping the capacity of its caller program counters
+func releaseStat(statValue *stat) {
+	*statValue = stat{pcs: statValue.pcs[:0]}
+	_statPool.Put(statValue)
+}
+
+// statQueue is a bounded lock-free multi-producer multi-consumer ring buffer of stat values, based on Dmitry Vyukov's bounded MPMC queue.
+// Statements push their stat values without locking or allocating and the collector pops them while holding statsLock. Statements may also pop the oldest stat values to make room with the BackpressureDropOldest policy
+type statQueue struct {
+	mask  uint64
+	slots []statQueueSlot
+	_     [56]byte // keep head and tail on their own cache lines
+	head  atomic.Uint64
+	_     [56]byte
+	tail  atomic.Uint64
+	_     [56]byte
+}
+
+// statQueueSlot is a single slot of the ring buffer. The sequence tells producers and the consumer whose turn it is to use the slot
+type statQueueSlot struct {
+	seq   atomic.Uint64
+	value *stat
+}
+
+// newStatQueue creates a new stat queue holding at least the specified number of stat values, rounded up to a power of two. The sequence of a slot can only tell its turns apart with at least two slots
+func newStatQueue(size int) *statQueue {
+	capacity := 2
+	for capacity < size {
+		capacity <<= 1
+	}
+	q := &statQueue{
+		mask:  uint64(capacity - 1),
+		slots: make([]statQueueSlot, capacity),
+	}
+	for idx := range q.slots {
+		q.slots[idx].seq.Store(uint64(idx))
+	}
+	return q
+}
+
+// push adds the stat value to the queue, returning false if the queue is full
+func (q *statQueue) push(statValue *stat) bool {
+	for {
+		pos := q.tail.Load()
+		slot := &q.slots[pos&q.mask]
+		seq := slot.seq.Load()
+		switch diff := int64(seq) - int64(pos); {
+		case diff == 0:
+			// the slot is free, claim it
+			if q.tail.CompareAndSwap(pos, pos+1) {
+				slot.value = statValue
+				slot.seq.Store(pos + 1)
+				return true
+			}
+		case diff < 0:
+			// the slot has not been consumed yet, we are full
+			return false
+		}
+		// another producer claimed the slot, try again
+	}
+}
+
+// pop removes the oldest stat value from the queue, returning false if the queue is empty
+func (q *statQueue) pop() (*stat, bool) {
+	for {
+		pos := q.head.Load()
+		slot := &q.slots[pos&q.mask]
+		seq := slot.seq.Load()
+		switch diff := int64(seq) - int64(pos+1); {
+		case diff == 0:
+			// the slot has been pushed to, claim it
+			if q.head.CompareAndSwap(pos, pos+1) {
+				statValue := slot.value
+				slot.value = nil
+				slot.seq.Store(pos + q.mask + 1)
+				return statValue, true
+			}
+		case diff < 0:
+			// nothing has been pushed to this slot yet, we are empty
+			return nil, false
+		}
+		// another consumer claimed the slot, try again
+	}
+}
+
+// len returns the approximate number of stat values in the queue
+func (q *statQueue) len() int {
+	head, tail := q.head.Load(), q.tail.Load()
+	if tail <= head {
+		return 0
+	}
+	return int(tail - head)
+}
+
+// size returns the capacity of the queue
+func (q *statQueue) size() int {
+	return len(q.slots)
+}
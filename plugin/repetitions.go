@@ -0,0 +1,252 @@
+package insights
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// _unitOfWorkCallerDepth is the caller depth collected for statements executed in a unit of work when caller collection is otherwise disabled
+	_unitOfWorkCallerDepth = 5
+)
+
+var (
+	// _equalityBindRegex matches a single column equality condition against a bind variable, such as `"users"."id" = $1` or `user_id = ?`
+	_equalityBindRegex = regexp.MustCompile("([\\w\"`.]+)\\s*=\\s*(\\?|\\$\\d+)")
+)
+
+// unitOfWorkContextKey is the context key used to store the unit of work
+type unitOfWorkContextKey struct{}
+
+// unitOfWork counts executions per statement within a single request, job, or other unit of work
+type unitOfWork struct {
+	lock       sync.Mutex
+	s          *SQLInsights
+	statements map[string]*unitOfWorkStatement // key -> statement executions
+	labels     map[string]string
+	done       bool
+}
+
+// unitOfWorkStatement tracks the executions of a single statement within a unit of work
+type unitOfWorkStatement struct {
+	Type    statType
+	NumVars int
+	Count   int
+	Callers []*callerInfo // callers of the execution reaching the repetition threshold
+}
+
+// repetitionStat defines a statement that was repeated within a single unit of work at or above the repetition threshold
+type repetitionStat struct {
+	TimeStamp   time.Time
+	Type        statType
+	Key         string
+	KeyHash     string
+	NumVars     int
+	Repetitions int
+	Callers     []*callerInfo
+	CallerHash  string
+	CallerJSON  []byte
+	Labels      string
+	LabelSet    map[string]string
+}
+
+// groupKey returns the key used to aggregate this repetition, the key hash plus caller hash and labels so loops hit from different routes are reported apart
+func (r *repetitionStat) groupKey() string {
+	key := r.KeyHash
+	if r.CallerHash != "" {
+		key += "#" + r.CallerHash
+	}
+	if r.Labels != "" {
+		key += "?" + r.Labels
+	}
+	return key
+}
+
+// WithUnitOfWork returns a copy of ctx marking a unit of work, such as a single request or job, and a function to call when the unit of work has completed.
+// Statements executed with the returned context, through db.WithContext(ctx), are counted and statements repeated at or above Config.RepetitionThreshold times are reported as N+1 findings when done is called
+func WithUnitOfWork(ctx context.Context) (context.Context, func()) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	uow := &unitOfWork{
+		statements: make(map[string]*unitOfWorkStatement, 10),
+		labels:     LabelsFromContext(ctx),
+	}
+	return context.WithValue(ctx, unitOfWorkContextKey{}, uow), uow.finish
+}
+
+// unitOfWorkFromContext returns the unit of work for the context, or nil if there is none
+func unitOfWorkFromContext(ctx context.Context) *unitOfWork {
+	if ctx == nil {
+		return nil
+	}
+	uow, _ := ctx.Value(unitOfWorkContextKey{}).(*unitOfWork)
+	return uow
+}
+
+// record counts an execution of the statement in this unit of work, returning the number of executions so far, zero once the unit of work finished
+func (u *unitOfWork) record(s *SQLInsights, sType statType, key string, numVars int) int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.done {
+		return 0
+	}
+	if u.s == nil {
+		u.s = s
+	}
+	if statement, ok := u.statements[key]; ok {
+		statement.Count++
+		return statement.Count
+	}
+	u.statements[key] = &unitOfWorkStatement{
+		Type:    sType,
+		NumVars: numVars,
+		Count:   1,
+	}
+	return 1
+}
+
+// setCallers sets the callers of the execution reaching the repetition threshold
+func (u *unitOfWork) setCallers(key string, callers []*callerInfo) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if statement, ok := u.statements[key]; ok {
+		statement.Callers = callers
+	}
+}
+
+// countUnitOfWork counts an execution of the statement in the unit of work of the context, if any. Counting needs neither the clock nor the stack, the callers are only collected by the execution reaching the repetition threshold to report where a loop originates. Callers already collected for the execution are reused
+func (s *SQLInsights) countUnitOfWork(ctx context.Context, sType statType, key string, numVars int, callers []*callerInfo) {
+	uow := unitOfWorkFromContext(ctx)
+	if uow == nil {
+		return
+	}
+	if uow.record(s, sType, key, numVars) != s.config.RepetitionThreshold {
+		return
+	}
+	if callers == nil {
+		callers = s.getCallers(max(s.config.CollectCallerDepth, _unitOfWorkCallerDepth))
+	}
+	uow.setCallers(key, callers)
+}
+
+// finish completes the unit of work, reporting statements repeated at or above the repetition threshold. Only the first call has any effect
+func (u *unitOfWork) finish() {
+	u.lock.Lock()
+	if u.done || u.s == nil {
+		// already finished, or no statements were recorded
+		u.done = true
+		u.lock.Unlock()
+		return
+	}
+	u.done = true
+	now := time.Now().UTC()
+	var findings []*repetitionStat
+	for key, statement := range u.statements {
+		if statement.Count < u.s.config.RepetitionThreshold {
+			continue
+		}
+		findings = append(findings, &repetitionStat{
+			TimeStamp:   now,
+			Type:        statement.Type,
+			Key:         key,
+			NumVars:     statement.NumVars,
+			Repetitions: statement.Count,
+			Callers:     statement.Callers,
+			LabelSet:    u.labels,
+		})
+	}
+	clear(u.statements)
+	u.lock.Unlock()
+
+	// report outside of our lock, adding a finding may block on a full buffer
+	for _, finding := range findings {
+		u.s.insightsAddRepetition(finding)
+	}
+}
+
+// insightsAddRepetition adds a repetition finding to be collected by the background collector
+func (s *SQLInsights) insightsAddRepetition(repValue *repetitionStat) {
+	if repValue == nil || repValue.Key == "" {
+		return
+	}
+
+	// create hash of the key (parameterized SQL statement) and callers
+	repValue.KeyHash = hash(repValue.Key)
+	repValue.CallerJSON, repValue.CallerHash = s.hashCallers(repValue.Callers)
+	repValue.Labels = s.encodeLabels(repValue.LabelSet)
+
+	// send to the repetition channel, applying our backpressure policy if the buffer is full
+	s.droppedRepetitions.Add(sendWithBackpressure(s, s.repetitionsChan, repValue))
+}
+
+// unsafeAddRepetition stores the repetition finding in the repetitions table. It is not thread safe and assumes statsLock is already locked
+func (s *SQLInsights) unsafeAddRepetition(repValue *repetitionStat) {
+	if repValue.KeyHash == "" {
+		return
+	}
+	repValue.Labels = s.unsafeBoundLabels(repValue.Labels)
+	groupKey := repValue.groupKey()
+	if _, ok := s.repetitions[groupKey]; !ok {
+		s.repetitions[groupKey] = make([]*repetitionStat, 0, 10)
+	}
+	s.repetitions[groupKey] = append(s.repetitions[groupKey], repValue)
+}
+
+// buildRepetitionHistory builds a repetition history from the specified list of repetition findings which all share the same statement, caller, and labels
+func (s *SQLInsights) buildRepetitionHistory(bucket reportBucket, repValues []*repetitionStat) *SQLInsightsRepetitionHistory {
+	if len(repValues) <= 0 {
+		return nil
+	}
+	repHistory := &SQLInsightsRepetitionHistory{
+		InstanceID:  s.instanceAppID,
+		CreatedAt:   bucket.Start,
+		EndedAt:     bucket.End,
+		HashID:      repValues[0].KeyHash,
+		CallerHash:  repValues[0].CallerHash,
+		Type:        repValues[0].Type,
+		Labels:      repValues[0].Labels,
+		Occurrences: len(repValues),
+	}
+	for _, repValue := range repValues {
+		repHistory.RepetitionsSum += repValue.Repetitions
+		if repValue.Repetitions > repHistory.RepetitionsMax {
+			repHistory.RepetitionsMax = repValue.Repetitions
+		}
+	}
+	return repHistory
+}
+
+// suggestBatching returns a suggestion for replacing repeated executions of the statement with a batched alternative
+func suggestBatching(sType statType, statement string, repetitions int) string {
+	switch sType {
+	case _statTypeCreate:
+		return fmt.Sprintf("%d inserts were executed one at a time, create all records at once with a single Create of a slice or CreateInBatches", repetitions)
+	case _statTypeUpdate, _statTypeDelete:
+		if column := singleEqualityColumn(statement); column != "" {
+			return fmt.Sprintf("%d %ss were executed one at a time, use a single %s with %s IN (?) instead", repetitions, sType, sType, column)
+		}
+		return fmt.Sprintf("%d %ss were executed one at a time, use a single %s covering all rows instead", repetitions, sType, sType)
+	}
+	if column := singleEqualityColumn(statement); column != "" {
+		return fmt.Sprintf("%d queries were executed one at a time, load all rows with a single query using %s IN (?) or use Preload to load the association", repetitions, column)
+	}
+	return fmt.Sprintf("%d queries were executed one at a time, batch them into a single query or use Preload to load the association", repetitions)
+}
+
+// singleEqualityColumn returns the column of the only equality condition against a bind variable in the WHERE clause of the statement, or an empty string if there is not exactly one
+func singleEqualityColumn(statement string) string {
+	where := strings.LastIndex(strings.ToUpper(statement), " WHERE ")
+	if where < 0 {
+		return ""
+	}
+	matches := _equalityBindRegex.FindAllStringSubmatch(statement[where:], 2)
+	if len(matches) != 1 {
+		return ""
+	}
+	return matches[0][1]
+}
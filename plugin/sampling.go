@@ -0,0 +1,160 @@
+package insights
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AdaptiveSamplingConfig defines the configuration for adaptive sampling, which lowers the sample rate while the application is under load and raises it back once the load subsides
+type AdaptiveSamplingConfig struct {
+	// MaxQPS is the number of statements per second above which the sample rate is lowered. A value <=0 disables QPS based adjustments
+	MaxQPS float64
+
+	// MaxBufferUtilization is the fraction (0-1] of the statistics buffer that may be in use before the sample rate is lowered. Defaults to 0.5
+	MaxBufferUtilization float64
+
+	// MinSampleRate is the lowest fraction (0-1] adaptive sampling may lower the sample rate to. Defaults to 0.01
+	MinSampleRate float64
+
+	// AdjustInterval is how often the sample rate is adjusted. Defaults to 1 second
+	AdjustInterval time.Duration
+}
+
+// applyDefaults applies default values to the adaptive sampling config if they are not set
+func (c *AdaptiveSamplingConfig) applyDefaults() {
+	if c.MaxBufferUtilization <= 0 || c.MaxBufferUtilization > 1 {
+		c.MaxBufferUtilization = 0.5
+	}
+	if c.MinSampleRate <= 0 || c.MinSampleRate > 1 {
+		c.MinSampleRate = 0.01
+	}
+	if c.AdjustInterval <= 0 {
+		c.AdjustInterval = time.Second
+	}
+}
+
+// sampler decides which statements are recorded
+type sampler struct {
+	rates    map[statType]float64 // configured sample rate per statement type
+	adaptive *AdaptiveSamplingConfig
+
+	multiplier     atomic.Uint64 // adaptive multiplier applied to the configured rates, stored as float64 bits
+	executions     atomic.Uint64 // number of statements executed, used to calculate QPS for adaptive sampling
+	lastExecutions uint64
+	lastAdjust     time.Time
+}
+
+// newSampler creates a new sampler from the specified config
+func newSampler(config *Config) *sampler {
+	ret := &sampler{
+		rates:      make(map[statType]float64, len(statTypes)),
+		adaptive:   config.AdaptiveSampling,
+		lastAdjust: time.Now(),
+	}
+	for _, sType := range statTypes {
+		rate := config.SampleRate
+		if typeRate, ok := config.TypeSampleRates[sType.String()]; ok {
+			rate = typeRate
+		}
+		ret.rates[sType] = normalizeSampleRate(rate)
+	}
+	ret.multiplier.Store(math.Float64bits(1))
+	return ret
+}
+
+// normalizeSampleRate returns the sample rate within (0,1], where a value <=0 means record everything
+func normalizeSampleRate(rate float64) float64 {
+	if rate <= 0 || rate >= 1 {
+		return 1
+	}
+	return rate
+}
+
+// rate returns the current effective sample rate for the statement type
+func (s *sampler) rate(sType statType) float64 {
+	rate, ok := s.rates[sType]
+	if !ok {
+		rate = 1
+	}
+	if s.adaptive != nil {
+		rate *= math.Float64frombits(s.multiplier.Load())
+	}
+	return rate
+}
+
+// sample decides if a statement of the specified type should be recorded, returning the effective sample rate used and the decision
+func (s *sampler) sample(sType statType) (float64, bool) {
+	s.executions.Add(1)
+	rate := s.rate(sType)
+	if rate >= 1 {
+		return 1, true
+	}
+	return rate, rand.Float64() < rate
+}
+
+// adjust recalculates the adaptive multiplier from the current QPS and statistics buffer utilization
+func (s *sampler) adjust(now time.Time, bufferUsed, bufferSize int) {
+	if s.adaptive == nil {
+		return
+	}
+	elapsed := now.Sub(s.lastAdjust).Seconds()
+	executions := s.executions.Load()
+	qps := 0.0
+	if elapsed > 0 {
+		qps = float64(executions-s.lastExecutions) / elapsed
+	}
+	s.lastExecutions = executions
+	s.lastAdjust = now
+
+	// start from the multiplier that would keep us at our max QPS, then reduce further if our buffer is backing up
+	multiplier := 1.0
+	if s.adaptive.MaxQPS > 0 && qps > s.adaptive.MaxQPS {
+		multiplier = s.adaptive.MaxQPS / qps
+	}
+	current := math.Float64frombits(s.multiplier.Load())
+	if bufferSize > 0 && float64(bufferUsed)/float64(bufferSize) > s.adaptive.MaxBufferUtilization {
+		multiplier = math.Min(multiplier, current/2)
+	} else if multiplier > current {
+		// recover gradually so we do not oscillate
+		multiplier = math.Min(multiplier, current*2)
+	}
+	s.multiplier.Store(math.Float64bits(math.Max(multiplier, s.adaptive.MinSampleRate)))
+}
+
+// statementStart is stored on a statement by insightsBefore for insightsAfter
+type statementStart struct {
+	At      time.Time
+	Rate    float64 // effective sample rate when the statement started
+	Sampled bool    // true if the statement was selected by sampling
+	Filter  bool    // true if the filter rules must be evaluated again once the SQL text is built
+	Counted bool    // true if the statement is not timed, only counted in its unit of work, see WithUnitOfWork
+
+	Span    trace.Span      // span of the statement when tracing, see Config.TracerProvider
+	Context context.Context // statement context before the span was started
+}
+
+// keepUnsampled returns true if the statement must be recorded regardless of sampling, errors when configured and slow statements
+func (s *SQLInsights) keepUnsampled(isError, slow bool) bool {
+	return slow || (isError && s.config.SampleKeepErrors)
+}
+
+// isSlow returns true if the statement took at least its slow threshold, the per statement SettingSlowMS directive when set, otherwise SampleKeepSlowerThan
+func (s *SQLInsights) isSlow(took, slowMS float64) bool {
+	if slowMS <= 0 {
+		if s.config.SampleKeepSlowerThan <= 0 {
+			return false
+		}
+		slowMS = durationMilliseconds(s.config.SampleKeepSlowerThan)
+	}
+	return took >= slowMS
+}
+
+// needsUnsampledTiming returns true if unsampled statements must still be timed to apply the error and slow overrides, see Config.SampleKeepErrors and Config.SampleKeepSlowerThan
+func (s *SQLInsights) needsUnsampledTiming() bool {
+	return s.config.SampleKeepErrors || s.config.SampleKeepSlowerThan > 0
+}
@@ -0,0 +1,176 @@
+package insights
+
+import (
+	"math"
+)
+
+const (
+	// _sketchRelativeAccuracy is the maximum relative error of the quantiles estimated by a sketch
+	_sketchRelativeAccuracy = 0.01
+
+	// _sketchMaxBins is the maximum number of bins of a sketch, covering values spanning over 17 orders of magnitude at our relative accuracy. The lowest bins are collapsed beyond this
+	_sketchMaxBins = 2048
+
+	// _sketchMinValue is the smallest value binned by a sketch, smaller values are counted as zero
+	_sketchMinValue = 1e-6
+)
+
+var (
+	// _sketchGamma is the ratio between the upper bounds of consecutive bins
+	_sketchGamma = (1 + _sketchRelativeAccuracy) / (1 - _sketchRelativeAccuracy)
+	// _sketchLogGamma is the natural logarithm of _sketchGamma, used to map values to bins
+	_sketchLogGamma = math.Log(_sketchGamma)
+)
+
+// sketch is a mergeable streaming quantile sketch based on DDSketch. Values are counted in logarithmically sized bins so any quantile can be estimated within _sketchRelativeAccuracy in constant memory.
+// It also keeps the weighted running mean and variance of the values (Welford's algorithm). Bins keep their range when reset so a sketch reused across report intervals does not allocate
+type sketch struct {
+	bins   []float64 // weighted counts, bins[i] counts values in (gamma^(offset+i-1), gamma^(offset+i)]
+	offset int       // bin index of bins[0]
+	zeros  float64   // weighted count of values below _sketchMinValue
+	count  float64   // weighted count of all values
+	min    float64
+	max    float64
+	mean   float64
+	m2     float64 // weighted sum of squared differences from the mean
+}
+
+// add adds the value with the specified weight, the number of values it represents
+func (k *sketch) add(value, weight float64) {
+	if weight <= 0 {
+		weight = 1
+	}
+	if value < 0 || math.IsNaN(value) {
+		value = 0
+	}
+	if k.count == 0 || value < k.min {
+		k.min = value
+	}
+	if k.count == 0 || value > k.max {
+		k.max = value
+	}
+
+	// update the running mean and variance
+	k.count += weight
+	delta := value - k.mean
+	k.mean += delta * weight / k.count
+	k.m2 += weight * delta * (value - k.mean)
+
+	if value < _sketchMinValue {
+		k.zeros += weight
+		return
+	}
+	k.addBin(int(math.Ceil(math.Log(value)/_sketchLogGamma)), weight)
+}
+
+// addBin adds the weight to the bin with the specified index, growing the bins as needed
+func (k *sketch) addBin(idx int, weight float64) {
+	if len(k.bins) == 0 {
+		k.offset = idx
+		k.bins = append(k.bins, weight)
+		return
+	}
+	lo, hi := k.offset, k.offset+len(k.bins)-1
+	if idx >= lo && idx <= hi {
+		k.bins[idx-lo] += weight
+		return
+	}
+	k.resize(min(lo, idx), max(hi, idx))
+	if idx < k.offset {
+		// collapsed into the lowest bin
+		idx = k.offset
+	}
+	k.bins[idx-k.offset] += weight
+}
+
+// resize changes the range of the bins to cover lo through hi, collapsing the lowest bins into a single bin when the range exceeds _sketchMaxBins
+func (k *sketch) resize(lo, hi int) {
+	if hi-lo+1 > _sketchMaxBins {
+		lo = hi - _sketchMaxBins + 1
+	}
+	bins := make([]float64, hi-lo+1)
+	for i, weight := range k.bins {
+		idx := k.offset + i
+		if idx < lo {
+			idx = lo
+		}
+		bins[idx-lo] += weight
+	}
+	k.bins, k.offset = bins, lo
+}
+
+// merge adds all values of the other sketch
+func (k *sketch) merge(other *sketch) {
+	if other.count == 0 {
+		return
+	}
+	if k.count == 0 || other.min < k.min {
+		k.min = other.min
+	}
+	if k.count == 0 || other.max > k.max {
+		k.max = other.max
+	}
+
+	// combine the running means and variances
+	count := k.count + other.count
+	delta := other.mean - k.mean
+	k.m2 += other.m2 + delta*delta*k.count*other.count/count
+	k.mean += delta * other.count / count
+	k.count = count
+
+	k.zeros += other.zeros
+	for i, weight := range other.bins {
+		if weight > 0 {
+			k.addBin(other.offset+i, weight)
+		}
+	}
+}
+
+// quantile returns the estimated value at quantile q (0-1), or 0 if the sketch is empty
+func (k *sketch) quantile(q float64) float64 {
+	if k.count == 0 {
+		return 0
+	}
+	rank := q * k.count
+	cumulative := k.zeros
+	if cumulative > rank {
+		return k.min
+	}
+	for i, weight := range k.bins {
+		cumulative += weight
+		if cumulative > rank {
+			// the midpoint of the bin in relative terms, clamped to the values seen
+			value := 2 * math.Pow(_sketchGamma, float64(k.offset+i)) / (_sketchGamma + 1)
+			return math.Min(math.Max(value, k.min), k.max)
+		}
+	}
+	return k.max
+}
+
+// forEachBin calls fn with the representative value and weighted count of every non empty bin, starting with the values counted as zero
+func (k *sketch) forEachBin(fn func(value, weight float64)) {
+	if k.zeros > 0 {
+		fn(0, k.zeros)
+	}
+	for i, weight := range k.bins {
+		if weight > 0 {
+			// the same representative value quantile estimates use
+			value := 2 * math.Pow(_sketchGamma, float64(k.offset+i)) / (_sketchGamma + 1)
+			fn(math.Min(math.Max(value, k.min), k.max), weight)
+		}
+	}
+}
+
+// stdDev returns the weighted population standard deviation of the values
+func (k *sketch) stdDev() float64 {
+	if k.count == 0 || k.m2 <= 0 {
+		return 0
+	}
+	return math.Sqrt(k.m2 / k.count)
+}
+
+// reset removes all values, keeping the range of the bins
+func (k *sketch) reset() {
+	clear(k.bins)
+	k.zeros, k.count, k.min, k.max, k.mean, k.m2 = 0, 0, 0, 0, 0, 0
+}
@@ -0,0 +1,126 @@
+package insights
+
+import (
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// _slowLogCallerDepth is the minimum number of callers logged with a slow or failed statement
+	_slowLogCallerDepth = 5
+
+	// _maxSlowLogFingerprints is the maximum number of statements whose last log time is remembered for rate limiting, the oldest are forgotten beyond this
+	_maxSlowLogFingerprints = 10000
+)
+
+// slowLogState is the rate limiting state of the slow query log of a statement
+type slowLogState struct {
+	last       time.Time // time of the last logged record
+	suppressed int       // records suppressed since the last logged record
+}
+
+// logsStatements returns true if slow or failed statements are logged, see Config.Logger
+func (s *SQLInsights) logsStatements() bool {
+	return s.config.Logger != nil
+}
+
+// logStatement logs the statement to Config.Logger if it took at least Config.SlowQueryThreshold or failed, at most once per Config.SlowQueryLogInterval per statement
+func (s *SQLInsights) logStatement(db *gorm.DB, start statementStart, database string, sType statType, key string, took float64, now time.Time, isError bool) {
+	duration := time.Duration(took * float64(time.Millisecond))
+	slow := s.config.SlowQueryThreshold > 0 && duration >= s.config.SlowQueryThreshold
+	if !slow && !isError {
+		return
+	}
+
+	// rate limit per statement so a storm of slow queries does not flood the logs
+	suppressed, ok := s.allowStatementLog(key, now)
+	if !ok {
+		return
+	}
+
+	attrs := make([]slog.Attr, 0, 16)
+	attrs = append(attrs,
+		slog.String("hash", hash(key)),
+		slog.String("sql", key),
+		slog.String("type", sType.String()),
+		slog.Duration("duration", duration),
+		slog.Int64("rows", db.RowsAffected),
+	)
+	if database != "" {
+		attrs = append(attrs, slog.String("database", database))
+	}
+	if db.Statement.Table != "" {
+		attrs = append(attrs, slog.String("table", db.Statement.Table))
+	}
+	if isError {
+		class, code := classifyError(db.Error)
+		attrs = append(attrs, slog.String("error", errorMessage(db.Error)), slog.String("error_class", class))
+		if code != "" {
+			attrs = append(attrs, slog.String("error_code", code))
+		}
+	}
+	if callers := s.getCallers(max(s.config.CollectCallerDepth, _slowLogCallerDepth)); len(callers) > 0 {
+		frames := make([]string, len(callers))
+		for idx, caller := range callers {
+			frames[idx] = caller.Function + " " + caller.Filename + ":" + strconv.Itoa(caller.Line)
+		}
+		attrs = append(attrs, slog.Any("callers", frames))
+	}
+	if labels := LabelsFromContext(db.Statement.Context); len(labels) > 0 {
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		labelAttrs := make([]any, 0, len(keys))
+		for _, k := range keys {
+			labelAttrs = append(labelAttrs, slog.String(k, labels[k]))
+		}
+		attrs = append(attrs, slog.Group("labels", labelAttrs...))
+	}
+	if traceID := statementTraceID(db.Statement.Context, start.Span); traceID != "" {
+		attrs = append(attrs, slog.String("trace_id", traceID))
+	}
+	if suppressed > 0 {
+		attrs = append(attrs, slog.Int("suppressed", suppressed))
+	}
+
+	level, msg := slog.LevelWarn, "slow query"
+	if isError {
+		level, msg = slog.LevelError, "query error"
+	}
+	s.config.Logger.LogAttrs(db.Statement.Context, level, msg, attrs...)
+}
+
+// allowStatementLog returns true if a record of the statement may be logged now, along with the number of records suppressed since its last record
+func (s *SQLInsights) allowStatementLog(key string, now time.Time) (int, bool) {
+	s.slowLogLock.Lock()
+	defer s.slowLogLock.Unlock()
+	state, ok := s.slowLog[key]
+	if !ok {
+		if len(s.slowLog) >= _maxSlowLogFingerprints {
+			// too many distinct statements, forget those not logged recently
+			for k, v := range s.slowLog {
+				if now.Sub(v.last) >= s.config.SlowQueryLogInterval {
+					delete(s.slowLog, k)
+				}
+			}
+			if len(s.slowLog) >= _maxSlowLogFingerprints {
+				clear(s.slowLog)
+			}
+		}
+		s.slowLog[key] = &slowLogState{last: now}
+		return 0, true
+	}
+	if now.Sub(state.last) < s.config.SlowQueryLogInterval {
+		state.suppressed++
+		return 0, false
+	}
+	suppressed := state.suppressed
+	state.last, state.suppressed = now, 0
+	return suppressed, true
+}
@@ -1,13 +1,24 @@
 package insights
 
 import (
-	"sort"
+	"math"
 	"time"
 )
 
 var (
-	_statTypeQuery statType = "query"
-	_statTypeRaw   statType = "raw"
+	_statTypeQuery  statType = "query"
+	_statTypeRaw    statType = "raw"
+	_statTypeCreate statType = "create"
+	_statTypeUpdate statType = "update"
+	_statTypeDelete statType = "delete"
+	_statTypeRow    statType = "row"
+
+	// statement types of queries and executions through a wrapped database/sql driver, bypassing GORM
+	_statTypeSQLQuery statType = "sql_query"
+	_statTypeSQLExec  statType = "sql_exec"
+
+	// statTypes is the list of all statement types captured by the plugin
+	statTypes = []statType{_statTypeQuery, _statTypeRaw, _statTypeCreate, _statTypeUpdate, _statTypeDelete, _statTypeRow, _statTypeSQLQuery, _statTypeSQLExec}
 )
 
 type statType string
@@ -18,124 +29,222 @@ func (s statType) String() string {
 
 // stat defines a statistic to be collected, aggregated, and stored
 type stat struct {
-	TimeStamp  time.Time
-	Type       statType
-	Key        string
-	KeyHash    string
-	NumVars    int
-	Took       float64
-	Rows       int64
-	Error      bool
-	Callers    []*callerInfo
-	CallerHash string
-	CallerJSON []byte
+	TimeStamp    time.Time
+	Type         statType
+	Key          string
+	KeyHash      string
+	Table        string // table of the statement, empty when unknown
+	Database     string // database name, see SQLInsights.Database
+	Connection   string // connection the statement was executed on
+	NumVars      int
+	Took         float64
+	Rows         int64
+	Error        bool
+	ErrorClass   string  // error class, see classifyError
+	ErrorCode    string  // driver specific error code
+	ErrorMessage string  // error message, truncated
+	Slow         bool    // true if the statement took at least its slow threshold
+	TraceID      string  // trace ID of a slow statement, see statementTraceID
+	Name         string  // human readable name set with the SettingName directive
+	Weight       float64 // inverse of the sample rate this stat was recorded with, the number of executions it represents
+	Callers      []*callerInfo
+	CallerHash   string
+	CallerJSON   []byte
+	Labels       string            // encoded labels this stat is aggregated by
+	LabelSet     map[string]string // labels from the statement context, encoded into Labels before collection
+
+	pcs []uintptr // program counters of the callers captured when the statement executed, resolved into Callers by the collector
 }
 
-// buildStatHistory builds a stat history from the specified list stat values
-func (s *SQLInsights) buildStatHistory(now time.Time, keyHash string, sType statType, statValues []*stat) (*SQLInsightsHistory, []*SQLInsightsCallerHistory) {
-	if len(statValues) <= 0 {
-		return nil, nil
+// groupKey returns the key used to aggregate this stat within its statement type, the key hash plus database, connection, caller, and labels
+func (s *stat) groupKey() string {
+	key := s.KeyHash
+	if s.Database != "" || s.Connection != "" {
+		key += "@" + s.Database + "/" + s.Connection
 	}
-
-	// build the stat and caller history (if enabled)
-	callerHistory := make([]*SQLInsightsCallerHistory, 0, 5)
-	callerHashMap := make(map[string]struct{}, 5)
-	statHistory := &SQLInsightsHistory{
-		InstanceID: s.instanceAppID,
-		CreatedAt:  now,
-		HashID:     keyHash,
-		Type:       sType,
-		Count:      len(statValues),
-		TookMin:    -1,
-		RowsMin:    -1,
+	if s.CallerHash != "" {
+		key += "#" + s.CallerHash
 	}
-	// calculate the min, max, avg, and sum
-	tookValues := make([]float64, 0, len(statValues))
-	rowValues := make([]int64, 0, len(statValues))
-	for _, statValue := range statValues {
-		if statValue.Error {
-			// increment the error count, skip the rest
-			statHistory.Errors++
-		} else {
-			// collect raw values for median calculations
-			tookValues = append(tookValues, statValue.Took)
-			rowValues = append(rowValues, statValue.Rows)
-
-			// Min/Max
-			if statHistory.TookMin < 0 || statValue.Took < statHistory.TookMin {
-				statHistory.TookMin = statValue.Took
-			}
-			if statValue.Took > statHistory.TookMax {
-				statHistory.TookMax = statValue.Took
-			}
-			if statHistory.RowsMin < 0 || statValue.Rows < statHistory.RowsMin {
-				statHistory.RowsMin = statValue.Rows
-			}
-			if statValue.Rows > statHistory.RowsMax {
-				statHistory.RowsMax = statValue.Rows
-			}
-
-			// Sums
-			statHistory.TookSum += statValue.Took
-			statHistory.RowsSum += statValue.Rows
-		}
-		if statValue.CallerHash != "" && s.config.CollectCallerDepth > 0 {
-			// we have a caller hash, so add it to the caller history if we haven't already
-			if _, ok := callerHashMap[statValue.CallerHash]; !ok {
-				callerHashMap[statValue.CallerHash] = struct{}{}
-				callerHistoryValue := &SQLInsightsCallerHistory{
-					ID:        statValue.CallerHash,
-					CreatedAt: now,
-					HashID:    keyHash,
-				}
-				callerHistoryValue.SetJSON(statValue.CallerJSON)
-				callerHistory = append(callerHistory, callerHistoryValue)
-			}
-		}
+	if s.Labels != "" {
+		key += "?" + s.Labels
 	}
+	return key
+}
 
-	validResults := len(statValues) - statHistory.Errors
-	// calculate the avg and median
-	if validResults > 0 {
-		statHistory.TookAvg = statHistory.TookSum / float64(validResults)
-		statHistory.RowsAvg = statHistory.RowsSum / int64(validResults)
-		statHistory.TookMed = calculateMedianFloat64(tookValues)
-		statHistory.RowsMed = calculateMedianInt64(rowValues)
+// weight returns the number of executions this stat represents
+func (s *stat) weight() float64 {
+	if s.Weight <= 0 {
+		return 1
 	}
+	return s.Weight
+}
 
-	return statHistory, callerHistory
+// statAggregate aggregates the stats of a statement, caller, and label set during a report interval in constant memory, so stats are returned to the pool as soon as they are collected
+type statAggregate struct {
+	Key        string
+	KeyHash    string
+	Table      string
+	Database   string
+	Connection string
+	CallerHash string // hash of the callers, empty when callers are not collected or exceeded Config.MaxCallersPerHash
+	CallerJSON []byte
+	NumVars    int
+	Labels     string
+	Name       string // latest name given to the statement with the SettingName directive
+
+	samples    int     // number of stats recorded
+	count      float64 // executions, weighted by the number of executions each sampled stat represents
+	errorCount float64
+	slowCount  float64
+	tookSum    float64
+	rowsSum    float64
+	took       sketch // execution durations of all executions, errors still consumed DB time
+	rows       sketch // rows affected/returned by successful executions
+	latency    latencyHistogram
+	traceID    string  // trace ID of the slowest slow execution with a trace, stored as an exemplar
+	traceTook  float64 // execution duration of the traceID execution
+
+	errors []*errorAggregate // errors by class and code
 }
 
-// calculateMedianFloat64 calculates the median value from the specified list of float64 values. Does alter the sorce slice when sorting, which we dont care about here
-func calculateMedianFloat64(values []float64) float64 {
-	sort.Float64s(values)
+// errorAggregate aggregates the errors of a statement sharing the same error class and code
+type errorAggregate struct {
+	Class   string
+	Code    string
+	Message string // first error message seen
+	count   float64
+	tookSum float64
+	tookMax float64
+}
 
-	var median float64
-	l := len(values)
-	if l == 0 {
-		return 0
-	} else if l%2 == 0 {
-		median = (values[l/2-1] + values[l/2]) / 2
+// add adds the stat to the aggregate
+func (a *statAggregate) add(statValue *stat) {
+	if a.samples == 0 {
+		a.Key, a.KeyHash, a.NumVars, a.Labels = statValue.Key, statValue.KeyHash, statValue.NumVars, statValue.Labels
+		a.Table = statValue.Table
+		a.Database, a.Connection = statValue.Database, statValue.Connection
+		a.CallerHash, a.CallerJSON = statValue.CallerHash, statValue.CallerJSON
+	}
+	if statValue.Name != "" {
+		a.Name = statValue.Name
+	}
+	weight := statValue.weight()
+	a.samples++
+	a.count += weight
+	if statValue.Slow {
+		a.slowCount += weight
+	}
+	if statValue.TraceID != "" && statValue.Took >= a.traceTook {
+		a.traceID, a.traceTook = statValue.TraceID, statValue.Took
+	}
+
+	// errors keep their timings, they still consumed DB time
+	a.took.add(statValue.Took, weight)
+	a.latency.add(statValue.Took, weight)
+	a.tookSum += statValue.Took * weight
+
+	if statValue.Error {
+		// increment the error count, skip the row statistics
+		a.errorCount += weight
+		a.addError(statValue, weight)
 	} else {
-		median = values[l/2]
+		a.rows.add(float64(statValue.Rows), weight)
+		a.rowsSum += float64(statValue.Rows) * weight
 	}
+}
 
-	return median
+// addError adds the error of the stat to the errors by class and code
+func (a *statAggregate) addError(statValue *stat, weight float64) {
+	var errorValue *errorAggregate
+	for _, existing := range a.errors {
+		if existing.Class == statValue.ErrorClass && existing.Code == statValue.ErrorCode {
+			errorValue = existing
+			break
+		}
+	}
+	if errorValue == nil {
+		errorValue = &errorAggregate{
+			Class:   statValue.ErrorClass,
+			Code:    statValue.ErrorCode,
+			Message: statValue.ErrorMessage,
+		}
+		a.errors = append(a.errors, errorValue)
+	}
+	errorValue.count += weight
+	errorValue.tookSum += statValue.Took * weight
+	if statValue.Took > errorValue.tookMax {
+		errorValue.tookMax = statValue.Took
+	}
 }
 
-// calculateMedianInt64 calculates the median value from the specified list of int64 values. Does alter the sorce slice when sorting, which we dont care about here
-func calculateMedianInt64(values []int64) int64 {
-	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+// reset clears the aggregate for the next report interval, keeping its allocations
+func (a *statAggregate) reset() {
+	a.Name = ""
+	a.samples, a.count, a.errorCount, a.slowCount, a.tookSum, a.rowsSum = 0, 0, 0, 0, 0, 0
+	a.traceID, a.traceTook = "", 0
+	a.took.reset()
+	a.rows.reset()
+	clear(a.latency[:])
+	clear(a.errors)
+	a.errors = a.errors[:0]
+}
 
-	var median int64
-	l := len(values)
-	if l == 0 {
-		return 0
-	} else if l%2 == 0 {
-		median = (values[l/2-1] + values[l/2]) / 2
-	} else {
-		median = values[l/2]
+// buildStatHistory builds a stat history and the caller history (if enabled) from the specified aggregate
+func (s *SQLInsights) buildStatHistory(bucket reportBucket, sType statType, agg *statAggregate) (*SQLInsightsHistory, []*SQLInsightsCallerHistory) {
+	if agg == nil || agg.samples <= 0 {
+		return nil, nil
+	}
+
+	// build the stat history
+	statHistory := &SQLInsightsHistory{
+		InstanceID: s.instanceAppID,
+		CreatedAt:  bucket.Start,
+		EndedAt:    bucket.End,
+		HashID:     agg.KeyHash,
+		Type:       sType,
+		Database:   agg.Database,
+		Connection: agg.Connection,
+		CallerHash: agg.CallerHash,
+		Labels:     agg.Labels,
+		Count:      int(math.Round(agg.count)),
+		Errors:     int(math.Round(agg.errorCount)),
+		Slow:       int(math.Round(agg.slowCount)),
+		TraceID:    agg.traceID,
+		SampleRate: float64(agg.samples) / agg.count,
+		TookMin:    agg.took.min,
+		TookMax:    agg.took.max,
+		TookAvg:    agg.tookSum / agg.count,
+		TookSum:    agg.tookSum,
+		TookMed:    agg.took.quantile(0.5),
+		TookP90:    agg.took.quantile(0.9),
+		TookP95:    agg.took.quantile(0.95),
+		TookP99:    agg.took.quantile(0.99),
+		TookP999:   agg.took.quantile(0.999),
+		TookStdDev: agg.took.stdDev(),
+		Latency:    agg.latency.encode(),
+		RowsMin:    -1,
+		RowsSum:    int64(math.Round(agg.rowsSum)),
+	}
+	if validResults := agg.count - agg.errorCount; validResults > 0 && agg.rows.count > 0 {
+		statHistory.RowsMin = int64(agg.rows.min)
+		statHistory.RowsMax = int64(agg.rows.max)
+		statHistory.RowsAvg = int64(math.Round(agg.rowsSum / validResults))
+		statHistory.RowsMed = int64(math.Round(agg.rows.quantile(0.5)))
+		statHistory.RowsP90 = int64(math.Round(agg.rows.quantile(0.9)))
+		statHistory.RowsP95 = int64(math.Round(agg.rows.quantile(0.95)))
+		statHistory.RowsP99 = int64(math.Round(agg.rows.quantile(0.99)))
+		statHistory.RowsP999 = int64(math.Round(agg.rows.quantile(0.999)))
+		statHistory.RowsStdDev = agg.rows.stdDev()
 	}
 
-	return median
+	if agg.CallerHash == "" || s.config.CollectCallerDepth <= 0 {
+		return statHistory, nil
+	}
+	callerHistoryValue := &SQLInsightsCallerHistory{
+		ID:        agg.CallerHash,
+		CreatedAt: bucket.Start,
+		HashID:    agg.KeyHash,
+	}
+	callerHistoryValue.SetJSON(agg.CallerJSON)
+	return statHistory, []*SQLInsightsCallerHistory{callerHistoryValue}
 }
@@ -0,0 +1,154 @@
+package insights
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// StatsDConfig defines the configuration of the StatsD/DogStatsD emitter, sending the statistics of every report interval to a local agent over UDP
+type StatsDConfig struct {
+	// Address is the UDP address of the agent, defaults to 127.0.0.1:8125
+	Address string
+
+	// Prefix is prepended to the metric names, defaults to "gorm_sql_insights."
+	Prefix string
+
+	// Tags are added to every metric, ex. "env:production"
+	Tags []string
+
+	// MaxPacketSize is the maximum size in bytes of a UDP packet, metrics are batched into packets up to this size. Defaults to 1432 to stay under an Ethernet MTU
+	MaxPacketSize int
+}
+
+// applyDefaults applies default values to the StatsD config if they are not set
+func (c *StatsDConfig) applyDefaults() {
+	if c.Address == "" {
+		c.Address = "127.0.0.1:8125"
+	}
+	if c.Prefix == "" {
+		c.Prefix = "gorm_sql_insights."
+	}
+	if c.MaxPacketSize <= 0 {
+		c.MaxPacketSize = 1432
+	}
+}
+
+// _statsdTagReplacer replaces the characters delimiting metrics and tags in tag values
+var _statsdTagReplacer = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+
+// statsdEmitter batches metrics in the DogStatsD format into UDP packets. It is only used by the collector while holding statsLock
+type statsdEmitter struct {
+	config *StatsDConfig
+	conn   net.Conn
+	tags   string // tags of every metric, starting with the instance ID
+	packet []byte
+}
+
+// newStatsDEmitter creates a new emitter tagging every metric with the instance ID and the configured tags
+func newStatsDEmitter(config *StatsDConfig, instanceID string) *statsdEmitter {
+	tags := "instance_id:" + _statsdTagReplacer.Replace(instanceID)
+	for _, tag := range config.Tags {
+		tags += "," + _statsdTagReplacer.Replace(tag)
+	}
+	return &statsdEmitter{
+		config: config,
+		tags:   tags,
+		packet: make([]byte, 0, config.MaxPacketSize),
+	}
+}
+
+// unsafeEmitStatistics sends the counts, execution durations, and errors of every statement aggregated during the report interval, and the statistics dropped per buffer.
+// It is not thread safe and assumes statsLock is already locked
+func (s *SQLInsights) unsafeEmitStatistics(dropped [3]int64) {
+	e := s.statsd
+	for sType, statTypeMap := range s.stats {
+		for _, agg := range statTypeMap {
+			if agg.samples <= 0 || agg.KeyHash == "" {
+				continue
+			}
+			tags := e.tags + ",type:" + sType.String() + ",hash:" + agg.KeyHash
+			if agg.Table != "" {
+				tags += ",table:" + _statsdTagReplacer.Replace(agg.Table)
+			}
+			if agg.Database != "" {
+				tags += ",database:" + _statsdTagReplacer.Replace(agg.Database)
+			}
+
+			e.add("statements", strconv.FormatInt(int64(math.Round(agg.count)), 10), "c", "", tags)
+			if agg.slowCount > 0 {
+				e.add("slow", strconv.FormatInt(int64(math.Round(agg.slowCount)), 10), "c", "", tags)
+			}
+			for _, errorValue := range agg.errors {
+				e.add("errors", strconv.FormatInt(int64(math.Round(errorValue.count)), 10), "c", "", tags+",error_class:"+errorValue.Class)
+			}
+
+			// send the representative duration of every sketch bin once, sampled at the inverse of its count so the agent counts it as often as it occurred
+			agg.took.forEachBin(func(value, weight float64) {
+				rate := ""
+				if weight > 1 {
+					rate = strconv.FormatFloat(1/weight, 'g', 6, 64)
+				}
+				e.add("duration", strconv.FormatFloat(value, 'f', -1, 64), "d", rate, tags)
+			})
+		}
+	}
+	for idx, buffer := range [3]string{"stats", "tx_stats", "repetitions"} {
+		if dropped[idx] > 0 {
+			e.add("dropped", strconv.FormatInt(dropped[idx], 10), "c", "", e.tags+",buffer:"+buffer)
+		}
+	}
+	e.flush()
+}
+
+// add adds a metric to the current packet in the DogStatsD format, name:value|type|@rate|#tags, sending the packet first if the metric does not fit
+func (e *statsdEmitter) add(name, value, metricType, rate, tags string) {
+	size := len(e.config.Prefix) + len(name) + 1 + len(value) + 1 + len(metricType) + 2 + len(tags)
+	if rate != "" {
+		size += 2 + len(rate)
+	}
+	if len(e.packet) > 0 && len(e.packet)+1+size > e.config.MaxPacketSize {
+		e.flush()
+	}
+	if len(e.packet) > 0 {
+		e.packet = append(e.packet, '\n')
+	}
+	e.packet = append(e.packet, e.config.Prefix...)
+	e.packet = append(e.packet, name...)
+	e.packet = append(e.packet, ':')
+	e.packet = append(e.packet, value...)
+	e.packet = append(e.packet, '|')
+	e.packet = append(e.packet, metricType...)
+	if rate != "" {
+		e.packet = append(e.packet, "|@"...)
+		e.packet = append(e.packet, rate...)
+	}
+	e.packet = append(e.packet, "|#"...)
+	e.packet = append(e.packet, tags...)
+}
+
+// flush sends the current packet. Metrics are best effort, a packet that can not be sent is dropped
+func (e *statsdEmitter) flush() {
+	if len(e.packet) == 0 {
+		return
+	}
+	if e.conn == nil {
+		conn, err := net.Dial("udp", e.config.Address)
+		if err != nil {
+			e.packet = e.packet[:0]
+			return
+		}
+		e.conn = conn
+	}
+	_, _ = e.conn.Write(e.packet)
+	e.packet = e.packet[:0]
+}
+
+// close closes the UDP connection to the agent
+func (e *statsdEmitter) close() {
+	if e.conn != nil {
+		_ = e.conn.Close()
+		e.conn = nil
+	}
+}
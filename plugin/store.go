@@ -0,0 +1,152 @@
+package insights
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+var (
+	// ErrNoStore is returned by the dashboard API when the plugin has neither a Config.Store nor a Config.DB to read statistics from
+	ErrNoStore = errors.New("no statistics store")
+	// ErrSummaryGroup is returned by the summary read queries of a Store for a column their records can not be grouped by
+	ErrSummaryGroup = errors.New("unsupported summary group")
+
+	// the built in stores implement Store
+	_ Store = &GormStore{}
+	_ Store = &MemoryStore{}
+)
+
+// Store stores the reported statistics and answers the read queries of the dashboard API. See GormStore, used by default when Config.DB is set, and MemoryStore.
+// The plugin calls the write methods from its background collector and the read methods from dashboard API requests, so implementations must be safe for concurrent use
+type Store interface {
+	// Migrate creates or updates the storage of the statistics, called when the plugin is created unless Config.SkipAutomigration is set
+	Migrate() error
+
+	// InstanceAppID returns the ID of the instance name, creating it if it does not exist yet
+	InstanceAppID(instanceID string) (uint, error)
+
+	// KnownHashes returns all stored statement hashes, so the plugin does not store them again
+	KnownHashes() ([]*SQLInsightsHash, error)
+
+	// KnownCallers returns the caller hash (ID) and hash ID of all stored callers, the caller values may be omitted
+	KnownCallers() ([]*SQLInsightsCallerHistory, error)
+
+	// SaveReport stores the statistics of a report interval. Statement hashes and callers already stored must be skipped, a stored hash given a Name must have its name updated.
+	// The slices of the report are reused by the plugin after the call, the records they point to are not
+	SaveReport(report *Report) error
+
+	// Purge removes the history of the instance created before the specified time from every kind of history: statements, errors, transactions, repetitions, connection pools, and drops.
+	// Statement hashes and callers are shared by instances and kept
+	Purge(instanceAppID uint, before time.Time) error
+
+	// StatementHistory returns the statement history matching the filter, along with the instance name and statement name
+	StatementHistory(filter *HistoryFilter) ([]*SQLInsightsQueryQueryHistoryDBResult, error)
+
+	// ConnectionCounts returns the number of statements per instance, report, database, and connection matching the filter. Only InstanceID, CreatedAt, Database, Connection, and Count are set
+	ConnectionCounts(filter *HistoryFilter) ([]*SQLInsightsHistory, error)
+
+	// LatencyHistory returns the statement history with latency buckets matching the filter, sorted by creation time. Only CreatedAt and Latency are required
+	LatencyHistory(filter *HistoryFilter) ([]*SQLInsightsHistory, error)
+
+	// StatementSummary returns the statement history matching the filter summed per group of the groupBy columns (hash_id, type, caller_hash, and labels), sorted by the total execution
+	// duration descending. Returns up to limit groups, all groups when limit is 0. Only the groupBy columns, Count, Errors, Slow, RowsSum, TookSum, and TookMax are set
+	StatementSummary(filter *HistoryFilter, groupBy []string, limit int) ([]*SQLInsightsHistory, error)
+
+	// ErrorSummary returns the error history matching the filter summed per group of the groupBy columns (class, code, hash_id, and type), sorted by count descending.
+	// Returns up to limit groups, all groups when limit is 0. Only the groupBy columns, Count, TookSum, and TookMax are set, along with the most recent sample Message when grouping by hash_id
+	ErrorSummary(filter *HistoryFilter, groupBy []string, limit int) ([]*SQLInsightsErrorHistory, error)
+
+	// TxSummary returns the transaction history matching the filter summed per first statement and caller, sorted descending by orderBy (took_max, took_sum, took_avg, idle_max,
+	// idle_sum, count, or rollbacks, defaulting to took_max). Returns up to limit groups, all groups when limit is 0. Minimums and maximums are kept, HashIDs merges the hash IDs of the group
+	TxSummary(filter *HistoryFilter, orderBy string, limit int) ([]*SQLInsightsTxHistory, error)
+
+	// RepetitionSummary returns the repetition history matching the filter summed per statement and caller, sorted by the total number of repeated executions descending.
+	// Returns up to limit groups, all groups when limit is 0. Only HashID, CallerHash, Type, Occurrences, RepetitionsSum, and RepetitionsMax are set
+	RepetitionSummary(filter *HistoryFilter, limit int) ([]*SQLInsightsRepetitionHistory, error)
+
+	// PoolHistory returns the connection pool history matching the filter, along with the instance name, sorted by creation time
+	PoolHistory(filter *HistoryFilter) ([]*SQLPoolHistoryResult, error)
+
+	// Hashes returns the statement hashes with the specified IDs
+	Hashes(ids []string) ([]*SQLInsightsHash, error)
+
+	// Callers returns the callers of the statements with the specified hash IDs
+	Callers(hashIDs []string) ([]*SQLInsightsCallerHistory, error)
+
+	// CallersContaining returns the callers whose serialized value contains the text, such as a function name
+	CallersContaining(text string) ([]*SQLInsightsCallerHistory, error)
+}
+
+// Report defines the statistics of a report interval to be stored
+type Report struct {
+	Hashes       []*SQLInsightsHash              // statement hashes not stored before
+	HashNames    map[string]string               // hash ID -> new name of statement hashes stored before
+	Callers      []*SQLInsightsCallerHistory     // callers not stored before
+	Statements   []*SQLInsightsHistory           // statement history
+	Errors       []*SQLInsightsErrorHistory      // error history
+	Transactions []*SQLInsightsTxHistory         // transaction history
+	Repetitions  []*SQLInsightsRepetitionHistory // repetition history
+	Pools        []*SQLInsightsPoolHistory       // connection pool history
+	Drops        *SQLInsightsDropHistory         // dropped statistics, nil if none were dropped
+}
+
+// HistoryFilter defines the records returned by the read queries of a Store. Empty lists match all records, each query only applies the fields its records have
+type HistoryFilter struct {
+	InstanceAppIDs []string
+	Databases      []string
+	Types          []string
+	HashIDs        []string
+	CallerHashes   []string
+	Classes        []string // error classes
+	From           time.Time
+	To             time.Time
+}
+
+// newHistoryFilter creates a filter for the specified optional from and to times, defaulting to the last 7 days
+func newHistoryFilter(instanceAppIDs []string, from, to *time.Time) *HistoryFilter {
+	fromTime, toTime := dashboardTimeRange(from, to)
+	return &HistoryFilter{
+		InstanceAppIDs: instanceAppIDs,
+		From:           fromTime,
+		To:             toTime,
+	}
+}
+
+// dashboardStore returns the store the dashboard API reads statistics from
+func (s *SQLInsights) dashboardStore() (Store, error) {
+	if s.store == nil {
+		return nil, ErrNoStore
+	}
+	return s.store, nil
+}
+
+const (
+	// columns the summary read queries of a Store group their records by
+	_summaryHashID     = "hash_id"
+	_summaryType       = "type"
+	_summaryCallerHash = "caller_hash"
+	_summaryLabels     = "labels"
+	_summaryClass      = "class"
+	_summaryCode       = "code"
+
+	// orders of the transaction summary
+	_txOrderTookMax   = "took_max"
+	_txOrderTookSum   = "took_sum"
+	_txOrderTookAvg   = "took_avg"
+	_txOrderIdleMax   = "idle_max"
+	_txOrderIdleSum   = "idle_sum"
+	_txOrderCount     = "count"
+	_txOrderRollbacks = "rollbacks"
+)
+
+// checkSummaryGroup returns ErrSummaryGroup unless every groupBy column is one of the allowed columns
+func checkSummaryGroup(groupBy []string, allowed ...string) error {
+	for _, column := range groupBy {
+		if !slices.Contains(allowed, column) {
+			return fmt.Errorf("%w: %q", ErrSummaryGroup, column)
+		}
+	}
+	return nil
+}
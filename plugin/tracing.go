@@ -0,0 +1,145 @@
+package insights
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	// _tracerName is the instrumentation name of the tracer creating our statement spans
+	_tracerName = "github.com/viocle/go-gorm-sql-insights/plugin"
+)
+
+// attribute keys of our statement spans, following the OpenTelemetry database semantic conventions where one exists
+const (
+	AttributeDBSystem       = attribute.Key("db.system")
+	AttributeDBName         = attribute.Key("db.name")
+	AttributeDBStatement    = attribute.Key("db.statement")
+	AttributeDBOperation    = attribute.Key("db.operation")
+	AttributeDBTable        = attribute.Key("db.sql.table")
+	AttributeDBRowsAffected = attribute.Key("db.rows_affected")
+	AttributeCodeFunction   = attribute.Key("code.function")
+	AttributeCodeFilepath   = attribute.Key("code.filepath")
+	AttributeCodeLineNumber = attribute.Key("code.lineno")
+	AttributeErrorType      = attribute.Key("error.type")
+
+	// AttributeHash is the hash ID of the parameterized statement, the HashID of its statistics
+	AttributeHash = attribute.Key("db.sql_insights.hash")
+	// AttributeStatementType is the statement type (query, raw, create, update, delete, row)
+	AttributeStatementType = attribute.Key("db.sql_insights.type")
+	// AttributeConnection is the connection the statement was executed on, see DatabasePlugin.NameConnection
+	AttributeConnection = attribute.Key("db.sql_insights.connection")
+)
+
+// startSpan starts a span for the statement as a child of the span in the statement context, setting the statement context to the new span so drivers and nested instrumentation see it.
+// Returns the span and the statement context before it was started, to be restored by endSpan. Returns a nil span when tracing is not enabled
+func (s *SQLInsights) startSpan(db *gorm.DB, sType statType) (trace.Span, context.Context) {
+	if s.tracer == nil {
+		return nil, nil
+	}
+	parent := db.Statement.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	// the SQL is not built yet, the span is renamed once it is
+	ctx, span := s.tracer.Start(parent, "gorm."+sType.String(), trace.WithSpanKind(trace.SpanKindClient))
+	db.Statement.Context = ctx
+	return span, parent
+}
+
+// endSpan restores the statement context and ends the span of the statement, if any, with the statement details and its error
+func (s *SQLInsights) endSpan(db *gorm.DB, start statementStart, database string, sType statType, key string, isError bool) {
+	if start.Span == nil {
+		return
+	}
+	// a reused statement must not start its next span as a child of this one
+	db.Statement.Context = start.Context
+
+	operation := sqlOperation(key)
+	name := operation
+	if name == "" {
+		name = "gorm." + sType.String()
+	}
+	if db.Statement.Table != "" {
+		name += " " + db.Statement.Table
+	}
+	start.Span.SetName(name)
+
+	attrs := make([]attribute.KeyValue, 0, 14)
+	attrs = append(attrs,
+		AttributeDBSystem.String(dbSystem(db)),
+		AttributeDBStatement.String(key),
+		AttributeDBOperation.String(operation),
+		AttributeHash.String(hash(key)),
+		AttributeStatementType.String(sType.String()),
+		AttributeConnection.String(s.statementConnection(db, sType)),
+		AttributeDBRowsAffected.Int64(db.RowsAffected),
+	)
+	if database != "" {
+		attrs = append(attrs, AttributeDBName.String(database))
+	}
+	if db.Statement.Table != "" {
+		attrs = append(attrs, AttributeDBTable.String(db.Statement.Table))
+	}
+	if callers := s.getCallers(1); len(callers) > 0 {
+		attrs = append(attrs,
+			AttributeCodeFunction.String(callers[0].Function),
+			AttributeCodeFilepath.String(callers[0].Filename),
+			AttributeCodeLineNumber.Int(callers[0].Line),
+		)
+	}
+	if isError {
+		class, _ := classifyError(db.Error)
+		attrs = append(attrs, AttributeErrorType.String(class))
+		start.Span.RecordError(db.Error)
+		start.Span.SetStatus(codes.Error, errorMessage(db.Error))
+	}
+	start.Span.SetAttributes(attrs...)
+	start.Span.End()
+}
+
+// statementTraceID returns the hex encoded trace ID of the span of the statement, or of the span in its context when it was not traced by us. Returns an empty string if there is none
+func statementTraceID(ctx context.Context, span trace.Span) string {
+	var spanContext trace.SpanContext
+	if span != nil {
+		spanContext = span.SpanContext()
+	} else if ctx != nil {
+		spanContext = trace.SpanContextFromContext(ctx)
+	}
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// sqlOperation returns the upper cased first keyword of the SQL statement, ex. SELECT, or an empty string if there is none
+func sqlOperation(sql string) string {
+	sql = strings.TrimLeft(sql, " \t\r\n(")
+	end := strings.IndexAny(sql, " \t\r\n(;")
+	if end < 0 {
+		end = len(sql)
+	}
+	return strings.ToUpper(sql[:end])
+}
+
+// dbSystem returns the db.system semantic convention value of the dialector of the DB
+func dbSystem(db *gorm.DB) string {
+	if db.Dialector == nil {
+		return "other_sql"
+	}
+	switch name := db.Dialector.Name(); name {
+	case "postgres":
+		return "postgresql"
+	case "sqlserver":
+		return "mssql"
+	case "":
+		return "other_sql"
+	default:
+		return name
+	}
+}
@@ -0,0 +1,374 @@
+package insights
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// _maxTxFingerprints is the maximum number of distinct statement fingerprints tracked for a single transaction or transaction history record
+	_maxTxFingerprints = 100
+)
+
+var (
+	// Ensure our connection pool wrappers implement the gorm interfaces we rely on
+	_ gorm.ConnPoolBeginner = &txConnPool{}
+	_ gorm.GetDBConnector   = &txConnPool{}
+	_ gorm.Tx               = &insightsTx{}
+	_ gorm.GetDBConnector   = &insightsTx{}
+)
+
+// txStat defines a completed transaction to be collected, aggregated, and stored
+type txStat struct {
+	TimeStamp  time.Time
+	Key        string // first statement executed in the transaction
+	KeyHash    string
+	Keys       []string // distinct statements executed in the transaction
+	KeyHashes  []string
+	Callers    []*callerInfo // callers of the first statement executed in the transaction
+	CallerHash string
+	Statements int
+	Took       float64 // transaction lifetime in fractional milliseconds
+	Idle       float64 // time spent between statements in fractional milliseconds
+	Committed  bool
+}
+
+// groupKey returns the key used to aggregate this transaction, the first statement fingerprint plus caller
+func (t *txStat) groupKey() string {
+	return t.KeyHash + t.CallerHash
+}
+
+// txConnPool wraps the connection pool of the monitored gorm DB so transactions started through it can be tracked
+type txConnPool struct {
+	gorm.ConnPool
+	s *SQLInsights
+}
+
+// BeginTx begins a transaction on the wrapped connection pool and returns it wrapped for tracking
+func (p *txConnPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	var tx gorm.ConnPool
+	switch beginner := p.ConnPool.(type) {
+	case gorm.TxBeginner:
+		sqlTx, err := beginner.BeginTx(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		tx = sqlTx
+	case gorm.ConnPoolBeginner:
+		poolTx, err := beginner.BeginTx(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		tx = poolTx
+	default:
+		return nil, gorm.ErrInvalidTransaction
+	}
+
+	now := time.Now().UTC()
+	return &insightsTx{
+		ConnPool:     tx,
+		s:            p.s,
+		parent:       p.ConnPool,
+		startedAt:    now,
+		lastActivity: now,
+	}, nil
+}
+
+// GetDBConn returns the *sql.DB of the wrapped connection pool so gorm's DB() continues to work
+func (p *txConnPool) GetDBConn() (*sql.DB, error) {
+	return getDBConn(p.ConnPool)
+}
+
+// insightsTx wraps a transaction started through txConnPool, tracking the statements executed inside it and its outcome
+type insightsTx struct {
+	gorm.ConnPool
+	s      *SQLInsights
+	parent gorm.ConnPool
+
+	lock         sync.Mutex
+	startedAt    time.Time
+	lastActivity time.Time
+	statements   int
+	idle         float64
+	firstKey     string
+	firstCallers []*callerInfo
+	keys         map[string]struct{}
+	finished     bool
+}
+
+// Commit commits the wrapped transaction and reports it
+func (t *insightsTx) Commit() error {
+	committer, ok := t.ConnPool.(gorm.TxCommitter)
+	if !ok {
+		return gorm.ErrInvalidTransaction
+	}
+	err := committer.Commit()
+	// a failed commit did not persist anything, so it is reported as a rollback
+	t.finish(err == nil)
+	return err
+}
+
+// Rollback rolls back the wrapped transaction and reports it
+func (t *insightsTx) Rollback() error {
+	committer, ok := t.ConnPool.(gorm.TxCommitter)
+	if !ok {
+		return gorm.ErrInvalidTransaction
+	}
+	err := committer.Rollback()
+	t.finish(false)
+	return err
+}
+
+// StmtContext returns a transaction specific prepared statement, used by gorm's prepared statement mode
+func (t *insightsTx) StmtContext(ctx context.Context, stmt *sql.Stmt) *sql.Stmt {
+	if tx, ok := t.ConnPool.(gorm.Tx); ok {
+		return tx.StmtContext(ctx, stmt)
+	}
+	return stmt
+}
+
+// GetDBConn returns the *sql.DB the transaction was started from so gorm's DB() continues to work
+func (t *insightsTx) GetDBConn() (*sql.DB, error) {
+	return getDBConn(t.parent)
+}
+
+// recordStatement records a statement executed inside this transaction that finished at the specified time
+func (t *insightsTx) recordStatement(key string, took float64, end time.Time, callers []*callerInfo) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finished {
+		return
+	}
+
+	// anything between the end of the last activity and the start of this statement is idle time
+	start := end.Add(-time.Duration(took * float64(time.Millisecond)))
+	if gap := start.Sub(t.lastActivity); gap > 0 {
+		t.idle += durationMilliseconds(gap)
+	}
+	if end.After(t.lastActivity) {
+		t.lastActivity = end
+	}
+	t.statements++
+	if t.firstKey == "" {
+		t.firstKey = key
+		t.firstCallers = callers
+	}
+	if t.keys == nil {
+		t.keys = make(map[string]struct{}, 5)
+	}
+	if len(t.keys) < _maxTxFingerprints {
+		t.keys[key] = struct{}{}
+	}
+}
+
+// firstStatementPending returns true if no statement has been recorded in this transaction yet
+func (t *insightsTx) firstStatementPending() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.firstKey == ""
+}
+
+// finish marks the transaction as complete and sends it to the background collector. Only the first call is reported
+func (t *insightsTx) finish(committed bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finished {
+		return
+	}
+	t.finished = true
+	if t.statements == 0 || t.firstKey == "" {
+		// nothing we track was executed in this transaction, such as our own statistics storage
+		return
+	}
+
+	now := time.Now().UTC()
+	idle := t.idle
+	if gap := now.Sub(t.lastActivity); gap > 0 {
+		idle += durationMilliseconds(gap)
+	}
+	keys := make([]string, 0, len(t.keys))
+	for key := range t.keys {
+		keys = append(keys, key)
+	}
+	t.s.insightsAddTxStat(&txStat{
+		TimeStamp:  now,
+		Key:        t.firstKey,
+		Keys:       keys,
+		Callers:    t.firstCallers,
+		Statements: t.statements,
+		Took:       durationMilliseconds(now.Sub(t.startedAt)),
+		Idle:       idle,
+		Committed:  committed,
+	})
+}
+
+// statementTx returns the tracked transaction the statement is executing in, if any
+func statementTx(db *gorm.DB) *insightsTx {
+	switch pool := db.Statement.ConnPool.(type) {
+	case *insightsTx:
+		return pool
+	case *gorm.PreparedStmtTX:
+		if tx, ok := pool.Tx.(*insightsTx); ok {
+			return tx
+		}
+	}
+	return nil
+}
+
+// getDBConn returns the *sql.DB for the specified connection pool
+func getDBConn(pool gorm.ConnPool) (*sql.DB, error) {
+	switch p := pool.(type) {
+	case *sql.DB:
+		return p, nil
+	case gorm.GetDBConnector:
+		return p.GetDBConn()
+	}
+	return nil, gorm.ErrInvalidDB
+}
+
+// wrapConnPool wraps the connection pool of the specified gorm DB instance so transactions can be tracked
+func (s *SQLInsights) wrapConnPool(db *gorm.DB) {
+	if _, ok := db.Config.ConnPool.(*txConnPool); ok || db.Config.ConnPool == nil {
+		// already wrapped or nothing to wrap
+		return
+	}
+	pool := &txConnPool{ConnPool: db.Config.ConnPool, s: s}
+	db.Config.ConnPool = pool
+	if db.Statement != nil {
+		db.Statement.ConnPool = pool
+	}
+}
+
+// unwrapConnPool restores the original connection pool of the specified gorm DB instance
+func (s *SQLInsights) unwrapConnPool(db *gorm.DB) {
+	pool, ok := db.Config.ConnPool.(*txConnPool)
+	if !ok {
+		return
+	}
+	db.Config.ConnPool = pool.ConnPool
+	if db.Statement != nil && db.Statement.ConnPool == pool {
+		db.Statement.ConnPool = pool.ConnPool
+	}
+}
+
+// insightsAddTxStat adds a transaction statistic to be collected by the background collector
+func (s *SQLInsights) insightsAddTxStat(txValue *txStat) {
+	if txValue == nil || txValue.Key == "" {
+		return
+	}
+
+	// create hashes of the first and all executed statements
+	txValue.KeyHash = hash(txValue.Key)
+	txValue.KeyHashes = make([]string, 0, len(txValue.Keys))
+	for _, key := range txValue.Keys {
+		txValue.KeyHashes = append(txValue.KeyHashes, hash(key))
+	}
+
+	// get hash of the first statement callers if we are tracking them
+	if s.config.CollectCallerDepth > 0 {
+		_, txValue.CallerHash = s.hashCallers(txValue.Callers)
+	}
+
+	// send to the transaction stats channel, applying our backpressure policy if the buffer is full
+	s.droppedTxStats.Add(sendWithBackpressure(s, s.txStatsChan, txValue))
+}
+
+// unsafeAddTxStat stores the transaction statistic in the transaction stats table. It is not thread safe and assumes statsLock is already locked
+func (s *SQLInsights) unsafeAddTxStat(txValue *txStat) {
+	if txValue.KeyHash == "" {
+		return
+	}
+	groupKey := txValue.groupKey()
+	if _, ok := s.txStats[groupKey]; !ok {
+		s.txStats[groupKey] = make([]*txStat, 0, 10)
+	}
+	s.txStats[groupKey] = append(s.txStats[groupKey], txValue)
+}
+
+// buildTxHistory builds a transaction history from the specified list of transaction stat values which all share the same first statement and caller
+func (s *SQLInsights) buildTxHistory(bucket reportBucket, txValues []*txStat) *SQLInsightsTxHistory {
+	if len(txValues) <= 0 {
+		return nil
+	}
+
+	txHistory := &SQLInsightsTxHistory{
+		InstanceID: s.instanceAppID,
+		CreatedAt:  bucket.Start,
+		EndedAt:    bucket.End,
+		HashID:     txValues[0].KeyHash,
+		CallerHash: txValues[0].CallerHash,
+		Count:      len(txValues),
+		TookMin:    -1,
+	}
+	hashIDs := make(map[string]struct{}, 5)
+	for _, txValue := range txValues {
+		if txValue.Committed {
+			txHistory.Commits++
+		} else {
+			txHistory.Rollbacks++
+		}
+
+		// Min/Max
+		if txHistory.TookMin < 0 || txValue.Took < txHistory.TookMin {
+			txHistory.TookMin = txValue.Took
+		}
+		if txValue.Took > txHistory.TookMax {
+			txHistory.TookMax = txValue.Took
+		}
+		if txValue.Idle > txHistory.IdleMax {
+			txHistory.IdleMax = txValue.Idle
+		}
+		if txValue.Statements > txHistory.StatementsMax {
+			txHistory.StatementsMax = txValue.Statements
+		}
+
+		// Sums
+		txHistory.TookSum += txValue.Took
+		txHistory.IdleSum += txValue.Idle
+		txHistory.StatementsSum += txValue.Statements
+
+		// distinct fingerprints executed in these transactions
+		for _, keyHash := range txValue.KeyHashes {
+			if len(hashIDs) >= _maxTxFingerprints {
+				break
+			}
+			hashIDs[keyHash] = struct{}{}
+		}
+	}
+	txHistory.TookAvg = txHistory.TookSum / float64(txHistory.Count)
+
+	hashIDList := make([]string, 0, len(hashIDs))
+	for hashID := range hashIDs {
+		hashIDList = append(hashIDList, hashID)
+	}
+	sort.Strings(hashIDList)
+	txHistory.SetHashIDs(hashIDList)
+
+	return txHistory
+}
+
+// SetHashIDs serializes the hash IDs as a JSON string and stores the result in HashIDs
+func (t *SQLInsightsTxHistory) SetHashIDs(hashIDs []string) {
+	if len(hashIDs) > 0 {
+		if b, err := json.Marshal(hashIDs); err == nil {
+			t.HashIDs = b
+		}
+	}
+}
+
+// GetHashIDs deserializes HashIDs and returns the hash IDs of the statements executed in the transactions
+func (t *SQLInsightsTxHistory) GetHashIDs() []string {
+	var hashIDs []string
+	if len(t.HashIDs) > 0 {
+		if err := json.Unmarshal(t.HashIDs, &hashIDs); err != nil {
+			return nil
+		}
+	}
+	return hashIDs
+}